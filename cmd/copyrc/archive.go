@@ -0,0 +1,394 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"gitlab.com/tozd/go/errors"
+)
+
+// 📦 Archive formats an archive entry can be stored as
+const (
+	ArchiveFormatTarGz  = "tar.gz"
+	ArchiveFormatZip    = "zip"
+	ArchiveFormatTarZst = "tar.zst"
+)
+
+// archiveFormat returns the configured format, tar.gz when none is set
+func archiveFormat(args *ArchiveEntry_Options) (string, error) {
+	if args == nil || args.Format == "" {
+		return ArchiveFormatTarGz, nil
+	}
+	switch args.Format {
+	case ArchiveFormatTarGz, ArchiveFormatZip, ArchiveFormatTarZst:
+		return args.Format, nil
+	}
+	return "", errors.Errorf("unsupported archive format %q (expected tar.gz, zip or tar.zst)", args.Format)
+}
+
+// archiveMaxSize returns the configured download limit, DefaultMaxArchiveSize when none is set
+func archiveMaxSize(args *ArchiveEntry_Options) (int64, error) {
+	if args == nil || args.MaxSize == "" {
+		return DefaultMaxArchiveSize, nil
+	}
+	size, err := parseByteSize(args.MaxSize)
+	if err != nil {
+		return 0, errors.Errorf("parsing max_size: %w", err)
+	}
+	return size, nil
+}
+
+// parseByteSize parses sizes like 1024, 500KB, 512MB or 8GiB. KB, MB and GB are powers of 1000,
+// KiB, MiB and GiB powers of 1024.
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+		{"B", 1},
+	}
+
+	scale := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			scale = u.scale
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.Errorf("invalid size %q (expected a positive number with an optional KB, MB, GB, KiB, MiB or GiB suffix)", s)
+	}
+	if n > math.MaxInt64/scale {
+		return 0, errors.Errorf("size %q is too large", s)
+	}
+	return n * scale, nil
+}
+
+// detectArchiveFormat tells the formats apart by their magic bytes
+func detectArchiveFormat(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return ArchiveFormatTarGz, nil
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		return ArchiveFormatZip, nil
+	case bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return ArchiveFormatTarZst, nil
+	}
+	return "", errors.Errorf("invalid archive format - expected gzip, zip or zstd data, got: %s", string(data[:min(len(data), 1024)]))
+}
+
+// 📄 archiveEntry is a file or symlink of an archive, whatever format it was read from
+type archiveEntry struct {
+	Name    string
+	Mode    int64
+	ModTime time.Time
+	Link    string // symlink target, empty for regular files
+	Size    int64  // size of a regular file
+}
+
+// rootPath returns the name below the top-level directory (repo-sha/ on github), false for the directory itself
+func (e archiveEntry) rootPath() (string, bool) {
+	_, name, ok := strings.Cut(e.Name, "/")
+	if !ok || name == "" {
+		return "", false
+	}
+	return path.Clean(name), true
+}
+
+// walkArchive calls fn for the regular files and symlinks of a tar.gz, zip or tar.zst archive in
+// archive order. r reads the contents of a regular file (nil for symlinks) and is only valid
+// during the call, so no more than one entry is ever read at a time.
+func walkArchive(src io.ReaderAt, size int64, fn func(e archiveEntry, r io.Reader) error) error {
+	head := make([]byte, 1024)
+	n, err := src.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return errors.Errorf("reading archive: %w", err)
+	}
+	format, err := detectArchiveFormat(head[:n])
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case ArchiveFormatZip:
+		zr, err := zip.NewReader(src, size)
+		if err != nil {
+			return errors.Errorf("opening zip: %w", err)
+		}
+
+		for _, f := range zr.File {
+			mode := f.Mode()
+			if !mode.IsRegular() && mode&fs.ModeSymlink == 0 {
+				continue
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				return errors.Errorf("opening %s: %w", f.Name, err)
+			}
+
+			entry := archiveEntry{Name: f.Name, Mode: int64(mode.Perm()), ModTime: f.Modified}
+			if mode&fs.ModeSymlink != 0 {
+				target, err := io.ReadAll(rc)
+				if err != nil {
+					rc.Close()
+					return errors.Errorf("reading %s: %w", f.Name, err)
+				}
+				entry.Link = string(target)
+				err = fn(entry, nil)
+			} else {
+				entry.Size = int64(f.UncompressedSize64)
+				err = fn(entry, rc)
+			}
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case ArchiveFormatTarZst:
+		dec, err := zstd.NewReader(io.NewSectionReader(src, 0, size))
+		if err != nil {
+			return errors.Errorf("opening zstd: %w", err)
+		}
+		defer dec.Close()
+		return walkTar(dec, fn)
+
+	default:
+		gz, err := gzip.NewReader(io.NewSectionReader(src, 0, size))
+		if err != nil {
+			return errors.Errorf("opening gzip: %w", err)
+		}
+		defer gz.Close()
+		return walkTar(gz, fn)
+	}
+}
+
+func walkTar(r io.Reader, fn func(e archiveEntry, r io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Errorf("reading archive: %w", err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			err = fn(archiveEntry{Name: hdr.Name, Mode: hdr.Mode, ModTime: hdr.ModTime, Size: hdr.Size}, tr)
+		case tar.TypeSymlink:
+			err = fn(archiveEntry{Name: hdr.Name, Mode: hdr.Mode, ModTime: hdr.ModTime, Link: hdr.Linkname}, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// archiveWriter packs entries, in the order they are added, as format. Compression settings are
+// fixed so the same entries always produce the same bytes.
+type archiveWriter struct {
+	format string
+	zw     *zip.Writer
+	tw     *tar.Writer
+	cw     io.WriteCloser
+}
+
+func newArchiveWriter(w io.Writer, format string) (*archiveWriter, error) {
+	if format == ArchiveFormatZip {
+		return &archiveWriter{format: format, zw: zip.NewWriter(w)}, nil
+	}
+
+	var cw io.WriteCloser
+	if format == ArchiveFormatTarZst {
+		enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, errors.Errorf("creating zstd writer: %w", err)
+		}
+		cw = enc
+	} else {
+		// the default gzip header has no name, a zero mtime and an "unknown" os byte
+		gw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+		if err != nil {
+			return nil, errors.Errorf("creating gzip writer: %w", err)
+		}
+		cw = gw
+	}
+	return &archiveWriter{format: format, tw: tar.NewWriter(cw), cw: cw}, nil
+}
+
+// add writes e with the e.Size bytes of contents read from r, symlinks have none
+func (a *archiveWriter) add(e archiveEntry, r io.Reader) error {
+	if a.zw != nil {
+		hdr := &zip.FileHeader{Name: e.Name, Method: zip.Deflate, Modified: e.ModTime}
+		if e.Link != "" {
+			hdr.SetMode(fs.ModeSymlink | 0777)
+			r = strings.NewReader(e.Link)
+		} else {
+			hdr.SetMode(fs.FileMode(e.Mode).Perm())
+		}
+
+		w, err := a.zw.CreateHeader(hdr)
+		if err != nil {
+			return errors.Errorf("writing zip header: %w", err)
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return errors.Errorf("writing zip content: %w", err)
+		}
+		return nil
+	}
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     e.Name,
+		Size:     e.Size,
+		Mode:     e.Mode,
+		ModTime:  e.ModTime,
+		Format:   tar.FormatPAX,
+	}
+	if e.Link != "" {
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = e.Link
+		hdr.Size = 0
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return errors.Errorf("writing tar header: %w", err)
+	}
+	if hdr.Size > 0 {
+		if _, err := io.CopyN(a.tw, r, hdr.Size); err != nil {
+			return errors.Errorf("writing tar content: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close finishes the archive, it does not close the underlying writer
+func (a *archiveWriter) Close() error {
+	if a.zw != nil {
+		if err := a.zw.Close(); err != nil {
+			return errors.Errorf("closing zip writer: %w", err)
+		}
+		return nil
+	}
+
+	if err := a.tw.Close(); err != nil {
+		return errors.Errorf("closing tar writer: %w", err)
+	}
+	if err := a.cw.Close(); err != nil {
+		return errors.Errorf("closing %s writer: %w", a.format, err)
+	}
+	return nil
+}
+
+// convertArchive writes the entries of the archive in src, in order, to w as format
+func convertArchive(src io.ReaderAt, size int64, w io.Writer, format string) error {
+	aw, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+	if err := walkArchive(src, size, aw.add); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// 📦 repackEpoch is the modification time of every repacked entry
+var repackEpoch = time.Unix(0, 0).UTC()
+
+// repackArchive writes the files of the archive in src whose path below the top-level directory
+// matches patterns and none of ignore to w as format. The result only depends on the kept contents:
+// entries are sorted, modes and mtimes are normalized and the compression header carries no name or
+// time. The kept contents are spooled to a temp file so they can be sorted without holding them.
+func repackArchive(src io.ReaderAt, size int64, w io.Writer, format string, patterns []string, ignore []string) error {
+	spool, err := os.CreateTemp("", ".copyrc-repack-*")
+	if err != nil {
+		return errors.Errorf("creating temp file: %w", err)
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	type spooled struct {
+		entry  archiveEntry
+		offset int64
+	}
+	var entries []spooled
+	var offset int64
+
+	err = walkArchive(src, size, func(e archiveEntry, r io.Reader) error {
+		name, ok := e.rootPath()
+		if !ok || !matchesFilePatterns(name, patterns, ignore) {
+			return nil
+		}
+
+		mode := int64(0644)
+		if e.Mode&0111 != 0 {
+			mode = 0755
+		}
+		kept := spooled{entry: archiveEntry{Name: e.Name, Mode: mode, ModTime: repackEpoch, Link: e.Link}, offset: offset}
+		if e.Link == "" {
+			n, err := io.Copy(spool, r)
+			if err != nil {
+				return errors.Errorf("spooling %s: %w", e.Name, err)
+			}
+			kept.entry.Size = n
+			offset += n
+		}
+		entries = append(entries, kept)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slices.SortFunc(entries, func(a, b spooled) int {
+		return strings.Compare(a.entry.Name, b.entry.Name)
+	})
+
+	aw, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+	for _, kept := range entries {
+		if err := aw.add(kept.entry, io.NewSectionReader(spool, kept.offset, kept.entry.Size)); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
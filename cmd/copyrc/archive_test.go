@@ -0,0 +1,181 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 🧪 testArchiveFile is an archive entry read into memory
+type testArchiveFile struct {
+	archiveEntry
+	Data []byte
+}
+
+// readArchive returns the regular files and symlinks of an archive with their contents
+func readArchive(data []byte) ([]testArchiveFile, error) {
+	var files []testArchiveFile
+	err := walkArchive(bytes.NewReader(data), int64(len(data)), func(e archiveEntry, r io.Reader) error {
+		file := testArchiveFile{archiveEntry: e}
+		if r != nil {
+			contents, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			file.Data = contents
+		}
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+// rewriteTestArchive runs a streaming convert or repack over data in memory
+func rewriteTestArchive(t *testing.T, data []byte, fn func(src io.ReaderAt, size int64, w io.Writer) error) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	require.NoError(t, fn(bytes.NewReader(data), int64(len(data)), &buf))
+	return buf.Bytes()
+}
+
+func TestArchiveFormats(t *testing.T) {
+	source := testArchive(t, time.Now(), []string{"lua/init.lua", "README.md"}, map[string]string{
+		"lua/init.lua": "return {}\n",
+		"README.md":    "# repo\n",
+	})
+
+	for _, format := range []string{ArchiveFormatTarGz, ArchiveFormatZip, ArchiveFormatTarZst} {
+		t.Run(format, func(t *testing.T) {
+			data := rewriteTestArchive(t, source, func(src io.ReaderAt, size int64, w io.Writer) error {
+				return convertArchive(src, size, w, format)
+			})
+
+			detected, err := detectArchiveFormat(data)
+			require.NoError(t, err)
+			assert.Equal(t, format, detected)
+
+			entries, err := readArchive(data)
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+			assert.Equal(t, "repo-abc123/lua/init.lua", entries[0].Name)
+			assert.Equal(t, "return {}\n", string(entries[0].Data))
+
+			// repacking is deterministic in every format
+			repack := func(src io.ReaderAt, size int64, w io.Writer) error {
+				return repackArchive(src, size, w, format, []string{"lua/**"}, nil)
+			}
+			first := rewriteTestArchive(t, data, repack)
+			second := rewriteTestArchive(t, data, repack)
+			assert.Equal(t, first, second)
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := detectArchiveFormat([]byte("<html>not an archive</html>"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid archive format")
+
+		_, err = archiveFormat(&ArchiveEntry_Options{Format: "rar"})
+		require.Error(t, err)
+	})
+}
+
+func TestProcess_ArchiveFormat(t *testing.T) {
+	upstream := filepath.Join(t.TempDir(), "upstream")
+	writeTestFiles(t, upstream, map[string]string{
+		"lua/init.lua": "return {}\n",
+	})
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	t.Run("zip", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      Source{Repo: upstream},
+			Destination: Destination{Path: t.TempDir()},
+			ArchiveArgs: &ArchiveEntry_Options{Format: ArchiveFormatZip, EmbedFS: true},
+		}
+		provider, err := NewLocalProvider()
+		require.NoError(t, err)
+		require.NoError(t, process(ctx, cfg, provider))
+
+		data, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "upstream.zip"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("PK"), data[0:2], "should be zip data")
+
+		code := typecheckEmbed(t, cfg.Destination.Path)
+		assert.Contains(t, code, "//go:embed upstream.zip")
+		assert.Contains(t, code, "zip.NewReader")
+	})
+
+	t.Run("tar.zst", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      Source{Repo: upstream},
+			Destination: Destination{Path: t.TempDir()},
+			ArchiveArgs: &ArchiveEntry_Options{Format: ArchiveFormatTarZst, EmbedFS: true},
+		}
+		provider, err := NewLocalProvider()
+		require.NoError(t, err)
+		require.NoError(t, process(ctx, cfg, provider))
+
+		data, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "upstream.tar.zst"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x28, 0xb5, 0x2f, 0xfd}, data[0:4], "should be zstd data")
+
+		code, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "embed.gen.go"))
+		require.NoError(t, err)
+		assert.Contains(t, string(code), "//go:embed upstream.tar.zst")
+		assert.Contains(t, string(code), `"github.com/klauspost/compress/zstd"`)
+	})
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{input: "1024", want: 1024},
+		{input: "500KB", want: 500_000},
+		{input: "512 MiB", want: 512 << 20},
+		{input: "8GiB", want: 8 << 30},
+		{input: "2GB", want: 2_000_000_000},
+		{input: "0", wantErr: true},
+		{input: "lots", wantErr: true},
+		{input: "-1MB", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseByteSize(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,422 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// 🗄️ DownloadCache keeps downloads on disk, content-addressed by their sha256. A key
+// (provider, repo, commit and file or archive) points at the object it resolved to, so
+// entries pulling the same upstream commit share one download across runs and destinations.
+//
+//	<dir>/objects/ab/ab12...   downloaded content
+//	<dir>/keys/cd/cd34...      sha256 of the object the key resolved to
+type DownloadCache struct {
+	dir string
+
+	mu    sync.Mutex
+	calls map[string]*cacheCall
+}
+
+// cacheCall is a download in flight, concurrent lookups of the same key wait for it
+type cacheCall struct {
+	done chan struct{}
+}
+
+// 🔑 CacheKey identifies a download. Path is the file within the repository, empty for the archive.
+type CacheKey struct {
+	Provider string
+	Repo     string
+	Commit   string
+	Path     string
+}
+
+func (k CacheKey) hash() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{k.Provider, k.Repo, k.Commit, k.Path}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewDownloadCache creates a cache in dir, an empty dir falls back to defaultCacheDir
+func NewDownloadCache(dir string) (*DownloadCache, error) {
+	if dir == "" {
+		var err error
+		dir, err = defaultCacheDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &DownloadCache{
+		dir:   dir,
+		calls: make(map[string]*cacheCall),
+	}, nil
+}
+
+// defaultCacheDir returns $XDG_CACHE_HOME/copyrc/downloads, or the user cache directory
+// of the platform when XDG_CACHE_HOME is not set
+func defaultCacheDir() (string, error) {
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return "", errors.Errorf("getting user cache dir: %w", err)
+		}
+		base = userCache
+	}
+	return filepath.Join(base, "copyrc", "downloads"), nil
+}
+
+func (c *DownloadCache) objectPath(sum string) string {
+	return filepath.Join(c.dir, "objects", sum[:2], sum)
+}
+
+func (c *DownloadCache) keyPath(key CacheKey) string {
+	h := key.hash()
+	return filepath.Join(c.dir, "keys", h[:2], h)
+}
+
+// Get returns the content cached for key, calling fetch on a miss. Commits are immutable so
+// keys never expire, only prune removes them.
+func (c *DownloadCache) Get(key CacheKey, fetch func() ([]byte, error)) ([]byte, error) {
+	defer c.acquire(key)()
+	return c.get(key, fetch)
+}
+
+// acquire waits until no download of key is in flight and registers the caller's, returning
+// the release. A caller that waited finds the object the first one stored, so a key is only
+// downloaded once however many entries ask for it.
+func (c *DownloadCache) acquire(key CacheKey) func() {
+	id := key.hash()
+
+	c.mu.Lock()
+	for {
+		call, ok := c.calls[id]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		<-call.done
+		c.mu.Lock()
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[id] = call
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		delete(c.calls, id)
+		c.mu.Unlock()
+		close(call.done)
+	}
+}
+
+func (c *DownloadCache) get(key CacheKey, fetch func() ([]byte, error)) ([]byte, error) {
+	if data, ok := c.lookup(key); ok {
+		return data, nil
+	}
+
+	data, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.store(key, data); err != nil {
+		return nil, errors.Errorf("caching download: %w", err)
+	}
+	return data, nil
+}
+
+// lookup reads the object of key, anything missing or corrupt is a miss
+func (c *DownloadCache) lookup(key CacheKey) ([]byte, bool) {
+	ref, err := os.ReadFile(c.keyPath(key))
+	if err != nil {
+		return nil, false
+	}
+	sum := strings.TrimSpace(string(ref))
+	if len(sum) != sha256.Size*2 {
+		return nil, false
+	}
+
+	objectPath := c.objectPath(sum)
+	data, err := os.ReadFile(objectPath)
+	if err != nil || sha256Hex(data) != sum {
+		return nil, false
+	}
+
+	// prune goes by the last use
+	now := time.Now()
+	_ = os.Chtimes(objectPath, now, now)
+	return data, true
+}
+
+// lookupFile is lookup for large objects: it returns the object path after hashing it as a stream
+func (c *DownloadCache) lookupFile(key CacheKey) (string, bool) {
+	objectPath, sum, ok := c.lookupObject(key)
+	if !ok {
+		return "", false
+	}
+
+	f, err := os.Open(objectPath)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil || hex.EncodeToString(h.Sum(nil)) != sum {
+		return "", false
+	}
+	return objectPath, true
+}
+
+// lookupObject returns the object path and sha256 of key without reading the object, callers that
+// read it anyway check the sha256 on the way
+func (c *DownloadCache) lookupObject(key CacheKey) (string, string, bool) {
+	ref, err := os.ReadFile(c.keyPath(key))
+	if err != nil {
+		return "", "", false
+	}
+	sum := strings.TrimSpace(string(ref))
+	if len(sum) != sha256.Size*2 {
+		return "", "", false
+	}
+
+	objectPath := c.objectPath(sum)
+	if _, err := os.Stat(objectPath); err != nil {
+		return "", "", false
+	}
+
+	// prune goes by the last use
+	now := time.Now()
+	_ = os.Chtimes(objectPath, now, now)
+	return objectPath, sum, true
+}
+
+// storeFile is store for a file that was hashed while it was downloaded
+func (c *DownloadCache) storeFile(key CacheKey, path string, sum string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return errors.Errorf("opening download: %w", err)
+	}
+	defer src.Close()
+
+	objectPath := c.objectPath(sum)
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return errors.Errorf("creating cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(objectPath), ".tmp-*")
+	if err != nil {
+		return errors.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return errors.Errorf("writing temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Errorf("closing temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), objectPath); err != nil {
+		return errors.Errorf("renaming temp file: %w", err)
+	}
+	return writeFileAtomic(c.keyPath(key), []byte(sum+"\n"))
+}
+
+// Has reports whether key can be served without a download
+func (c *DownloadCache) Has(key CacheKey) bool {
+	_, ok := c.lookupFile(key)
+	return ok
+}
+
+func (c *DownloadCache) store(key CacheKey, data []byte) error {
+	sum := sha256Hex(data)
+	if err := writeFileAtomic(c.objectPath(sum), data); err != nil {
+		return err
+	}
+	return writeFileAtomic(c.keyPath(key), []byte(sum+"\n"))
+}
+
+// writeFileAtomic writes through a temporary file so readers never see a partial object
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Errorf("creating cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return errors.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Errorf("writing temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Errorf("closing temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Errorf("renaming temp file: %w", err)
+	}
+	return nil
+}
+
+// Prune removes the objects not used for longer than olderThan (all of them when zero)
+// and the keys that point at a removed object. It returns the number of objects and bytes removed.
+func (c *DownloadCache) Prune(olderThan time.Duration) (int, int64, error) {
+	cutoff := time.Now().Add(-olderThan)
+	var removed int
+	var freed int64
+
+	objects := filepath.Join(c.dir, "objects")
+	err := filepath.WalkDir(objects, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if olderThan > 0 && info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, 0, errors.Errorf("pruning objects: %w", err)
+	}
+
+	keys := filepath.Join(c.dir, "keys")
+	err = filepath.WalkDir(keys, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		ref, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sum := strings.TrimSpace(string(ref))
+		if len(sum) == sha256.Size*2 {
+			if _, err := os.Stat(c.objectPath(sum)); err == nil {
+				return nil
+			}
+		}
+		return os.Remove(path)
+	})
+	if err != nil {
+		return 0, 0, errors.Errorf("pruning keys: %w", err)
+	}
+
+	return removed, freed, nil
+}
+
+type downloadCacheContextKey struct{}
+
+// NewDownloadCacheInContext makes cache available to processing, without one every run downloads again
+func NewDownloadCacheInContext(ctx context.Context, cache *DownloadCache) context.Context {
+	return context.WithValue(ctx, downloadCacheContextKey{}, cache)
+}
+
+func downloadCacheFromContext(ctx context.Context) *DownloadCache {
+	cache, _ := ctx.Value(downloadCacheContextKey{}).(*DownloadCache)
+	return cache
+}
+
+// cachedDownload fetches through the cache in ctx. Local sources are read from disk
+// already, and are not pinned to a commit, so they skip the cache.
+func cachedDownload(ctx context.Context, src Source, commitHash string, file string, fetch func() ([]byte, error)) ([]byte, error) {
+	cache := downloadCacheFromContext(ctx)
+	provider := repoHost(src.Repo)
+	if cache == nil || commitHash == "" || provider == "file://" {
+		return fetch()
+	}
+
+	return cache.Get(CacheKey{
+		Provider: provider,
+		Repo:     src.Repo,
+		Commit:   commitHash,
+		Path:     file,
+	}, fetch)
+}
+
+// 🧹 runCacheCommand implements `copyrc cache prune`
+func runCacheCommand(ctx context.Context, args []string) error {
+	logger := loggerFromContext(ctx)
+
+	if len(args) == 0 || args[0] != "prune" {
+		return errors.New("usage: copyrc cache prune [-older-than duration] [-dir path] [-git-dir path]")
+	}
+
+	flags := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+	olderThan := flags.Duration("older-than", 30*24*time.Hour, "remove downloads and clones not used for this long, 0 removes everything")
+	dir := flags.String("dir", "", "cache directory (default $XDG_CACHE_HOME/copyrc/downloads)")
+	gitDir := flags.String("git-dir", "", "git clone cache directory (default $XDG_CACHE_HOME/copyrc/git)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return errors.Errorf("parsing flags: %w", err)
+	}
+
+	cache, err := NewDownloadCache(*dir)
+	if err != nil {
+		return err
+	}
+
+	removed, freed, err := cache.Prune(*olderThan)
+	if err != nil {
+		return err
+	}
+	logger.Successf("removed %d cached downloads (%.1f MB) from %s", removed, float64(freed)/(1<<20), cache.dir)
+
+	if *gitDir == "" {
+		if *gitDir, err = defaultGitCacheDir(); err != nil {
+			return err
+		}
+	}
+
+	removed, freed, err = pruneGitCache(*gitDir, *olderThan)
+	if err != nil {
+		return err
+	}
+	logger.Successf("removed %d git clones (%.1f MB) from %s", removed, float64(freed)/(1<<20), *gitDir)
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+)
+
+func TestDownloadCache(t *testing.T) {
+	cache, err := NewDownloadCache(t.TempDir())
+	require.NoError(t, err)
+
+	key := CacheKey{Provider: "github.com", Repo: "github.com/org/repo", Commit: "abc123", Path: "a.go"}
+	var calls atomic.Int32
+	fetch := func() ([]byte, error) {
+		calls.Add(1)
+		return []byte("package a\n"), nil
+	}
+
+	t.Run("hit", func(t *testing.T) {
+		data, err := cache.Get(key, fetch)
+		require.NoError(t, err)
+		assert.Equal(t, "package a\n", string(data))
+
+		data, err = cache.Get(key, fetch)
+		require.NoError(t, err)
+		assert.Equal(t, "package a\n", string(data))
+		assert.Equal(t, int32(1), calls.Load(), "the second lookup is served from disk")
+
+		// another cache over the same directory, like the next run
+		other, err := NewDownloadCache(cache.dir)
+		require.NoError(t, err)
+		_, err = other.Get(key, fetch)
+		require.NoError(t, err)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("keys", func(t *testing.T) {
+		before := calls.Load()
+		newCommit := key
+		newCommit.Commit = "def456"
+		_, err := cache.Get(newCommit, fetch)
+		require.NoError(t, err)
+		assert.Equal(t, before+1, calls.Load(), "a new commit is a new key")
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(cache.objectPath(sha256Hex([]byte("package a\n"))), []byte("garbage"), 0644))
+
+		before := calls.Load()
+		data, err := cache.Get(key, fetch)
+		require.NoError(t, err)
+		assert.Equal(t, "package a\n", string(data))
+		assert.Equal(t, before+1, calls.Load(), "corrupt objects are downloaded again")
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		missing := key
+		missing.Path = "missing.go"
+		_, err := cache.Get(missing, func() ([]byte, error) {
+			return nil, errors.New("not found")
+		})
+		require.Error(t, err)
+
+		_, err = os.Stat(cache.keyPath(missing))
+		assert.True(t, os.IsNotExist(err), "failed downloads are not cached")
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		shared := key
+		shared.Path = "shared.go"
+
+		var downloads atomic.Int32
+		release := make(chan struct{})
+		slow := func() ([]byte, error) {
+			downloads.Add(1)
+			<-release
+			return []byte("package shared\n"), nil
+		}
+
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data, err := cache.Get(shared, slow)
+				assert.NoError(t, err)
+				assert.Equal(t, "package shared\n", string(data))
+			}()
+		}
+
+		// let the lookups pile up on the first download
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), downloads.Load())
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		old := key
+		old.Path = "old.go"
+		_, err := cache.Get(old, func() ([]byte, error) { return []byte("package old\n"), nil })
+		require.NoError(t, err)
+
+		lastMonth := time.Now().Add(-31 * 24 * time.Hour)
+		require.NoError(t, os.Chtimes(cache.objectPath(sha256Hex([]byte("package old\n"))), lastMonth, lastMonth))
+
+		removed, freed, err := cache.Prune(30 * 24 * time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		assert.Equal(t, int64(len("package old\n")), freed)
+
+		_, err = os.Stat(cache.keyPath(old))
+		assert.True(t, os.IsNotExist(err), "keys of pruned objects are removed")
+		_, err = os.Stat(cache.keyPath(key))
+		assert.NoError(t, err, "recently used keys are kept")
+
+		_, _, err = cache.Prune(0)
+		require.NoError(t, err)
+		entries, err := os.ReadDir(filepath.Join(cache.dir, "keys"))
+		require.NoError(t, err)
+		for _, e := range entries {
+			files, err := os.ReadDir(filepath.Join(cache.dir, "keys", e.Name()))
+			require.NoError(t, err)
+			assert.Empty(t, files)
+		}
+	})
+}
+
+func TestProcess_SharesDownloads(t *testing.T) {
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	cache, err := NewDownloadCache(t.TempDir())
+	require.NoError(t, err)
+	ctx = NewDownloadCacheInContext(ctx, cache)
+
+	mock := NewMockProvider(t)
+	mock.AddFile("a.go", []byte("package a\n"))
+	mock.AddFile("b.go", []byte("package b\n"))
+
+	// two destinations pulling from the same upstream commit
+	for _, dest := range []string{t.TempDir(), t.TempDir()} {
+		require.NoError(t, process(ctx, &SingleConfig{
+			Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+			Destination: Destination{Path: dest},
+			CopyArgs:    &CopyEntry_Options{},
+		}, mock))
+
+		content, err := os.ReadFile(filepath.Join(dest, "a.go"))
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "package a")
+	}
+
+	assert.ElementsMatch(t, []string{"a.go", "b.go"}, mock.fetched, "every file is downloaded once")
+}
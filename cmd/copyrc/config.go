@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"context"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/hashicorp/hcl/v2"
@@ -34,8 +35,22 @@ type CopyConfig struct {
 	Copies []*CopyEntry `json:"copies" hcl:"copy,block" yaml:"copies"`
 	// 📝 Archive configurations
 	Archives []*ArchiveEntry `json:"archives" hcl:"archive,block" yaml:"archives"`
+	// 🔗 Plain url configurations
+	URLs []*URLEntry `json:"urls,omitempty" hcl:"url,block" yaml:"urls,omitempty"`
 	// 🔧 Flags block
 	Flags *FlagsBlock `json:"flags,omitempty" hcl:"flags,block" yaml:"flags,omitempty"`
+	// 🌐 Per-host provider configurations
+	Providers []*ProviderConfig `json:"providers,omitempty" yaml:"providers,omitempty" hcl:"provider,block"`
+}
+
+// 🌐 Provider configuration for a repository host
+type ProviderConfig struct {
+	Host     string `json:"host" yaml:"host" hcl:"host,label"`
+	Type     string `json:"type" yaml:"type" hcl:"type,attr"`                                        // github, gitlab, git, goproxy or npm
+	BaseURL  string `json:"base_url,omitempty" yaml:"base_url,omitempty" hcl:"base_url,optional"`    // 🌐 Base url of the host (e.g. https://gitlab.corp.example)
+	TokenEnv string `json:"token_env,omitempty" yaml:"token_env,omitempty" hcl:"token_env,optional"` // 🔑 Environment variable holding the api token
+	APIURL   string `json:"api_url,omitempty" yaml:"api_url,omitempty" hcl:"api_url,optional"`       // 🔌 Api url override for github hosts (e.g. https://github.corp.example/api/v3)
+	RawURL   string `json:"raw_url,omitempty" yaml:"raw_url,omitempty" hcl:"raw_url,optional"`       // 📄 Raw file url override for github hosts (e.g. https://github.corp.example/raw)
 }
 
 type SingleConfig struct {
@@ -46,12 +61,31 @@ type SingleConfig struct {
 	Flags       FlagsBlock
 }
 
+// statusDir is where the lock file lives, stored archives keep theirs in a directory named after the repo
+func (cfg *SingleConfig) statusDir() string {
+	if cfg.ArchiveArgs != nil && !cfg.ArchiveArgs.Extract {
+		return filepath.Join(cfg.Destination.Path, repoBaseName(cfg.Source.Repo))
+	}
+	return cfg.Destination.Path
+}
+
+// recursive reports whether the destination holds a directory tree
+func (cfg *SingleConfig) recursive() bool {
+	if cfg.ArchiveArgs != nil {
+		return cfg.ArchiveArgs.Extract
+	}
+	return cfg.CopyArgs != nil && cfg.CopyArgs.Recursive
+}
+
 type FlagsBlock struct {
 	Clean        bool `json:"clean,omitempty" hcl:"clean,optional" yaml:"clean,omitempty"`
 	Status       bool `json:"status,omitempty" hcl:"status,optional" yaml:"status,omitempty"`
 	RemoteStatus bool `json:"remote_status,omitempty" hcl:"remote_status,optional" yaml:"remote_status,omitempty"`
 	Force        bool `json:"force,omitempty" hcl:"force,optional" yaml:"force,omitempty"`
 	Async        bool `json:"async,omitempty" hcl:"async,optional" yaml:"async,omitempty"`
+	Frozen       bool `json:"frozen,omitempty" hcl:"frozen,optional" yaml:"frozen,omitempty"`
+	Offline      bool `json:"offline,omitempty" hcl:"offline,optional" yaml:"offline,omitempty"`
+	Jobs         int  `json:"jobs,omitempty" hcl:"jobs,optional" yaml:"jobs,omitempty"` // 🚦 Concurrent downloads and entries (default 8)
 }
 
 // 🎯 Source configuration
@@ -60,6 +94,8 @@ type Source struct {
 	Ref     string `json:"ref,omitempty" yaml:"ref,omitempty" hcl:"ref,attr"`
 	Path    string `json:"path" yaml:"path" hcl:"path,optional"`
 	RefType string `json:"ref_type" yaml:"ref_type" hcl:"ref_type,optional"`
+	BaseURL string `json:"base_url,omitempty" yaml:"base_url,omitempty" hcl:"base_url,optional"` // 🌐 Override the provider base url (e.g. a self-hosted gitlab)
+	Sha256  string `json:"sha256,omitempty" yaml:"sha256,omitempty" hcl:"sha256,optional"`       // 🔒 Expected sha256 of the downloaded archive (archives only)
 }
 
 // 📦 Destination configuration
@@ -75,6 +111,21 @@ type CopyEntry_Options struct {
 	Recursive        bool          `json:"recursive,omitempty" yaml:"recursive,omitempty" hcl:"recursive,optional" cty:"recursive"` // 📁 Enable recursive directory copying
 	ExtensionPrefix  string        `json:"extension_prefix,omitempty" yaml:"extension_prefix,omitempty" hcl:"extension_prefix,optional" cty:"extension_prefix"`
 	NoHeaderComments bool          `json:"no_header_comments,omitempty" yaml:"no_header_comments,omitempty" hcl:"no_header_comments,optional" cty:"no_header_comments"`
+	EmbedFS          bool          `json:"embed_fs,omitempty" yaml:"embed_fs,omitempty" hcl:"embed_fs,optional" cty:"embed_fs"` // 📦 Generate embed.gen.go exposing the copied files as an fs.FS
+	Go               *GoTransform  `json:"go,omitempty" yaml:"go,omitempty" hcl:"go,block" cty:"go"`                            // 🐹 Rewrite the package clause and imports of .go files
+	Patches          []string      `json:"patches,omitempty" yaml:"patches,omitempty" hcl:"patches,optional" cty:"patches"`     // 🩹 Patch files applied after the replacements, globs relative to the working directory
+
+	// 🔁 HCL replacement blocks, LoadConfig appends them to Replacements
+	ReplacementBlocks []Replacement `json:"-" yaml:"-" hcl:"replacement,block"`
+}
+
+// mergeReplacementBlocks moves the replacement blocks of an HCL config into Replacements
+func (o *CopyEntry_Options) mergeReplacementBlocks() {
+	if o == nil {
+		return
+	}
+	o.Replacements = append(o.Replacements, o.ReplacementBlocks...)
+	o.ReplacementBlocks = nil
 }
 
 // 📝 Individual copy entry
@@ -91,8 +142,31 @@ type ArchiveEntry struct {
 	Options     *ArchiveEntry_Options `yaml:"options,omitempty" hcl:"options,block"`
 }
 
+// 🔗 Url entry, files fetched over plain http(s) instead of from a repository
+type URLEntry struct {
+	URL         string             `json:"url,omitempty" yaml:"url,omitempty" hcl:"url,optional"`
+	URLs        []string           `json:"urls,omitempty" yaml:"urls,omitempty" hcl:"urls,optional"`
+	Destination Destination        `json:"destination" yaml:"destination" hcl:"destination,block"`
+	Options     *CopyEntry_Options `json:"options,omitempty" yaml:"options,omitempty" hcl:"options,block"`
+}
+
+// All returns url followed by urls
+func (u *URLEntry) All() []string {
+	var all []string
+	if u.URL != "" {
+		all = append(all, u.URL)
+	}
+	return append(all, u.URLs...)
+}
+
 type ArchiveEntry_Options struct {
-	GoEmbed bool `yaml:"go_embed,omitempty" hcl:"go_embed,optional"`
+	GoEmbed      bool     `yaml:"go_embed,omitempty" hcl:"go_embed,optional"`
+	EmbedFS      bool     `yaml:"embed_fs,omitempty" hcl:"embed_fs,optional"`           // 📦 Also generate an FS() over the archive contents
+	Format       string   `yaml:"format,omitempty" hcl:"format,optional"`               // 🗜️ tar.gz (default), zip or tar.zst
+	Extract      bool     `yaml:"extract,omitempty" hcl:"extract,optional"`             // 📂 Unpack the archive instead of storing the tarball
+	FilePatterns []string `yaml:"file_patterns,omitempty" hcl:"file_patterns,optional"` // 🎯 Only keep matching files (the tarball is repacked unless extracting)
+	IgnoreFiles  []string `yaml:"ignore_files,omitempty" hcl:"ignore_files,optional"`   // 🚫 Drop matching files
+	MaxSize      string   `yaml:"max_size,omitempty" hcl:"max_size,optional"`           // 📏 Largest download accepted, e.g. 512MB or 8GiB (default 4GiB)
 }
 
 // 📝 Load config from file (supports YAML and HCL)
@@ -102,34 +176,34 @@ func LoadConfig(path string, input Input) (*CopyConfig, error) {
 		return nil, errors.Errorf("reading config file: %w", err)
 	}
 
-	// Try YAML first
+	var cfg CopyConfig
 	if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
-		var cfg CopyConfig
 		decoder := yaml.NewDecoder(bytes.NewReader(data))
 		decoder.KnownFields(true)
 		if err := decoder.Decode(&cfg); err != nil {
 			return nil, errors.Errorf("parsing YAML: %w", err)
 		}
-		return &cfg, nil
-	}
-	parser := hclparse.NewParser()
-	hclFile, diags := parser.ParseHCL(data, path)
-	if diags.HasErrors() {
-		return nil, errors.Errorf("parsing HCL: %s", diags.Error())
-	}
+	} else {
+		parser := hclparse.NewParser()
+		hclFile, diags := parser.ParseHCL(data, path)
+		if diags.HasErrors() {
+			return nil, errors.Errorf("parsing HCL: %s", diags.Error())
+		}
 
-	// Create evaluation context
-	ctx := &hcl.EvalContext{
-		Variables: map[string]cty.Value{},
-	}
+		// Create evaluation context
+		ctx := &hcl.EvalContext{
+			Variables: map[string]cty.Value{},
+		}
 
-	// Decode HCL into our HCL-specific schema
-	var cfg CopyConfig
-	diags = gohcl.DecodeBody(hclFile.Body, ctx, &cfg)
-	if diags.HasErrors() {
-		return nil, errors.Errorf("decoding HCL: %s", diags.Error())
+		// Decode HCL into our HCL-specific schema
+		diags = gohcl.DecodeBody(hclFile.Body, ctx, &cfg)
+		if diags.HasErrors() {
+			return nil, errors.Errorf("decoding HCL: %s", diags.Error())
+		}
 	}
 
+	// 🚩 Command line flags override the config, whatever its format
+
 	if cfg.Flags == nil {
 		cfg.Flags = &FlagsBlock{}
 	}
@@ -153,10 +227,21 @@ func LoadConfig(path string, input Input) (*CopyConfig, error) {
 		cfg.Flags.Clean = input.Clean.value
 	}
 
+	if input.Frozen.IsSet() {
+		cfg.Flags.Frozen = input.Frozen.value
+	}
+	if input.Offline.IsSet() {
+		cfg.Flags.Offline = input.Offline.value
+	}
+	if input.Jobs > 0 {
+		cfg.Flags.Jobs = input.Jobs
+	}
+
 	// remove all ./ from dest and source
 	for _, copy := range cfg.Copies {
 		copy.Destination.Path = strings.TrimPrefix(copy.Destination.Path, "./")
 		copy.Source.Path = strings.TrimPrefix(copy.Source.Path, "./")
+		copy.Options.mergeReplacementBlocks()
 	}
 
 	for _, archive := range cfg.Archives {
@@ -164,16 +249,30 @@ func LoadConfig(path string, input Input) (*CopyConfig, error) {
 		archive.Source.Path = strings.TrimPrefix(archive.Source.Path, "./")
 	}
 
+	for _, url := range cfg.URLs {
+		url.Destination.Path = strings.TrimPrefix(url.Destination.Path, "./")
+		url.Options.mergeReplacementBlocks()
+	}
+
 	// Convert to internal format
 	return &cfg, nil
 
 }
 
-// 🏃 Run all copy operations
-func (cfg *CopyConfig) RunAll(ctx context.Context, provider RepoProvider) error {
+// 🏃 Run all copy operations. Entries with different destinations run in parallel, up to
+// -jobs at a time, entries sharing a destination keep their order.
+func (cfg *CopyConfig) RunAll(ctx context.Context, providers ProviderResolver) error {
 	logger := loggerFromContext(ctx)
 	logger.Header("Copying files from repositories")
 
+	var flags FlagsBlock
+	if cfg.Flags != nil {
+		flags = *cfg.Flags
+	}
+	ctx = withJobLimit(ctx, flags.jobs())
+
+	var entries []runEntry
+
 	// Process copies
 	for _, copy := range cfg.Copies {
 		config := &SingleConfig{
@@ -181,14 +280,24 @@ func (cfg *CopyConfig) RunAll(ctx context.Context, provider RepoProvider) error
 			Destination: copy.Destination,
 			CopyArgs:    copy.Options,
 			ArchiveArgs: nil,
-		}
-		if cfg.Flags != nil {
-			config.Flags = *cfg.Flags
+			Flags:       flags,
 		}
 
-		if err := process(ctx, config, provider); err != nil {
-			return errors.Errorf("running copy %s: %w", copy.Destination.Path, err)
+		provider, err := providers.ProviderFor(copy.Source)
+		if err != nil {
+			return errors.Errorf("resolving provider for copy %s: %w", copy.Destination.Path, err)
 		}
+
+		entries = append(entries, runEntry{
+			index: len(entries),
+			dest:  copy.Destination.Path,
+			run: func(ctx context.Context) error {
+				if err := process(ctx, config, provider); err != nil {
+					return errors.Errorf("running copy %s: %w", copy.Destination.Path, err)
+				}
+				return nil
+			},
+		})
 	}
 
 	// Process archives
@@ -198,15 +307,39 @@ func (cfg *CopyConfig) RunAll(ctx context.Context, provider RepoProvider) error
 			Destination: archive.Destination,
 			ArchiveArgs: archive.Options,
 			CopyArgs:    nil,
-		}
-		if cfg.Flags != nil {
-			config.Flags = *cfg.Flags
+			Flags:       flags,
 		}
 
-		if err := process(ctx, config, provider); err != nil {
-			return errors.Errorf("running archive %s: %w", archive.Destination.Path, err)
+		provider, err := providers.ProviderFor(archive.Source)
+		if err != nil {
+			return errors.Errorf("resolving provider for archive %s: %w", archive.Destination.Path, err)
 		}
+
+		entries = append(entries, runEntry{
+			index: len(entries),
+			dest:  archive.Destination.Path,
+			run: func(ctx context.Context) error {
+				if err := process(ctx, config, provider); err != nil {
+					return errors.Errorf("running archive %s: %w", archive.Destination.Path, err)
+				}
+				return nil
+			},
+		})
+	}
+
+	// Process urls
+	for _, url := range cfg.URLs {
+		entries = append(entries, runEntry{
+			index: len(entries),
+			dest:  url.Destination.Path,
+			run: func(ctx context.Context) error {
+				if err := processURLs(ctx, url, flags); err != nil {
+					return errors.Errorf("running url %s: %w", url.Destination.Path, err)
+				}
+				return nil
+			},
+		})
 	}
 
-	return nil
+	return runEntries(ctx, flags.jobs(), entries)
 }
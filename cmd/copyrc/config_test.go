@@ -382,3 +382,137 @@ copy {
 		})
 	}
 }
+
+func TestLoadConfig_Providers(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		config string
+	}{
+		{
+			name: "hcl",
+			file: "config.hcl",
+			config: `
+provider "gitlab.corp.example" {
+  type      = "gitlab"
+  base_url  = "https://gitlab.corp.example"
+  token_env = "CORP_GITLAB_TOKEN"
+}
+
+provider "mirror.corp.example" {
+  type = "git"
+}
+
+copy {
+  source {
+    repo = "gitlab.corp.example/group/sub/repo"
+    ref  = "main"
+    path = "src"
+  }
+  destination {
+    path = "./dest"
+  }
+}
+`,
+		},
+		{
+			name: "yaml",
+			file: "config.yaml",
+			config: `
+providers:
+  - host: gitlab.corp.example
+    type: gitlab
+    base_url: https://gitlab.corp.example
+    token_env: CORP_GITLAB_TOKEN
+  - host: mirror.corp.example
+    type: git
+copies:
+  - source:
+      repo: gitlab.corp.example/group/sub/repo
+      ref: main
+      path: src
+    destination:
+      path: dest
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), tt.file)
+			require.NoError(t, os.WriteFile(configPath, []byte(tt.config), 0644))
+
+			cfg, err := LoadConfig(configPath, Input{})
+			require.NoError(t, err)
+
+			require.Len(t, cfg.Providers, 2)
+			assert.Equal(t, ProviderConfig{
+				Host:     "gitlab.corp.example",
+				Type:     "gitlab",
+				BaseURL:  "https://gitlab.corp.example",
+				TokenEnv: "CORP_GITLAB_TOKEN",
+			}, *cfg.Providers[0])
+			assert.Equal(t, ProviderConfig{Host: "mirror.corp.example", Type: "git"}, *cfg.Providers[1])
+
+			registry, err := NewProviderRegistry(cfg.Providers)
+			require.NoError(t, err)
+			provider, err := registry.ProviderFor(cfg.Copies[0].Source)
+			require.NoError(t, err)
+			assert.IsType(t, &GitlabProvider{}, provider)
+		})
+	}
+}
+
+func TestLoadConfig_FlagOverrides(t *testing.T) {
+	configs := map[string]string{
+		"config.yaml": `
+flags:
+  jobs: 2
+copies:
+  - source:
+      repo: github.com/org/repo
+      ref: main
+      path: ./src
+    destination:
+      path: ./dest
+`,
+		".copyrc.hcl": `
+flags {
+  jobs = 2
+}
+
+copy {
+  source {
+    repo = "github.com/org/repo"
+    ref  = "main"
+    path = "./src"
+  }
+  destination {
+    path = "./dest"
+  }
+}
+`,
+	}
+
+	for file, config := range configs {
+		t.Run(file, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), file)
+			require.NoError(t, os.WriteFile(configPath, []byte(config), 0644))
+
+			input := Input{Frozen: newDefaultFalseBoolFlag(), Offline: newDefaultFalseBoolFlag(), Jobs: 5}
+			require.NoError(t, input.Frozen.Set("true"))
+			require.NoError(t, input.Offline.Set("true"))
+
+			cfg, err := LoadConfig(configPath, input)
+			require.NoError(t, err)
+			require.NotNil(t, cfg.Flags)
+			assert.True(t, cfg.Flags.Frozen)
+			assert.True(t, cfg.Flags.Offline)
+			assert.Equal(t, 5, cfg.Flags.Jobs)
+
+			require.Len(t, cfg.Copies, 1)
+			assert.Equal(t, "src", cfg.Copies[0].Source.Path)
+			assert.Equal(t, "dest", cfg.Copies[0].Destination.Path)
+		})
+	}
+}
@@ -0,0 +1,426 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// embedPackageName keeps the letters and digits of name (vscode-jsonrpc, lodash.merge) so it can be used as a package name
+func embedPackageName(name string) string {
+	pkgName := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return r
+		}
+		return -1
+	}, name)
+	if pkgName == "" || unicode.IsDigit(rune(pkgName[0])) {
+		pkgName = "embedded" + pkgName
+	}
+	return pkgName
+}
+
+// copiedPackageName returns the package of the .go files copied to the root of the destination,
+// so embed.gen.go joins them. Without any, the package is named after the destination directory.
+func copiedPackageName(ctx context.Context, dest string, status *StatusFile) (string, error) {
+	names := slices.Sorted(maps.Keys(status.CoppiedFiles))
+	for _, name := range names {
+		if strings.ContainsAny(name, "/\\") || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") || name == "embed.gen.go" {
+			continue
+		}
+		content, err := readFile(ctx, filepath.Join(dest, name))
+		if err != nil {
+			return "", errors.Errorf("reading %s: %w", name, err)
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), name, content, parser.PackageClauseOnly)
+		if err != nil {
+			// not valid Go, another file may still say which package this is
+			continue
+		}
+		return file.Name.Name, nil
+	}
+
+	abs, err := filepath.Abs(dest)
+	if err != nil {
+		return "", errors.Errorf("resolving destination: %w", err)
+	}
+	return embedPackageName(filepath.Base(abs)), nil
+}
+
+// embedRoots returns the top-level files and directories of the copied files, sorted
+func embedRoots(status *StatusFile) []string {
+	roots := []string{}
+	for name := range status.CoppiedFiles {
+		root, _, _ := strings.Cut(filepath.ToSlash(name), "/")
+		if !slices.Contains(roots, root) {
+			roots = append(roots, root)
+		}
+	}
+	slices.Sort(roots)
+	return roots
+}
+
+// writeEmbedTarLoader writes the body of loadFS for a tar.gz or tar.zst Data, and openTar. Only the headers
+// are read up front, opening a file decompresses Data again up to that file.
+func writeEmbedTarLoader(buf *bytes.Buffer, format string) {
+	fmt.Fprintf(buf, "\ttr, closeTar, err := openTar()\n")
+	fmt.Fprintf(buf, "\tif err != nil {\n")
+	fmt.Fprintf(buf, "\t\treturn nil, err\n")
+	fmt.Fprintf(buf, "\t}\n")
+	fmt.Fprintf(buf, "\tdefer closeTar()\n\n")
+	fmt.Fprintf(buf, "\tfiles := map[string]*archiveFile{}\n")
+	fmt.Fprintf(buf, "\tfor index := 0; ; index++ {\n")
+	fmt.Fprintf(buf, "\t\thdr, err := tr.Next()\n")
+	fmt.Fprintf(buf, "\t\tif err == io.EOF {\n")
+	fmt.Fprintf(buf, "\t\t\treturn newArchiveFS(files), nil\n")
+	fmt.Fprintf(buf, "\t\t}\n")
+	fmt.Fprintf(buf, "\t\tif err != nil {\n")
+	fmt.Fprintf(buf, "\t\t\treturn nil, err\n")
+	fmt.Fprintf(buf, "\t\t}\n")
+	fmt.Fprintf(buf, "\t\t_, name, ok := strings.Cut(hdr.Name, \"/\")\n")
+	fmt.Fprintf(buf, "\t\tif hdr.Typeflag != tar.TypeReg || !ok || name == \"\" {\n")
+	fmt.Fprintf(buf, "\t\t\tcontinue\n")
+	fmt.Fprintf(buf, "\t\t}\n")
+	fmt.Fprintf(buf, "\t\tname = path.Clean(name)\n")
+	fmt.Fprintf(buf, "\t\tentry := index\n")
+	fmt.Fprintf(buf, "\t\tfiles[name] = &archiveFile{name: name, size: hdr.Size, mode: fs.FileMode(hdr.Mode).Perm(), modTime: hdr.ModTime, open: func() (io.ReadCloser, error) {\n")
+	fmt.Fprintf(buf, "\t\t\treturn openTarEntry(entry)\n")
+	fmt.Fprintf(buf, "\t\t}}\n")
+	fmt.Fprintf(buf, "\t}\n")
+	fmt.Fprintf(buf, "})\n\n")
+
+	fmt.Fprintf(buf, "// openTar decompresses Data from the start\n")
+	fmt.Fprintf(buf, "func openTar() (*tar.Reader, func(), error) {\n")
+	if format == ArchiveFormatTarZst {
+		fmt.Fprintf(buf, "\tdec, err := zstd.NewReader(bytes.NewReader(Data))\n")
+	} else {
+		fmt.Fprintf(buf, "\tdec, err := gzip.NewReader(bytes.NewReader(Data))\n")
+	}
+	fmt.Fprintf(buf, "\tif err != nil {\n")
+	fmt.Fprintf(buf, "\t\treturn nil, nil, err\n")
+	fmt.Fprintf(buf, "\t}\n")
+	fmt.Fprintf(buf, "\treturn tar.NewReader(dec), func() { dec.Close() }, nil\n")
+	fmt.Fprintf(buf, "}\n\n")
+
+	fmt.Fprintf(buf, "// openTarEntry streams the contents of the entry at index, decompressing only what comes before it\n")
+	fmt.Fprintf(buf, "func openTarEntry(index int) (io.ReadCloser, error) {\n")
+	fmt.Fprintf(buf, "\ttr, closeTar, err := openTar()\n")
+	fmt.Fprintf(buf, "\tif err != nil {\n")
+	fmt.Fprintf(buf, "\t\treturn nil, err\n")
+	fmt.Fprintf(buf, "\t}\n")
+	fmt.Fprintf(buf, "\tfor i := 0; i <= index; i++ {\n")
+	fmt.Fprintf(buf, "\t\tif _, err := tr.Next(); err != nil {\n")
+	fmt.Fprintf(buf, "\t\t\tcloseTar()\n")
+	fmt.Fprintf(buf, "\t\t\treturn nil, err\n")
+	fmt.Fprintf(buf, "\t\t}\n")
+	fmt.Fprintf(buf, "\t}\n")
+	fmt.Fprintf(buf, "\treturn &tarEntry{Reader: tr, close: closeTar}, nil\n")
+	fmt.Fprintf(buf, "}\n\n")
+
+	fmt.Fprintf(buf, "type tarEntry struct {\n")
+	fmt.Fprintf(buf, "\t*tar.Reader\n")
+	fmt.Fprintf(buf, "\tclose func()\n")
+	fmt.Fprintf(buf, "}\n\n")
+	fmt.Fprintf(buf, "func (e *tarEntry) Close() error {\n")
+	fmt.Fprintf(buf, "\te.close()\n")
+	fmt.Fprintf(buf, "\treturn nil\n")
+	fmt.Fprintf(buf, "}\n")
+}
+
+// writeEmbedZipLoader writes the body of loadFS for a zip Data, zip files are decompressed when opened
+func writeEmbedZipLoader(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "\tzr, err := zip.NewReader(bytes.NewReader(Data), int64(len(Data)))\n")
+	fmt.Fprintf(buf, "\tif err != nil {\n")
+	fmt.Fprintf(buf, "\t\treturn nil, err\n")
+	fmt.Fprintf(buf, "\t}\n\n")
+	fmt.Fprintf(buf, "\tfiles := map[string]*archiveFile{}\n")
+	fmt.Fprintf(buf, "\tfor _, f := range zr.File {\n")
+	fmt.Fprintf(buf, "\t\t_, name, ok := strings.Cut(f.Name, \"/\")\n")
+	fmt.Fprintf(buf, "\t\tif !f.Mode().IsRegular() || !ok || name == \"\" {\n")
+	fmt.Fprintf(buf, "\t\t\tcontinue\n")
+	fmt.Fprintf(buf, "\t\t}\n")
+	fmt.Fprintf(buf, "\t\tname = path.Clean(name)\n")
+	fmt.Fprintf(buf, "\t\tfiles[name] = &archiveFile{name: name, size: int64(f.UncompressedSize64), mode: f.Mode().Perm(), modTime: f.Modified, open: f.Open}\n")
+	fmt.Fprintf(buf, "\t}\n")
+	fmt.Fprintf(buf, "\treturn newArchiveFS(files), nil\n")
+	fmt.Fprintf(buf, "})\n")
+}
+
+// embedArchiveFS is the read-only fs.FS the generated FS() returns for stored archives,
+// the loaders fill in its files with an open func that decompresses on demand
+const embedArchiveFS = `
+// archiveFS is a read-only fs.FS over Data
+type archiveFS struct {
+	files map[string]*archiveFile
+	dirs  map[string][]fs.DirEntry // sorted entries by directory, "." is the root
+}
+
+func newArchiveFS(files map[string]*archiveFile) *archiveFS {
+	a := &archiveFS{files: files, dirs: map[string][]fs.DirEntry{".": nil}}
+	seen := map[string]bool{}
+	for _, f := range files {
+		var entry fs.DirEntry = f
+		for name := f.name; name != "." && !seen[name]; name = path.Dir(name) {
+			seen[name] = true
+			dir := path.Dir(name)
+			a.dirs[dir] = append(a.dirs[dir], entry)
+			entry = archiveDir(path.Base(dir))
+		}
+	}
+	for _, entries := range a.dirs {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	}
+	return a
+}
+
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if f, ok := a.files[name]; ok {
+		rc, err := f.open()
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &openFile{ReadCloser: rc, info: f}, nil
+	}
+	if entries, ok := a.dirs[name]; ok {
+		return &openDir{info: archiveDir(path.Base(name)), entries: entries}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// archiveFile is a file of the archive, it is both its fs.FileInfo and its fs.DirEntry
+type archiveFile struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	open    func() (io.ReadCloser, error)
+}
+
+func (f *archiveFile) Name() string               { return path.Base(f.name) }
+func (f *archiveFile) Size() int64                { return f.size }
+func (f *archiveFile) Mode() fs.FileMode          { return f.mode }
+func (f *archiveFile) ModTime() time.Time         { return f.modTime }
+func (f *archiveFile) IsDir() bool                { return false }
+func (f *archiveFile) Sys() any                   { return nil }
+func (f *archiveFile) Type() fs.FileMode          { return 0 }
+func (f *archiveFile) Info() (fs.FileInfo, error) { return f, nil }
+
+// archiveDir is a directory of the archive by its base name
+type archiveDir string
+
+func (d archiveDir) Name() string               { return string(d) }
+func (d archiveDir) Size() int64                { return 0 }
+func (d archiveDir) Mode() fs.FileMode          { return fs.ModeDir | 0o555 }
+func (d archiveDir) ModTime() time.Time         { return time.Time{} }
+func (d archiveDir) IsDir() bool                { return true }
+func (d archiveDir) Sys() any                   { return nil }
+func (d archiveDir) Type() fs.FileMode          { return fs.ModeDir }
+func (d archiveDir) Info() (fs.FileInfo, error) { return d, nil }
+
+type openFile struct {
+	io.ReadCloser
+	info *archiveFile
+}
+
+func (f *openFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+type openDir struct {
+	info    archiveDir
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *openDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *openDir) Close() error               { return nil }
+
+func (d *openDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: string(d.info), Err: fs.ErrInvalid}
+}
+
+func (d *openDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	d.offset += len(entries)
+	return append([]fs.DirEntry(nil), entries...), nil
+}
+`
+
+// writeEmbed generates embed.gen.go for the destination. Stored archives embed the tarball as Data,
+// with embed_fs an FS() that decompresses it on first use. Extracted archives and copies embed the files
+// themselves with //go:embed all:dir.
+func writeEmbed(ctx context.Context, provider RepoProvider, cfg *SingleConfig, commitHash string, status *StatusFile, mu *sync.Mutex) error {
+	var tarball, embedFS bool
+	var pkgName string
+	switch {
+	case cfg.ArchiveArgs != nil && (cfg.ArchiveArgs.GoEmbed || cfg.ArchiveArgs.EmbedFS):
+		tarball = !cfg.ArchiveArgs.Extract
+		embedFS = cfg.ArchiveArgs.EmbedFS || cfg.ArchiveArgs.Extract
+		pkgName = embedPackageName(repoBaseName(cfg.Source.Repo))
+	case cfg.CopyArgs != nil && cfg.CopyArgs.EmbedFS:
+		embedFS = true
+		mu.Lock()
+		name, err := copiedPackageName(ctx, cfg.Destination.Path, status)
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+		pkgName = name
+	default:
+		return nil
+	}
+
+	permalink, err := provider.GetArchiveUrl(ctx, cfg.Source)
+	if err != nil {
+		return errors.Errorf("getting permalink: %w", err)
+	}
+	mu.Lock()
+	status.ArchiveURL = permalink
+	mu.Unlock()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// 📦 generated by copyrc. DO NOT EDIT.\n")
+	fmt.Fprintf(&buf, "// ℹ️ see .copyrc.lock for more details.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkgName)
+
+	mu.Lock()
+	if tarball {
+		format, err := archiveFormat(cfg.ArchiveArgs)
+		if err != nil {
+			mu.Unlock()
+			return err
+		}
+		archiveName := repoBaseName(cfg.Source.Repo) + "." + format
+		tarStatus := status.CoppiedFiles[archiveName]
+
+		if embedFS {
+			fmt.Fprintf(&buf, "import (\n")
+			if format == ArchiveFormatZip {
+				fmt.Fprintf(&buf, "\t\"archive/zip\"\n")
+			} else {
+				fmt.Fprintf(&buf, "\t\"archive/tar\"\n")
+			}
+			fmt.Fprintf(&buf, "\t\"bytes\"\n")
+			if format == ArchiveFormatTarGz {
+				fmt.Fprintf(&buf, "\t\"compress/gzip\"\n")
+			}
+			fmt.Fprintf(&buf, "\t_ \"embed\"\n")
+			fmt.Fprintf(&buf, "\t\"io\"\n")
+			fmt.Fprintf(&buf, "\t\"io/fs\"\n")
+			fmt.Fprintf(&buf, "\t\"path\"\n")
+			fmt.Fprintf(&buf, "\t\"sort\"\n")
+			fmt.Fprintf(&buf, "\t\"strings\"\n")
+			fmt.Fprintf(&buf, "\t\"sync\"\n")
+			fmt.Fprintf(&buf, "\t\"time\"\n")
+			if format == ArchiveFormatTarZst {
+				fmt.Fprintf(&buf, "\n\t\"github.com/klauspost/compress/zstd\"\n")
+			}
+			fmt.Fprintf(&buf, ")\n\n")
+		} else {
+			fmt.Fprintf(&buf, "import _ \"embed\"\n\n")
+		}
+		fmt.Fprintf(&buf, "//go:embed %s\n", archiveName)
+		fmt.Fprintf(&buf, "var Data []byte\n\n")
+		fmt.Fprintf(&buf, "// Metadata about the downloaded repository\n")
+		fmt.Fprintf(&buf, "var (\n")
+		fmt.Fprintf(&buf, "\tRef        = %q\n", cfg.Source.Ref)
+		fmt.Fprintf(&buf, "\tCommit     = %q\n", commitHash)
+		fmt.Fprintf(&buf, "\tRepository = %q\n", cfg.Source.Repo)
+		fmt.Fprintf(&buf, "\tPermalink  = %q\n", permalink)
+		fmt.Fprintf(&buf, "\tDownloaded = %q\n", tarStatus.LastUpdated.Format(time.RFC3339))
+		fmt.Fprintf(&buf, ")\n")
+
+		if embedFS {
+			fmt.Fprintf(&buf, "\n// FS returns the files of the archive, without its top-level directory.\n")
+			fmt.Fprintf(&buf, "// The first call lists the files, each one is decompressed when it is opened.\n")
+			fmt.Fprintf(&buf, "func FS() (fs.FS, error) {\n")
+			fmt.Fprintf(&buf, "\treturn loadFS()\n")
+			fmt.Fprintf(&buf, "}\n\n")
+			fmt.Fprintf(&buf, "var loadFS = sync.OnceValues(func() (fs.FS, error) {\n")
+			if format == ArchiveFormatZip {
+				writeEmbedZipLoader(&buf)
+			} else {
+				writeEmbedTarLoader(&buf, format)
+			}
+			buf.WriteString(embedArchiveFS)
+		}
+	} else {
+		roots := embedRoots(status)
+		if len(roots) == 0 {
+			mu.Unlock()
+			return errors.Errorf("no files to embed in %s", cfg.Destination.Path)
+		}
+		for i, root := range roots {
+			roots[i] = "all:" + root
+		}
+
+		fmt.Fprintf(&buf, "import (\n")
+		fmt.Fprintf(&buf, "\t\"embed\"\n")
+		fmt.Fprintf(&buf, "\t\"io/fs\"\n")
+		fmt.Fprintf(&buf, ")\n\n")
+		fmt.Fprintf(&buf, "//go:embed %s\n", strings.Join(roots, " "))
+		fmt.Fprintf(&buf, "var files embed.FS\n\n")
+		fmt.Fprintf(&buf, "// Metadata about the copied repository\n")
+		fmt.Fprintf(&buf, "var (\n")
+		fmt.Fprintf(&buf, "\tRef        = %q\n", cfg.Source.Ref)
+		fmt.Fprintf(&buf, "\tCommit     = %q\n", commitHash)
+		fmt.Fprintf(&buf, "\tRepository = %q\n", cfg.Source.Repo)
+		fmt.Fprintf(&buf, "\tPermalink  = %q\n", permalink)
+		fmt.Fprintf(&buf, ")\n\n")
+		fmt.Fprintf(&buf, "// FS returns the copied files, rooted at this directory\n")
+		fmt.Fprintf(&buf, "func FS() (fs.FS, error) {\n")
+		fmt.Fprintf(&buf, "\treturn files, nil\n")
+		fmt.Fprintf(&buf, "}\n")
+	}
+	mu.Unlock()
+
+	embedPath := filepath.Join(cfg.Destination.Path, "embed.gen.go")
+
+	// Let writeFile handle status determination
+	if _, err := writeFile(ctx, WriteFileOpts{
+		SourcePath:    embedPath,
+		Destination:   cfg.Destination,
+		Path:          embedPath,
+		Contents:      buf.Bytes(),
+		IsManaged:     true,
+		StatusFile:    status,
+		StatusMutex:   mu,
+		EnsureNewline: true,
+	}); err != nil {
+		return errors.Errorf("writing embed.gen.go: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 🧪 typecheckEmbed parses and type checks the generated embed.gen.go against the standard library
+func typecheckEmbed(t *testing.T, dir string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(dir, "embed.gen.go"))
+	require.NoError(t, err)
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "embed.gen.go", data, parser.ParseComments)
+	require.NoError(t, err, string(data))
+
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	_, err = conf.Check(file.Name.Name, fset, []*ast.File{file}, nil)
+	require.NoError(t, err, string(data))
+
+	return string(data)
+}
+
+func TestEmbedPackageName(t *testing.T) {
+	assert.Equal(t, "vscodejsonrpc", embedPackageName("vscode-jsonrpc"))
+	assert.Equal(t, "lodashmerge", embedPackageName("lodash.merge"))
+	assert.Equal(t, "embedded3d", embedPackageName("3d"))
+	assert.Equal(t, "embedded", embedPackageName("..."))
+}
+
+func TestWriteEmbed(t *testing.T) {
+	upstream := filepath.Join(t.TempDir(), "upstream")
+	writeTestFiles(t, upstream, map[string]string{
+		"assets/index.html":     "<html></html>\n",
+		"assets/css/site.css":   "body {}\n",
+		"assets/_partial.html":  "<p></p>\n",
+		"assets/.well-known/x":  "x\n",
+		"other/not-copied.html": "<html></html>\n",
+		"gopkg/a.go":            "package upstreamlib\n",
+		"gopkg/a_test.go":       "package upstreamlib_test\n",
+		"gopkg/sub/b.go":        "package sub\n",
+	})
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	t.Run("tarball_fs", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      Source{Repo: upstream},
+			Destination: Destination{Path: t.TempDir()},
+			ArchiveArgs: &ArchiveEntry_Options{EmbedFS: true},
+		}
+		provider, err := NewLocalProvider()
+		require.NoError(t, err)
+		require.NoError(t, process(ctx, cfg, provider))
+
+		code := typecheckEmbed(t, cfg.Destination.Path)
+		assert.Contains(t, code, "package upstream")
+		assert.Contains(t, code, "//go:embed upstream.tar.gz")
+		assert.Contains(t, code, "func FS() (fs.FS, error)")
+		assert.Contains(t, code, "Repository = ")
+	})
+
+	t.Run("archive_fs_behaves", func(t *testing.T) {
+		if _, err := exec.LookPath("go"); err != nil || testing.Short() {
+			t.Skip("needs the go command")
+		}
+
+		for _, format := range []string{ArchiveFormatTarGz, ArchiveFormatZip} {
+			t.Run(format, func(t *testing.T) {
+				cfg := &SingleConfig{
+					Source:      Source{Repo: upstream},
+					Destination: Destination{Path: t.TempDir()},
+					ArchiveArgs: &ArchiveEntry_Options{EmbedFS: true, Format: format},
+				}
+				provider, err := NewLocalProvider()
+				require.NoError(t, err)
+				require.NoError(t, process(ctx, cfg, provider))
+
+				// run testing/fstest against the generated FS in a module of its own
+				writeTestFiles(t, cfg.Destination.Path, map[string]string{
+					"go.mod": "module example.com/upstream\n\ngo 1.22\n",
+					"fs_test.go": `package upstream
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	fsys, err := FS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "assets/index.html", "assets/css/site.css", "gopkg/sub/b.go"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.ReadFile(fsys, "assets/css/site.css")
+	if err != nil || string(data) != "body {}\n" {
+		t.Fatalf("reading site.css: %q %v", data, err)
+	}
+}
+`,
+				})
+
+				cmd := exec.Command("go", "test", ".")
+				cmd.Dir = cfg.Destination.Path
+				cmd.Env = append(os.Environ(), "GOFLAGS=", "GOWORK=off", "GOPROXY=off", "GOTOOLCHAIN=local")
+				out, err := cmd.CombinedOutput()
+				require.NoError(t, err, string(out))
+			})
+		}
+	})
+
+	t.Run("tarball_data_only", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      Source{Repo: upstream},
+			Destination: Destination{Path: t.TempDir()},
+			ArchiveArgs: &ArchiveEntry_Options{GoEmbed: true},
+		}
+		provider, err := NewLocalProvider()
+		require.NoError(t, err)
+		require.NoError(t, process(ctx, cfg, provider))
+
+		code := typecheckEmbed(t, cfg.Destination.Path)
+		assert.Contains(t, code, "var Data []byte")
+		assert.NotContains(t, code, "func FS()")
+	})
+
+	t.Run("extracted", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      Source{Repo: upstream, Path: "assets"},
+			Destination: Destination{Path: filepath.Join(t.TempDir(), "site")},
+			ArchiveArgs: &ArchiveEntry_Options{Extract: true, GoEmbed: true},
+		}
+		provider, err := NewLocalProvider()
+		require.NoError(t, err)
+		require.NoError(t, process(ctx, cfg, provider))
+
+		code := typecheckEmbed(t, cfg.Destination.Path)
+		assert.Contains(t, code, "//go:embed all:.well-known all:_partial.html all:css all:index.html\n")
+		assert.Contains(t, code, "var files embed.FS")
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      Source{Repo: upstream, Path: "assets"},
+			Destination: Destination{Path: filepath.Join(t.TempDir(), "web-assets")},
+			CopyArgs:    &CopyEntry_Options{Recursive: true, EmbedFS: true},
+		}
+		provider, err := NewLocalProvider()
+		require.NoError(t, err)
+		require.NoError(t, process(ctx, cfg, provider))
+
+		code := typecheckEmbed(t, cfg.Destination.Path)
+		assert.Contains(t, code, "package webassets")
+		assert.Contains(t, code, "//go:embed all:.well-known all:_partial.html all:css all:index.html\n")
+
+		status, err := loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+		require.NoError(t, err)
+		assert.Contains(t, status.GeneratedFiles, "embed.gen.go")
+	})
+	t.Run("copy_go_package", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      Source{Repo: upstream, Path: "gopkg"},
+			Destination: Destination{Path: filepath.Join(t.TempDir(), "web-assets")},
+			CopyArgs:    &CopyEntry_Options{Recursive: true, EmbedFS: true, NoHeaderComments: true},
+		}
+		provider, err := NewLocalProvider()
+		require.NoError(t, err)
+		require.NoError(t, process(ctx, cfg, provider))
+
+		code := typecheckEmbed(t, cfg.Destination.Path)
+		assert.Contains(t, code, "package upstreamlib\n", "embed.gen.go joins the package of the copied files")
+	})
+}
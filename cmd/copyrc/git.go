@@ -0,0 +1,641 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// 🏗️ Generic git implementation, works against any remote git itself can talk to
+type GitProvider struct {
+	cacheDir string
+	baseURL  string
+
+	// mu only guards the maps, the git commands run under the per-key locks so that
+	// entries for different repos and refs do not wait on each other
+	mu         sync.Mutex
+	locks      map[string]*sync.Mutex
+	resolved   map[string]string
+	prefetched map[string]bool
+}
+
+// NewGitProvider creates a git provider that keeps its shallow clones in cacheDir.
+// An empty cacheDir falls back to the user cache directory. baseURL is used to build
+// remotes for repos written as host/org/repo, they default to https.
+func NewGitProvider(cacheDir string, baseURL string) (*GitProvider, error) {
+	if cacheDir == "" {
+		dir, err := defaultGitCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		cacheDir = dir
+	}
+	return &GitProvider{
+		cacheDir:   cacheDir,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		locks:      make(map[string]*sync.Mutex),
+		resolved:   make(map[string]string),
+		prefetched: make(map[string]bool),
+	}, nil
+}
+
+// defaultGitCacheDir is where the clones are kept, next to the download cache
+func defaultGitCacheDir() (string, error) {
+	userCache, err := os.UserCacheDir()
+	if err != nil {
+		return "", errors.Errorf("getting user cache dir: %w", err)
+	}
+	return filepath.Join(userCache, "copyrc", "git"), nil
+}
+
+// pruneGitCache removes the clones in cacheDir not used for olderThan, 0 removes all of them
+func pruneGitCache(cacheDir string, olderThan time.Duration) (int, int64, error) {
+	entries, err := os.ReadDir(cacheDir)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, errors.Errorf("reading git cache: %w", err)
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	var removed int
+	var freed int64
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return 0, 0, errors.Errorf("reading git cache: %w", err)
+		}
+		// checkout touches the clone directory every time it is used
+		if olderThan > 0 && info.ModTime().After(cutoff) {
+			continue
+		}
+
+		dir := filepath.Join(cacheDir, e.Name())
+		var size int64
+		_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				if info, err := d.Info(); err == nil {
+					size += info.Size()
+				}
+			}
+			return nil
+		})
+		if err := os.RemoveAll(dir); err != nil {
+			return 0, 0, errors.Errorf("removing %s: %w", dir, err)
+		}
+		removed++
+		freed += size
+	}
+	return removed, freed, nil
+}
+
+// parseGitRemote validates that repo is a remote git can fetch from
+func parseGitRemote(repo string) (string, error) {
+	repo = strings.TrimSpace(repo)
+	for _, prefix := range []string{"https://", "http://", "ssh://", "git://", "file://"} {
+		if strings.HasPrefix(repo, prefix) && len(repo) > len(prefix) {
+			return repo, nil
+		}
+	}
+	// scp-like syntax: user@host:path
+	if at, colon := strings.Index(repo, "@"), strings.Index(repo, ":"); at > 0 && colon > at+1 && colon < len(repo)-1 && !strings.Contains(repo[:colon], "/") {
+		return repo, nil
+	}
+	return "", errors.Errorf("invalid git remote: %s (expected https://, ssh://, git@host: or file:// remote)", repo)
+}
+
+// remoteFor returns the remote to fetch repo from
+func (g *GitProvider) remoteFor(repo string) (string, error) {
+	if remote, err := parseGitRemote(repo); err == nil {
+		return remote, nil
+	}
+
+	host, repoPath, ok := strings.Cut(strings.TrimPrefix(repo, "From "), "/")
+	if !ok || host == "" || repoPath == "" {
+		return "", errors.Errorf("invalid git repository: %s (expected a git remote or host/path)", repo)
+	}
+	if g.baseURL != "" {
+		return g.baseURL + "/" + repoPath, nil
+	}
+	return "https://" + host + "/" + repoPath, nil
+}
+
+// gitRemoteName returns the last path element of the remote, without .git
+func gitRemoteName(remote string) string {
+	name := remote
+	if idx := strings.LastIndexAny(name, "/:"); idx != -1 {
+		name = name[idx+1:]
+	}
+	return strings.TrimSuffix(name, ".git")
+}
+
+func runGit(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	return runGitInput(ctx, dir, nil, args...)
+}
+
+// runGitInput is runGit with stdin
+func runGitInput(ctx context.Context, dir string, stdin io.Reader, args ...string) ([]byte, error) {
+	return execGit(ctx, dir, stdin, nil, args...)
+}
+
+// runGitEnv is runGit with extra environment, for config that must not show up in the process list
+func runGitEnv(ctx context.Context, dir string, env []string, args ...string) ([]byte, error) {
+	return execGit(ctx, dir, nil, env, args...)
+}
+
+func execGit(ctx context.Context, dir string, stdin io.Reader, env []string, args ...string) ([]byte, error) {
+	cmdArgs := args
+	if dir != "" {
+		cmdArgs = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "git", cmdArgs...)
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Errorf("running git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// gitStream is the stdout of a running git command, the read that reaches its end reports how git exited
+type gitStream struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+	name   string
+	done   bool
+	err    error
+}
+
+// streamGit runs git in dir without waiting for its output
+func streamGit(ctx context.Context, dir string, args ...string) (io.ReadCloser, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	s := &gitStream{cmd: cmd, name: args[0]}
+	cmd.Stderr = &s.stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Errorf("running git %s: %w", args[0], err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Errorf("running git %s: %w", args[0], err)
+	}
+	s.ReadCloser = stdout
+	return s, nil
+}
+
+func (s *gitStream) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if err == io.EOF {
+		if werr := s.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (s *gitStream) wait() error {
+	if !s.done {
+		s.done = true
+		if err := s.cmd.Wait(); err != nil {
+			s.err = errors.Errorf("running git %s: %w: %s", s.name, err, strings.TrimSpace(s.stderr.String()))
+		}
+	}
+	return s.err
+}
+
+// Close stops git when the output was not read to the end
+func (s *gitStream) Close() error {
+	if !s.done {
+		_ = s.cmd.Process.Kill()
+		_ = s.wait()
+	}
+	return nil
+}
+
+// lock serializes the work on key, such as fetching into one clone, and returns the unlock
+func (g *GitProvider) lock(key string) func() {
+	g.mu.Lock()
+	l, ok := g.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		g.locks[key] = l
+	}
+	g.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// repoPath returns the cache directory of a remote
+func (g *GitProvider) repoPath(remote string) string {
+	sum := sha256.Sum256([]byte(remote))
+	return filepath.Join(g.cacheDir, gitRemoteName(remote)+"-"+hex.EncodeToString(sum[:6]))
+}
+
+// repoDir returns the cache directory for a remote, initializing a bare partial clone if needed
+func (g *GitProvider) repoDir(ctx context.Context, remote string) (string, error) {
+	dir := g.repoPath(remote)
+
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err == nil {
+		return dir, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Errorf("creating cache directory: %w", err)
+	}
+
+	for _, args := range [][]string{
+		{"init", "--bare", "-q"},
+		{"remote", "add", "origin", remote},
+		{"config", "core.repositoryformatversion", "1"},
+		{"config", "extensions.partialClone", "origin"},
+		{"config", "remote.origin.promisor", "true"},
+		{"config", "remote.origin.partialclonefilter", "blob:none"},
+	} {
+		if _, err := runGit(ctx, dir, args...); err != nil {
+			return "", errors.Errorf("initializing cache repository: %w", err)
+		}
+	}
+
+	return dir, nil
+}
+
+// fetch makes sure commitHash is available in the cache, fetching only that commit's tree
+func (g *GitProvider) fetch(ctx context.Context, dir string, args Source, commitHash string) error {
+	if _, err := runGit(ctx, dir, "cat-file", "-e", commitHash+"^{commit}"); err == nil {
+		return nil
+	}
+
+	// most servers allow fetching a reachable commit directly, fall back to the ref otherwise
+	if _, err := runGit(ctx, dir, "fetch", "-q", "--depth=1", "--filter=blob:none", "origin", commitHash); err == nil {
+		return nil
+	}
+
+	if _, err := runGit(ctx, dir, "fetch", "-q", "--depth=1", "--filter=blob:none", "origin", args.Ref); err != nil {
+		return errors.Errorf("fetching %s: %w", args.Ref, err)
+	}
+
+	if _, err := runGit(ctx, dir, "cat-file", "-e", commitHash+"^{commit}"); err != nil {
+		return errors.Errorf("commit %s not found after fetching %s", commitHash, args.Ref)
+	}
+
+	return nil
+}
+
+// checkout resolves the commit for args and makes sure it is fetched
+func (g *GitProvider) checkout(ctx context.Context, args Source) (string, string, error) {
+	remote, err := g.remoteFor(args.Repo)
+	if err != nil {
+		return "", "", errors.Errorf("parsing git remote: %w", err)
+	}
+
+	commitHash, err := g.GetCommitHash(ctx, args)
+	if err != nil {
+		return "", "", errors.Errorf("getting commit hash: %w", err)
+	}
+
+	// git commands that write to the same clone go one at a time
+	defer g.lock("dir:" + g.repoPath(remote))()
+
+	dir, err := g.repoDir(ctx, remote)
+	if err != nil {
+		return "", "", errors.Errorf("preparing cache: %w", err)
+	}
+
+	if err := g.fetch(ctx, dir, args, commitHash); err != nil {
+		return "", "", errors.Errorf("fetching repository: %w", err)
+	}
+
+	// mark the clone as used for cache prune
+	now := time.Now()
+	_ = os.Chtimes(dir, now, now)
+
+	return dir, commitHash, nil
+}
+
+// prefetch downloads the blobs under treePath that are not in the cache yet in one batch, so
+// reading the files does not take a lazy promisor fetch each. It runs once per commit and path.
+func (g *GitProvider) prefetch(ctx context.Context, dir string, commitHash string, treePath string) error {
+	key := dir + "\x00" + commitHash + "\x00" + strings.Trim(treePath, "/")
+
+	defer g.lock("dir:" + dir)()
+
+	g.mu.Lock()
+	done := g.prefetched[key]
+	g.mu.Unlock()
+	if done {
+		return nil
+	}
+
+	entries, err := lsTree(ctx, dir, commitHash, treePath, true)
+	if err != nil {
+		return errors.Errorf("listing files: %w", err)
+	}
+
+	// --missing=print lists the objects the partial clone does not have without fetching them
+	out, err := runGit(ctx, dir, "rev-list", "--objects", "--missing=print", commitHash)
+	if err != nil {
+		return errors.Errorf("listing missing objects: %w", err)
+	}
+	missing := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		if sha, ok := strings.CutPrefix(line, "?"); ok {
+			missing[sha] = true
+		}
+	}
+
+	var wants bytes.Buffer
+	for _, e := range entries {
+		if e.Type == "blob" && missing[e.Sha] {
+			wants.WriteString(e.Sha + "\n")
+			delete(missing, e.Sha)
+		}
+	}
+
+	// the same request git makes for a lazy fetch, with every blob at once
+	if wants.Len() > 0 {
+		if _, err := runGitInput(ctx, dir, &wants, "-c", "fetch.negotiationAlgorithm=noop", "fetch", "-q", "--no-tags",
+			"--no-write-fetch-head", "--recurse-submodules=no", "--filter=blob:none", "--stdin", "origin"); err != nil {
+			return errors.Errorf("fetching blobs: %w", err)
+		}
+	}
+
+	g.mu.Lock()
+	g.prefetched[key] = true
+	g.mu.Unlock()
+	return nil
+}
+
+type gitTreeEntry struct {
+	Mode string
+	Type string
+	Sha  string
+	Path string
+}
+
+func lsTree(ctx context.Context, dir string, commitHash string, treePath string, recursive bool) ([]gitTreeEntry, error) {
+	cmdArgs := []string{"ls-tree", "-z"}
+	if recursive {
+		cmdArgs = append(cmdArgs, "-r")
+	}
+	cmdArgs = append(cmdArgs, commitHash)
+	if treePath = strings.Trim(treePath, "/"); treePath != "" && treePath != "." {
+		cmdArgs = append(cmdArgs, "--", treePath+"/")
+	}
+
+	out, err := runGit(ctx, dir, cmdArgs...)
+	if err != nil {
+		return nil, errors.Errorf("listing tree: %w", err)
+	}
+
+	var entries []gitTreeEntry
+	for _, line := range strings.Split(string(out), "\x00") {
+		if line == "" {
+			continue
+		}
+		meta, file, ok := strings.Cut(line, "\t")
+		if !ok {
+			return nil, errors.Errorf("unexpected ls-tree output: %q", line)
+		}
+		fields := strings.Fields(meta)
+		if len(fields) != 3 {
+			return nil, errors.Errorf("unexpected ls-tree output: %q", line)
+		}
+		entries = append(entries, gitTreeEntry{Mode: fields[0], Type: fields[1], Sha: fields[2], Path: file})
+	}
+
+	return entries, nil
+}
+
+func (g *GitProvider) ListFiles(ctx context.Context, args Source, recursive bool) ([]ProviderFile, error) {
+	dir, commitHash, err := g.checkout(ctx, args)
+	if err != nil {
+		return nil, errors.Errorf("checking out repository: %w", err)
+	}
+
+	entries, err := lsTree(ctx, dir, commitHash, args.Path, recursive)
+	if err != nil {
+		return nil, errors.Errorf("listing files: %w", err)
+	}
+
+	result := make([]ProviderFile, 0, len(entries))
+	for _, e := range entries {
+		if e.Type != "blob" {
+			continue
+		}
+		result = append(result, ProviderFile{
+			Path: e.Path,
+			Sha:  e.Sha,
+		})
+	}
+	return result, nil
+}
+
+func (g *GitProvider) GetCommitHash(ctx context.Context, args Source) (string, error) {
+	if args.RefType == "commit" {
+		return args.Ref, nil
+	}
+
+	remote, err := g.remoteFor(args.Repo)
+	if err != nil {
+		return "", errors.Errorf("parsing git remote: %w", err)
+	}
+
+	// pin the ref for the lifetime of the provider so every file comes from the same commit
+	// and resolve it once, entries asking for the same ref wait for the first ls-remote
+	key := remote + "@" + args.Ref
+	defer g.lock("ref:" + key)()
+
+	g.mu.Lock()
+	hash, ok := g.resolved[key]
+	g.mu.Unlock()
+	if ok {
+		return hash, nil
+	}
+
+	hash, err = lsRemote(ctx, remote, args.Ref, nil)
+	if err != nil {
+		return "", err
+	}
+
+	g.mu.Lock()
+	g.resolved[key] = hash
+	g.mu.Unlock()
+	return hash, nil
+}
+
+// errGitRefNotFound is returned by lsRemote when the remote has no such ref
+var errGitRefNotFound = errors.Base("ref not found")
+
+// lsRemote resolves ref on remote to a commit hash, env is passed on to git
+func lsRemote(ctx context.Context, remote string, ref string, env []string) (string, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	out, err := runGitEnv(ctx, "", env, "ls-remote", remote, ref, ref+"^{}")
+	if err != nil {
+		return "", errors.Errorf("running git ls-remote: %w", err)
+	}
+
+	var hash string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			continue
+		}
+		// annotated tags are listed twice, prefer the peeled commit
+		if strings.HasSuffix(parts[1], "^{}") {
+			hash = parts[0]
+			break
+		}
+		if hash == "" {
+			hash = parts[0]
+		}
+	}
+
+	if hash == "" {
+		return "", errors.Errorf("no commit hash found for ref %s: %w", ref, errGitRefNotFound)
+	}
+	return hash, nil
+}
+
+// GetFile returns the contents of a file at the resolved commit
+func (g *GitProvider) GetFile(ctx context.Context, args Source, file string) ([]byte, error) {
+	dir, commitHash, err := g.checkout(ctx, args)
+	if err != nil {
+		return nil, errors.Errorf("checking out repository: %w", err)
+	}
+
+	if err := g.prefetch(ctx, dir, commitHash, args.Path); err != nil {
+		return nil, errors.Errorf("prefetching %s: %w", args.Path, err)
+	}
+
+	// files outside args.Path are still fetched lazily from the promisor remote
+	data, err := runGit(ctx, dir, "cat-file", "blob", commitHash+":"+file)
+	if err != nil {
+		return nil, errors.Errorf("reading %s: %w", file, err)
+	}
+	return data, nil
+}
+
+// OpenArchive streams a tar.gz of the resolved commit from git archive, laid out like a GitHub archive
+func (g *GitProvider) OpenArchive(ctx context.Context, args Source) (io.ReadCloser, error) {
+	dir, commitHash, err := g.checkout(ctx, args)
+	if err != nil {
+		return nil, errors.Errorf("checking out repository: %w", err)
+	}
+
+	if err := g.prefetch(ctx, dir, commitHash, ""); err != nil {
+		return nil, errors.Errorf("prefetching repository: %w", err)
+	}
+
+	prefix := gitRemoteName(args.Repo) + "-" + commitHash + "/"
+	rc, err := streamGit(ctx, dir, "archive", "--format=tar.gz", "--prefix="+prefix, commitHash)
+	if err != nil {
+		return nil, errors.Errorf("creating archive: %w", err)
+	}
+	return rc, nil
+}
+
+func (g *GitProvider) GetPermalink(ctx context.Context, args Source, commitHash string, file string) (string, error) {
+	remote, err := g.remoteFor(args.Repo)
+	if err != nil {
+		return "", errors.Errorf("parsing git remote: %w", err)
+	}
+	if file == "" && args.Path == "" {
+		// archive permalink
+		return fmt.Sprintf("%s#%s", remote, commitHash), nil
+	}
+	return fmt.Sprintf("%s#%s:%s", remote, commitHash, file), nil
+}
+
+func (g *GitProvider) GetSourceInfo(ctx context.Context, args Source, commitHash string) (string, error) {
+	remote, err := g.remoteFor(args.Repo)
+	if err != nil {
+		return "", errors.Errorf("parsing git remote: %w", err)
+	}
+	return fmt.Sprintf("%s@%s", remote, commitHash), nil
+}
+
+// GetArchiveUrl returns a reference to the archived commit, the archive itself comes from OpenArchive
+func (g *GitProvider) GetArchiveUrl(ctx context.Context, args Source) (string, error) {
+	commitHash, err := g.GetCommitHash(ctx, args)
+	if err != nil {
+		return "", errors.Errorf("getting commit hash: %w", err)
+	}
+	return g.GetPermalink(ctx, Source{Repo: args.Repo}, commitHash, "")
+}
+
+func (g *GitProvider) GetLicense(ctx context.Context, args Source, commitHash string) (LicenseEntry, error) {
+	dir, resolved, err := g.checkout(ctx, Source{Repo: args.Repo, Ref: commitHash, RefType: "commit"})
+	if err != nil {
+		return LicenseEntry{}, errors.Errorf("checking out repository: %w", err)
+	}
+
+	entries, err := lsTree(ctx, dir, resolved, "", false)
+	if err != nil {
+		return LicenseEntry{}, errors.Errorf("listing files: %w", err)
+	}
+
+	for _, e := range entries {
+		if e.Type != "blob" || !isLicenseFile(path.Base(e.Path)) {
+			continue
+		}
+
+		// a single file, not worth prefetching the whole tree for
+		data, err := runGit(ctx, dir, "cat-file", "blob", resolved+":"+e.Path)
+		if err != nil {
+			return LicenseEntry{}, errors.Errorf("reading license: %w", err)
+		}
+
+		spdx, name := detectLicense(data)
+		permalink, err := g.GetPermalink(ctx, args, resolved, e.Path)
+		if err != nil {
+			return LicenseEntry{}, errors.Errorf("getting permalink: %w", err)
+		}
+
+		return LicenseEntry{
+			SPDX:      spdx,
+			Name:      name,
+			Permalink: permalink,
+		}, nil
+	}
+
+	return LicenseEntry{}, nil
+}
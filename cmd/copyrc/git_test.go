@@ -0,0 +1,238 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMITLicense = `MIT License
+
+Copyright (c) 2025 test
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction.
+`
+
+// 🧪 gitTestRepo creates a bare repository with the given files committed on main
+func gitTestRepo(t *testing.T, files map[string]string) (remote string, commit string) {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	root := t.TempDir()
+	work := filepath.Join(root, "work")
+	bare := filepath.Join(root, "upstream.git")
+
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "git %v: %s", args, out)
+		return strings.TrimSpace(string(out))
+	}
+
+	require.NoError(t, os.MkdirAll(work, 0755))
+	git(work, "init", "-q", "-b", "main")
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(work, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(work, name), []byte(content), 0644))
+	}
+	git(work, "add", "-A")
+	git(work, "commit", "-q", "-m", "initial")
+	git(work, "tag", "-a", "v1.0.0", "-m", "v1.0.0")
+
+	git(root, "clone", "-q", "--bare", work, bare)
+	git(bare, "config", "uploadpack.allowFilter", "true")
+	git(bare, "config", "uploadpack.allowAnySHA1InWant", "true")
+
+	return "file://" + bare, git(work, "rev-parse", "HEAD")
+}
+
+func TestParseGitRemote(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "https", input: "https://git.example.com/org/repo.git"},
+		{name: "ssh", input: "ssh://git@git.example.com:2222/org/repo.git"},
+		{name: "scp_like", input: "git@git.example.com:org/repo.git"},
+		{name: "file", input: "file:///srv/git/repo.git"},
+		{name: "bare_github_style", input: "github.com/org/repo", wantErr: true},
+		{name: "empty_file", input: "file://", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, err := parseGitRemote(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.input, remote)
+		})
+	}
+}
+
+func TestGitProvider(t *testing.T) {
+	remote, commit := gitTestRepo(t, map[string]string{
+		"LICENSE":               testMITLicense,
+		"README.md":             "# readme\n",
+		"pkg/main.go":           "package pkg\n",
+		"pkg/internal/utils.go": "package internal\n",
+	})
+
+	provider, err := NewGitProvider(t.TempDir(), "")
+	require.NoError(t, err)
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	src := Source{Repo: remote, Ref: "main", Path: "pkg"}
+
+	t.Run("GetCommitHash", func(t *testing.T) {
+		hash, err := provider.GetCommitHash(ctx, src)
+		require.NoError(t, err)
+		assert.Equal(t, commit, hash)
+
+		hash, err = provider.GetCommitHash(ctx, Source{Repo: remote, Ref: "v1.0.0"})
+		require.NoError(t, err)
+		assert.Equal(t, commit, hash, "annotated tags should resolve to the peeled commit")
+	})
+
+	t.Run("ListFiles", func(t *testing.T) {
+		files, err := provider.ListFiles(ctx, src, false)
+		require.NoError(t, err)
+		assert.Equal(t, []ProviderFile{{Path: "pkg/main.go", Sha: gitBlobSha([]byte("package pkg\n"))}}, files)
+
+		files, err = provider.ListFiles(ctx, src, true)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []ProviderFile{
+			{Path: "pkg/internal/utils.go", Sha: gitBlobSha([]byte("package internal\n"))},
+			{Path: "pkg/main.go", Sha: gitBlobSha([]byte("package pkg\n"))},
+		}, files)
+	})
+
+	t.Run("GetFile", func(t *testing.T) {
+		data, err := provider.GetFile(ctx, src, "pkg/internal/utils.go")
+		require.NoError(t, err)
+		assert.Equal(t, "package internal\n", string(data))
+	})
+
+	t.Run("prefetch", func(t *testing.T) {
+		fresh, err := NewGitProvider(t.TempDir(), "")
+		require.NoError(t, err)
+
+		data, err := fresh.GetFile(ctx, src, "pkg/main.go")
+		require.NoError(t, err)
+		assert.Equal(t, "package pkg\n", string(data))
+
+		dir, err := fresh.repoDir(ctx, remote)
+		require.NoError(t, err)
+		out, err := runGit(ctx, dir, "rev-list", "--objects", "--missing=print", commit)
+		require.NoError(t, err)
+		assert.NotContains(t, string(out), "?"+gitBlobSha([]byte("package internal\n")), "every blob under the path is fetched with the first file")
+		assert.Contains(t, string(out), "?"+gitBlobSha([]byte("# readme\n")), "blobs outside the path are left to lazy fetches")
+	})
+
+	t.Run("parallel", func(t *testing.T) {
+		other, _ := gitTestRepo(t, map[string]string{"b.go": "package b\n"})
+
+		fresh, err := NewGitProvider(t.TempDir(), "")
+		require.NoError(t, err)
+
+		// a long fetch into one clone must not hold up another repo
+		unlock := fresh.lock("dir:" + fresh.repoPath(remote))
+		defer unlock()
+
+		data, err := fresh.GetFile(ctx, Source{Repo: other, Ref: "main"}, "b.go")
+		require.NoError(t, err)
+		assert.Equal(t, "package b\n", string(data))
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		fresh, err := NewGitProvider(cacheDir, "")
+		require.NoError(t, err)
+		_, err = fresh.GetFile(ctx, src, "pkg/main.go")
+		require.NoError(t, err)
+
+		removed, _, err := pruneGitCache(cacheDir, time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, 0, removed, "a clone used just now is kept")
+
+		removed, freed, err := pruneGitCache(cacheDir, 0)
+		require.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		assert.Positive(t, freed)
+
+		entries, err := os.ReadDir(cacheDir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("GetLicense", func(t *testing.T) {
+		license, err := provider.GetLicense(ctx, src, commit)
+		require.NoError(t, err)
+		assert.Equal(t, "MIT", license.SPDX)
+		assert.Equal(t, remote+"#"+commit+":LICENSE", license.Permalink)
+	})
+
+	t.Run("OpenArchive", func(t *testing.T) {
+		data, err := GetFileFromTarball(ctx, provider, Source{Repo: remote, Ref: "main"})
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x1f, 0x8b}, data[0:2], "should be gzipped data")
+	})
+
+	t.Run("process", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      src,
+			Destination: Destination{Path: t.TempDir()},
+			CopyArgs: &CopyEntry_Options{
+				Recursive:    true,
+				Replacements: []Replacement{{Old: "package internal", New: "package utils"}},
+			},
+		}
+		require.NoError(t, process(ctx, cfg, provider))
+
+		content, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "internal", "utils.go"))
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "package utils")
+		assert.Contains(t, string(content), "license: MIT")
+
+		status, err := loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+		require.NoError(t, err)
+		assert.Equal(t, commit, status.CommitHash)
+		assert.Len(t, status.CoppiedFiles, 2)
+	})
+}
@@ -16,26 +16,131 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"strings"
+	"sync"
 
 	"gitlab.com/tozd/go/errors"
 )
 
-// 🏗️ Github implementation
+// 🏗️ Github implementation, for github.com or a GitHub Enterprise Server host
 type GithubProvider struct {
+	host     string
+	apiURL   string
+	rawURL   string
+	webURL   string
+	tokenEnv string
+
+	mu       sync.Mutex
+	resolved map[string]string
+}
+
+// GithubProviderOptions configures the hosts a GithubProvider talks to, empty fields are derived from Host
+type GithubProviderOptions struct {
+	Host     string // github.com or the enterprise host (e.g. github.corp.example)
+	APIURL   string // defaults to https://api.github.com or https://<host>/api/v3
+	RawURL   string // defaults to https://raw.githubusercontent.com or https://<host>/raw
+	WebURL   string // defaults to https://github.com or https://<host>
+	TokenEnv string // defaults to GITHUB_TOKEN or GH_ENTERPRISE_TOKEN
 }
 
 func NewGithubProvider() (*GithubProvider, error) {
-	return &GithubProvider{}, nil
+	return NewGithubProviderWithOptions(GithubProviderOptions{})
+}
+
+func NewGithubProviderWithOptions(opts GithubProviderOptions) (*GithubProvider, error) {
+	g := &GithubProvider{
+		host:     opts.Host,
+		apiURL:   strings.TrimSuffix(opts.APIURL, "/"),
+		rawURL:   strings.TrimSuffix(opts.RawURL, "/"),
+		webURL:   strings.TrimSuffix(opts.WebURL, "/"),
+		tokenEnv: opts.TokenEnv,
+		resolved: make(map[string]string),
+	}
+
+	if g.host == "" {
+		g.host = "github.com"
+	}
+
+	if g.host == "github.com" {
+		if g.webURL == "" {
+			g.webURL = "https://github.com"
+		}
+		if g.apiURL == "" {
+			g.apiURL = "https://api.github.com"
+		}
+		if g.rawURL == "" {
+			g.rawURL = "https://raw.githubusercontent.com"
+		}
+	} else {
+		if g.webURL == "" {
+			g.webURL = "https://" + g.host
+		}
+		if g.apiURL == "" {
+			g.apiURL = g.webURL + "/api/v3"
+		}
+		if g.rawURL == "" {
+			g.rawURL = g.webURL + "/raw"
+		}
+	}
+
+	return g, nil
+}
+
+// token returns the api token for the provider's host, following the gh cli conventions for enterprise hosts
+func (g *GithubProvider) token() (string, string) {
+	if g.tokenEnv != "" {
+		return os.Getenv(g.tokenEnv), g.tokenEnv
+	}
+	if g.host == "github.com" {
+		return os.Getenv("GITHUB_TOKEN"), "GITHUB_TOKEN"
+	}
+	for _, env := range []string{"GH_ENTERPRISE_TOKEN", "GITHUB_ENTERPRISE_TOKEN"} {
+		if token := os.Getenv(env); token != "" {
+			return token, env
+		}
+	}
+	return "", "GH_ENTERPRISE_TOKEN"
+}
+
+// get requests url with the token of the host, raw and archive downloads of private repositories need it as much as the api
+func (g *GithubProvider) get(ctx context.Context, url string, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, errors.Errorf("creating request: %w", err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	token, tokenEnv := g.token()
+	if token != "" {
+		req.Header.Set("Authorization", "token "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("requesting %s: %w", url, err)
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		resp.Body.Close()
+		return nil, errors.Errorf("unexpected status code: %d - try setting %s", resp.StatusCode, tokenEnv)
+	}
+
+	return resp, nil
 }
 
 func parseGithubRepo(repo string) (org string, name string, err error) {
+	return parseGithubRepoForHost(repo, "github.com")
+}
+
+func parseGithubRepoForHost(repo string, host string) (org string, name string, err error) {
 	// Remove "From " prefix if present
 	repo = strings.TrimPrefix(repo, "From ")
 
@@ -45,43 +150,113 @@ func parseGithubRepo(repo string) (org string, name string, err error) {
 	}
 
 	parts := strings.Split(repo, "/")
-	if len(parts) != 3 || parts[0] != "github.com" {
-		return "", "", errors.Errorf("invalid github repository format: %s (expected github.com/org/repo)", repo)
+	if len(parts) != 3 || parts[0] != host {
+		return "", "", errors.Errorf("invalid github repository format: %s (expected %s/org/repo)", repo, host)
 	}
 	return parts[1], parts[2], nil
 }
 
+func (g *GithubProvider) parseRepo(repo string) (org string, name string, err error) {
+	return parseGithubRepoForHost(repo, g.host)
+}
+
 func (g *GithubProvider) ListFiles(ctx context.Context, args Source, recursive bool) ([]ProviderFile, error) {
-	org, repo, err := parseGithubRepo(args.Repo)
+	commitHash, err := g.GetCommitHash(ctx, args)
 	if err != nil {
-		return nil, errors.Errorf("parsing github repository: %w", err)
+		return nil, errors.Errorf("getting commit hash: %w", err)
 	}
 
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s?ref=%s", org, repo, args.Path, args.Ref)
+	// list the commit the files are downloaded from, the ref may move in between
+	pinned := args
+	pinned.Ref = commitHash
+	pinned.RefType = "commit"
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if !recursive {
+		return g.listContents(ctx, pinned, false)
+	}
+
+	files, truncated, err := g.listTree(ctx, pinned, commitHash)
 	if err != nil {
-		return nil, errors.Errorf("creating request: %w", err)
+		return nil, err
 	}
 
-	// Add GitHub token if available
-	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
-		req.Header.Set("Authorization", "token "+token)
+	// the trees api caps large responses, walk the directories one by one instead
+	if truncated {
+		return g.listContents(ctx, pinned, true)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	return files, nil
+}
+
+// listTree lists every blob under args.Path at commitHash with a single request to the git trees api
+func (g *GithubProvider) listTree(ctx context.Context, args Source, commitHash string) (files []ProviderFile, truncated bool, err error) {
+	org, repo, err := g.parseRepo(args.Repo)
 	if err != nil {
-		return nil, errors.Errorf("fetching file list: %w", err)
+		return nil, false, errors.Errorf("parsing github repository: %w", err)
+	}
+
+	resp, err := g.get(ctx, fmt.Sprintf("%s/repos/%s/%s/git/trees/%s?recursive=1", g.apiURL, org, repo, commitHash), "")
+	if err != nil {
+		return nil, false, errors.Errorf("fetching file tree: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound {
-		return []ProviderFile{}, nil
+		return []ProviderFile{}, false, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, errors.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var tree struct {
+		Tree []struct {
+			Path string `json:"path"`
+			Type string `json:"type"`
+			Sha  string `json:"sha"`
+		} `json:"tree"`
+		Truncated bool `json:"truncated"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tree); err != nil {
+		return nil, false, errors.Errorf("decoding response: %w", err)
+	}
+
+	if tree.Truncated {
+		return nil, true, nil
+	}
+
+	prefix := strings.Trim(args.Path, "/")
+	result := []ProviderFile{}
+	for _, entry := range tree.Tree {
+		if entry.Type != "blob" {
+			continue
+		}
+		if prefix != "" && entry.Path != prefix && !strings.HasPrefix(entry.Path, prefix+"/") {
+			continue
+		}
+		result = append(result, ProviderFile{
+			Path: entry.Path,
+			Sha:  entry.Sha,
+		})
+	}
+	return result, false, nil
+}
+
+// listContents lists files through the contents api, one request per directory
+func (g *GithubProvider) listContents(ctx context.Context, args Source, recursive bool) ([]ProviderFile, error) {
+	org, repo, err := g.parseRepo(args.Repo)
+	if err != nil {
+		return nil, errors.Errorf("parsing github repository: %w", err)
 	}
 
-	if resp.StatusCode == http.StatusForbidden {
+	resp, err := g.get(ctx, fmt.Sprintf("%s/repos/%s/%s/contents/%s?ref=%s", g.apiURL, org, repo, args.Path, args.Ref), "")
+	if err != nil {
+		return nil, errors.Errorf("fetching file list: %w", err)
+	}
+	defer resp.Body.Close()
 
-		return nil, errors.Errorf("unexpected status code: %d - try setting GITHUB_TOKEN", resp.StatusCode)
+	if resp.StatusCode == http.StatusNotFound {
+		return []ProviderFile{}, nil
 	}
 
 	if resp.StatusCode != http.StatusOK {
@@ -95,29 +270,25 @@ func (g *GithubProvider) ListFiles(ctx context.Context, args Source, recursive b
 	}
 
 	// Try to decode as array first
-	var files []struct {
+	type contentEntry struct {
 		Path string `json:"path"`
 		Type string `json:"type"`
+		Sha  string `json:"sha"`
 	}
+	var files []contentEntry
 	if err := json.Unmarshal(body, &files); err != nil {
-		var file struct {
-			Path string `json:"path"`
-			Type string `json:"type"`
-		}
+		var file contentEntry
 		if err := json.Unmarshal(body, &file); err != nil {
 			return nil, errors.Errorf("decoding response: %w", err)
 		}
-		files = []struct {
-			Path string `json:"path"`
-			Type string `json:"type"`
-		}{file}
+		files = []contentEntry{file}
 	}
 
 	result := make([]ProviderFile, 0, len(files))
 	for _, f := range files {
 
 		if f.Type == "dir" && recursive {
-			childs, err := g.ListFiles(ctx, Source{
+			childs, err := g.listContents(ctx, Source{
 				Repo:    args.Repo,
 				Ref:     args.Ref,
 				Path:    f.Path,
@@ -131,6 +302,7 @@ func (g *GithubProvider) ListFiles(ctx context.Context, args Source, recursive b
 		if f.Type == "file" {
 			result = append(result, ProviderFile{
 				Path: f.Path,
+				Sha:  f.Sha,
 			})
 		}
 	}
@@ -138,13 +310,25 @@ func (g *GithubProvider) ListFiles(ctx context.Context, args Source, recursive b
 }
 
 func (g *GithubProvider) GetCommitHash(ctx context.Context, args Source) (string, error) {
-	// Try the specified ref first
-	hash, err := g.tryGetCommitHash(ctx, args)
-	if err == nil {
+	if args.RefType == "commit" {
+		return args.Ref, nil
+	}
+
+	// pin the ref for the lifetime of the provider so every file comes from the same commit
+	key := args.Repo + "@" + args.Ref
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if hash, ok := g.resolved[key]; ok {
 		return hash, nil
 	}
 
-	return "", errors.Errorf("getting commit hash: %w", err)
+	hash, err := g.tryGetCommitHash(ctx, args)
+	if err != nil {
+		return "", errors.Errorf("getting commit hash: %w", err)
+	}
+
+	g.resolved[key] = hash
+	return hash, nil
 }
 
 func (g *GithubProvider) tryGetCommitHash(ctx context.Context, args Source) (string, error) {
@@ -152,30 +336,91 @@ func (g *GithubProvider) tryGetCommitHash(ctx context.Context, args Source) (str
 	if args.RefType == "commit" {
 		return args.Ref, nil
 	}
-	org, repo, err := parseGithubRepo(args.Repo)
+	org, repo, err := g.parseRepo(args.Repo)
 	if err != nil {
 		return "", errors.Errorf("parsing github repository: %w", err)
 	}
 
-	cmd := exec.CommandContext(ctx, "git", "ls-remote",
-		fmt.Sprintf("https://github.com/%s/%s.git", org, repo),
-		args.Ref)
+	// ls-remote does not count against the api rate limit. The token goes in an extra header
+	// set through the environment, so it stays out of the remote url and the process list.
+	var env []string
+	if token, _ := g.token(); token != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+		env = []string{"GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader", "GIT_CONFIG_VALUE_0=Authorization: Basic " + auth}
+	}
+
+	hash, err := lsRemote(ctx, fmt.Sprintf("%s/%s/%s.git", g.webURL, org, repo), args.Ref, env)
+	if errors.Is(err, errGitRefNotFound) {
+		return "", errors.Errorf("invalid tag or reference '%s'", args.Ref)
+	}
+	if err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// GetFile downloads a file from the raw host with the token, the permalink alone can't authenticate
+func (g *GithubProvider) GetFile(ctx context.Context, args Source, file string) ([]byte, error) {
+	commitHash, err := g.GetCommitHash(ctx, args)
+	if err != nil {
+		return nil, errors.Errorf("getting commit hash: %w", err)
+	}
+
+	permalink, err := g.GetPermalink(ctx, args, commitHash, file)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := g.get(ctx, permalink, "")
+	if err != nil {
+		return nil, errors.Errorf("downloading file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("downloading file %s: %s", file, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("reading file: %w", err)
+	}
+	return data, nil
+}
+
+// OpenArchive downloads the tarball of the resolved commit through the api with the token,
+// GetArchiveUrl alone can't authenticate
+func (g *GithubProvider) OpenArchive(ctx context.Context, args Source) (io.ReadCloser, error) {
+	org, repo, err := g.parseRepo(args.Repo)
+	if err != nil {
+		return nil, errors.Errorf("parsing github repository: %w", err)
+	}
+
+	commitHash, err := g.GetCommitHash(ctx, args)
+	if err != nil {
+		return nil, errors.Errorf("getting commit hash: %w", err)
+	}
 
-	out, err := cmd.Output()
+	resp, err := g.get(ctx, fmt.Sprintf("%s/repos/%s/%s/tarball/%s", g.apiURL, org, repo, commitHash), "")
 	if err != nil {
-		return "", errors.Errorf("running git ls-remote: %w", err)
+		return nil, errors.Errorf("downloading archive: %w", err)
 	}
 
-	parts := strings.Fields(string(out))
-	if len(parts) == 0 {
-		return "", errors.New("no commit hash found")
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errors.Errorf("invalid tag or reference '%s'", args.Ref)
 	}
 
-	return parts[0], nil
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("downloading archive: %s", resp.Status)
+	}
+
+	return resp.Body, nil
 }
 
 func (g *GithubProvider) GetPermalink(ctx context.Context, args Source, commitHash string, file string) (string, error) {
-	org, repo, err := parseGithubRepo(args.Repo)
+	org, repo, err := g.parseRepo(args.Repo)
 	if err != nil {
 		return "", errors.Errorf("parsing github repository: %w", err)
 	}
@@ -187,68 +432,46 @@ func (g *GithubProvider) GetPermalink(ctx context.Context, args Source, commitHa
 		}
 		return url, nil
 	}
-	return fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/%s",
-		org, repo, commitHash, file), nil
+	return fmt.Sprintf("%s/%s/%s/%s/%s",
+		g.rawURL, org, repo, commitHash, file), nil
 }
 
 func (g *GithubProvider) GetSourceInfo(ctx context.Context, args Source, commitHash string) (string, error) {
-	org, repo, err := parseGithubRepo(args.Repo)
+	org, repo, err := g.parseRepo(args.Repo)
 	if err != nil {
 		return "", errors.Errorf("parsing github repository: %w", err)
 	}
-	return fmt.Sprintf("github.com/%s/%s@%s", org, repo, commitHash), nil
+	return fmt.Sprintf("%s/%s/%s@%s", g.host, org, repo, commitHash), nil
 }
 
-// GetArchiveUrl returns the URL to download the repository archive
+// GetArchiveUrl returns the URL to download the repository archive at the resolved commit, archives
+// are cached by commit so a moving ref must not pick what is downloaded
 func (g *GithubProvider) GetArchiveUrl(ctx context.Context, args Source) (string, error) {
-	org, repo, err := parseGithubRepo(args.Repo)
+	org, repo, err := g.parseRepo(args.Repo)
 	if err != nil {
 		return "", errors.Errorf("parsing github repository: %w", err)
 	}
-	var refPath string
-	switch args.RefType {
-	case "commit":
-		refPath = args.Ref
-	case "branch":
-		refPath = "heads/" + args.Ref
-	default:
-		if strings.HasPrefix(args.Ref, "tags/") {
-			refPath = "refs/" + args.Ref
-		} else {
-			refPath = "refs/tags/" + args.Ref
-		}
+
+	commitHash, err := g.GetCommitHash(ctx, args)
+	if err != nil {
+		return "", errors.Errorf("getting commit hash: %w", err)
 	}
 
-	return fmt.Sprintf("https://github.com/%s/%s/archive/%s.tar.gz", org, repo, refPath), nil
+	return fmt.Sprintf("%s/%s/%s/archive/%s.tar.gz", g.webURL, org, repo, commitHash), nil
 }
 
 func (g *GithubProvider) GetLicense(ctx context.Context, args Source, commitHash string) (LicenseEntry, error) {
-	org, repo, err := parseGithubRepo(args.Repo)
+	org, repo, err := g.parseRepo(args.Repo)
 	if err != nil {
 		return LicenseEntry{}, errors.Errorf("parsing github repository: %w", err)
 	}
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/license?ref=%s", org, repo, commitHash)
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return LicenseEntry{}, errors.Errorf("creating request: %w", err)
-	}
-
-	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
-		req.Header.Set("Authorization", "token "+token)
-	}
-
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := g.get(ctx, fmt.Sprintf("%s/repos/%s/%s/license?ref=%s", g.apiURL, org, repo, commitHash), "")
 	if err != nil {
 		return LicenseEntry{}, errors.Errorf("fetching license: %w", err)
 	}
-
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == http.StatusForbidden {
-			return LicenseEntry{}, errors.Errorf("unexpected status code: %d - try setting GITHUB_TOKEN", resp.StatusCode)
-		}
 		return LicenseEntry{}, errors.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
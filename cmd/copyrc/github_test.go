@@ -15,6 +15,15 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -70,3 +79,208 @@ func TestParseGithubRepo(t *testing.T) {
 		})
 	}
 }
+
+func TestParseGithubRepoForHost(t *testing.T) {
+	org, repo, err := parseGithubRepoForHost("github.corp.example/platform/tools@main", "github.corp.example")
+	require.NoError(t, err)
+	assert.Equal(t, "platform", org)
+	assert.Equal(t, "tools", repo)
+
+	_, _, err = parseGithubRepoForHost("github.com/platform/tools", "github.corp.example")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expected github.corp.example/org/repo")
+}
+
+func TestGithubEnterpriseProvider(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	const truncatedCommit = "89abcdef0123456789abcdef0123456789abcdef"
+
+	// refs are resolved with git ls-remote over the smart http protocol, which authenticates with basic auth
+	pkt := func(line string) string { return fmt.Sprintf("%04x%s", len(line)+4, line) }
+	gitAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("x-access-token:secret"))
+
+	var commitLookups atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/platform/tools.git/info/refs" {
+			if r.Header.Get("Authorization") != gitAuth {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			commitLookups.Add(1)
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+			_, _ = io.WriteString(w, pkt("# service=git-upload-pack\n")+"0000"+pkt(commit+" refs/tags/v1.0.0\x00agent=test\n")+"0000")
+			return
+		}
+		if r.Header.Get("Authorization") != "token secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v3/repos/platform/tools/license":
+			assert.Equal(t, commit, r.URL.Query().Get("ref"))
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"url":     "https://github.corp.example/api/v3/repos/platform/tools/license",
+				"license": map[string]string{"spdx_id": "MIT", "name": "MIT License"},
+			})
+		case "/api/v3/repos/platform/tools/contents/pkg":
+			assert.Contains(t, []string{commit, truncatedCommit}, r.URL.Query().Get("ref"), "listings are pinned to the resolved commit")
+			_ = json.NewEncoder(w).Encode([]map[string]string{
+				{"path": "pkg/main.go", "type": "file", "sha": "aaa"},
+				{"path": "pkg/nested", "type": "dir", "sha": "bbb"},
+			})
+		case "/api/v3/repos/platform/tools/contents/pkg/nested":
+			assert.Equal(t, truncatedCommit, r.URL.Query().Get("ref"), "the truncated fallback lists the resolved commit")
+			_ = json.NewEncoder(w).Encode([]map[string]string{
+				{"path": "pkg/nested/helper.go", "type": "file", "sha": "ccc"},
+			})
+		case "/api/v3/repos/platform/tools/git/trees/" + commit:
+			assert.Equal(t, "1", r.URL.Query().Get("recursive"))
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"sha": "tree",
+				"tree": []map[string]string{
+					{"path": "README.md", "type": "blob", "sha": "ddd"},
+					{"path": "pkg", "type": "tree", "sha": "eee"},
+					{"path": "pkg/main.go", "type": "blob", "sha": "aaa"},
+					{"path": "pkg/nested", "type": "tree", "sha": "bbb"},
+					{"path": "pkg/nested/helper.go", "type": "blob", "sha": "ccc"},
+					{"path": "pkgs/other.go", "type": "blob", "sha": "fff"},
+				},
+				"truncated": false,
+			})
+		case "/raw/platform/tools/" + commit + "/pkg/main.go":
+			_, _ = w.Write([]byte("package main\n"))
+		case "/api/v3/repos/platform/tools/tarball/" + commit:
+			_, _ = w.Write([]byte{0x1f, 0x8b, 0x08})
+		case "/api/v3/repos/platform/tools/git/trees/" + truncatedCommit:
+			_ = json.NewEncoder(w).Encode(map[string]any{"sha": "tree", "tree": []any{}, "truncated": true})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	provider, err := NewGithubProviderWithOptions(GithubProviderOptions{
+		Host:   "github.corp.example",
+		WebURL: server.URL,
+	})
+	require.NoError(t, err)
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	src := Source{Repo: "github.corp.example/platform/tools", Ref: "v1.0.0", Path: "pkg"}
+
+	t.Run("urls", func(t *testing.T) {
+		link, err := provider.GetPermalink(ctx, src, commit, "pkg/main.go")
+		require.NoError(t, err)
+		assert.Equal(t, server.URL+"/raw/platform/tools/"+commit+"/pkg/main.go", link)
+
+		t.Setenv("GH_ENTERPRISE_TOKEN", "secret")
+		link, err = provider.GetArchiveUrl(ctx, src)
+		require.NoError(t, err)
+		assert.Equal(t, server.URL+"/platform/tools/archive/"+commit+".tar.gz", link, "archives are downloaded by the resolved commit")
+
+		info, err := provider.GetSourceInfo(ctx, src, commit)
+		require.NoError(t, err)
+		assert.Equal(t, "github.corp.example/platform/tools@"+commit, info)
+	})
+
+	t.Run("enterprise_token", func(t *testing.T) {
+		t.Setenv("GITHUB_TOKEN", "")
+		t.Setenv("GH_ENTERPRISE_TOKEN", "secret")
+
+		license, err := provider.GetLicense(ctx, src, commit)
+		require.NoError(t, err)
+		assert.Equal(t, "MIT", license.SPDX)
+
+		files, err := provider.ListFiles(ctx, src, false)
+		require.NoError(t, err)
+		assert.Equal(t, []ProviderFile{{Path: "pkg/main.go", Sha: "aaa"}}, files)
+	})
+
+	t.Run("recursive_tree", func(t *testing.T) {
+		t.Setenv("GH_ENTERPRISE_TOKEN", "secret")
+
+		pinned := Source{Repo: src.Repo, Ref: commit, RefType: "commit", Path: "pkg"}
+		files, err := provider.ListFiles(ctx, pinned, true)
+		require.NoError(t, err)
+		assert.Equal(t, []ProviderFile{
+			{Path: "pkg/main.go", Sha: "aaa"},
+			{Path: "pkg/nested/helper.go", Sha: "ccc"},
+		}, files)
+	})
+
+	t.Run("truncated_tree_falls_back", func(t *testing.T) {
+		t.Setenv("GH_ENTERPRISE_TOKEN", "secret")
+
+		pinned := Source{Repo: src.Repo, Ref: truncatedCommit, RefType: "commit", Path: "pkg"}
+		files, err := provider.ListFiles(ctx, pinned, true)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []ProviderFile{
+			{Path: "pkg/main.go", Sha: "aaa"},
+			{Path: "pkg/nested/helper.go", Sha: "ccc"},
+		}, files)
+	})
+
+	t.Run("token_on_downloads", func(t *testing.T) {
+		t.Setenv("GH_ENTERPRISE_TOKEN", "secret")
+
+		hash, err := provider.GetCommitHash(ctx, src)
+		require.NoError(t, err)
+		assert.Equal(t, commit, hash)
+
+		data, err := provider.GetFile(ctx, src, "pkg/main.go")
+		require.NoError(t, err)
+		assert.Equal(t, "package main\n", string(data))
+
+		rc, err := provider.OpenArchive(ctx, src)
+		require.NoError(t, err)
+		defer rc.Close()
+		archive, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x1f, 0x8b, 0x08}, archive, "the archive of the resolved commit comes from the api")
+
+		_, err = provider.ListFiles(ctx, src, false)
+		require.NoError(t, err)
+		assert.Equal(t, int32(1), commitLookups.Load(), "the ref is resolved once per provider")
+
+		_, err = provider.GetCommitHash(ctx, Source{Repo: src.Repo, Ref: "v9.9.9"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid tag or reference 'v9.9.9'")
+	})
+
+	t.Run("github_token_is_not_sent", func(t *testing.T) {
+		t.Setenv("GITHUB_TOKEN", "secret")
+		t.Setenv("GH_ENTERPRISE_TOKEN", "")
+		t.Setenv("GITHUB_ENTERPRISE_TOKEN", "")
+
+		_, err := provider.GetLicense(ctx, src, commit)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "GH_ENTERPRISE_TOKEN")
+	})
+
+	t.Run("unauthorized_listing", func(t *testing.T) {
+		unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer unauthorized.Close()
+
+		p, err := NewGithubProviderWithOptions(GithubProviderOptions{Host: "github.corp.example", WebURL: unauthorized.URL})
+		require.NoError(t, err)
+
+		pinned := Source{Repo: src.Repo, Ref: commit, RefType: "commit", Path: "pkg"}
+		for _, recursive := range []bool{false, true} {
+			_, err = p.ListFiles(ctx, pinned, recursive)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "try setting GH_ENTERPRISE_TOKEN")
+		}
+		_, err = p.GetLicense(ctx, pinned, commit)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "try setting GH_ENTERPRISE_TOKEN")
+	})
+
+	t.Run("public_repo_rejected", func(t *testing.T) {
+		_, err := provider.GetPermalink(ctx, Source{Repo: "github.com/platform/tools"}, commit, "pkg/main.go")
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,356 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// 🏗️ Gitlab implementation, talks to the v4 api of gitlab.com or a self-hosted instance
+type GitlabProvider struct {
+	baseURL  string
+	tokenEnv string
+
+	mu       sync.Mutex
+	resolved map[string]string
+}
+
+// NewGitlabProvider creates a gitlab provider, an empty baseURL derives it from the repo host
+// and an empty tokenEnv reads the token from GITLAB_TOKEN
+func NewGitlabProvider(baseURL string, tokenEnv string) (*GitlabProvider, error) {
+	if tokenEnv == "" {
+		tokenEnv = "GITLAB_TOKEN"
+	}
+	return &GitlabProvider{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		tokenEnv: tokenEnv,
+		resolved: make(map[string]string),
+	}, nil
+}
+
+// parseGitlabRepo splits a repo like gitlab.com/group/sub/repo into its host and project path
+func parseGitlabRepo(repo string) (host string, project string, err error) {
+	// Remove "From " prefix if present
+	repo = strings.TrimPrefix(repo, "From ")
+
+	// Remove @ref suffix if present
+	if idx := strings.LastIndex(repo, "@"); idx != -1 {
+		repo = repo[:idx]
+	}
+
+	repo = strings.TrimSuffix(repo, ".git")
+
+	parts := strings.Split(repo, "/")
+	if len(parts) < 3 || slices.Contains(parts, "") {
+		return "", "", errors.Errorf("invalid gitlab repository format: %s (expected host/group[/subgroup...]/repo)", repo)
+	}
+	return parts[0], strings.Join(parts[1:], "/"), nil
+}
+
+// gitlabRef strips the tags/ and heads/ prefixes used elsewhere in copyrc configs
+func gitlabRef(ref string) string {
+	ref = strings.TrimPrefix(ref, "refs/")
+	ref = strings.TrimPrefix(ref, "tags/")
+	return strings.TrimPrefix(ref, "heads/")
+}
+
+// projectURL returns the api url for the project, honoring a per-entry base url
+func (g *GitlabProvider) projectURL(args Source) (string, error) {
+	host, project, err := parseGitlabRepo(args.Repo)
+	if err != nil {
+		return "", errors.Errorf("parsing gitlab repository: %w", err)
+	}
+	return fmt.Sprintf("%s/api/v4/projects/%s", g.webURL(args, host), url.PathEscape(project)), nil
+}
+
+func (g *GitlabProvider) webURL(args Source, host string) string {
+	if args.BaseURL != "" {
+		return strings.TrimSuffix(args.BaseURL, "/")
+	}
+	if g.baseURL != "" {
+		return g.baseURL
+	}
+	return "https://" + host
+}
+
+func (g *GitlabProvider) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, errors.Errorf("creating request: %w", err)
+	}
+
+	// Add GitLab token if available
+	if token := os.Getenv(g.tokenEnv); token != "" {
+		req.Header.Set("PRIVATE-TOKEN", token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("requesting %s: %w", url, err)
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		resp.Body.Close()
+		return nil, errors.Errorf("unexpected status code: %d - try setting %s", resp.StatusCode, g.tokenEnv)
+	}
+
+	return resp, nil
+}
+
+func (g *GitlabProvider) getJSON(ctx context.Context, url string, v any) (http.Header, error) {
+	resp, err := g.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, errors.Errorf("decoding response: %w", err)
+	}
+	return resp.Header, nil
+}
+
+func (g *GitlabProvider) ListFiles(ctx context.Context, args Source, recursive bool) ([]ProviderFile, error) {
+	projectURL, err := g.projectURL(args)
+	if err != nil {
+		return nil, err
+	}
+
+	commitHash, err := g.GetCommitHash(ctx, args)
+	if err != nil {
+		return nil, errors.Errorf("getting commit hash: %w", err)
+	}
+
+	result := []ProviderFile{}
+	page := "1"
+	for page != "" {
+		query := url.Values{}
+		query.Set("ref", commitHash)
+		query.Set("path", strings.Trim(args.Path, "/"))
+		query.Set("recursive", fmt.Sprintf("%t", recursive))
+		query.Set("per_page", "100")
+		query.Set("page", page)
+
+		resp, err := g.get(ctx, projectURL+"/repository/tree?"+query.Encode())
+		if err != nil {
+			return nil, errors.Errorf("fetching file list: %w", err)
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return []ProviderFile{}, nil
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+
+		var entries []struct {
+			ID   string `json:"id"`
+			Path string `json:"path"`
+			Type string `json:"type"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&entries)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Errorf("decoding response: %w", err)
+		}
+
+		for _, e := range entries {
+			if e.Type == "blob" {
+				result = append(result, ProviderFile{
+					Path: e.Path,
+					Sha:  e.ID,
+				})
+			}
+		}
+
+		page = resp.Header.Get("X-Next-Page")
+	}
+
+	return result, nil
+}
+
+func (g *GitlabProvider) GetCommitHash(ctx context.Context, args Source) (string, error) {
+	if args.RefType == "commit" {
+		return args.Ref, nil
+	}
+
+	projectURL, err := g.projectURL(args)
+	if err != nil {
+		return "", err
+	}
+
+	// pin the ref for the lifetime of the provider so every file comes from the same commit
+	key := projectURL + "@" + args.Ref
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if hash, ok := g.resolved[key]; ok {
+		return hash, nil
+	}
+
+	var commit struct {
+		ID string `json:"id"`
+	}
+	if _, err := g.getJSON(ctx, projectURL+"/repository/commits/"+url.PathEscape(gitlabRef(args.Ref)), &commit); err != nil {
+		return "", errors.Errorf("getting commit: %w", err)
+	}
+
+	if commit.ID == "" {
+		return "", errors.New("no commit hash found")
+	}
+
+	g.resolved[key] = commit.ID
+	return commit.ID, nil
+}
+
+// GetFile returns the contents of a file through the raw file endpoint, which also works for private projects
+func (g *GitlabProvider) GetFile(ctx context.Context, args Source, file string) ([]byte, error) {
+	projectURL, err := g.projectURL(args)
+	if err != nil {
+		return nil, err
+	}
+
+	commitHash, err := g.GetCommitHash(ctx, args)
+	if err != nil {
+		return nil, errors.Errorf("getting commit hash: %w", err)
+	}
+
+	resp, err := g.get(ctx, fmt.Sprintf("%s/repository/files/%s/raw?ref=%s", projectURL, url.PathEscape(file), url.QueryEscape(commitHash)))
+	if err != nil {
+		return nil, errors.Errorf("downloading file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("downloading file %s: %s", file, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("reading file: %w", err)
+	}
+	return data, nil
+}
+
+// OpenArchive downloads the archive with the gitlab token, GetArchiveUrl alone can't authenticate
+func (g *GitlabProvider) OpenArchive(ctx context.Context, args Source) (io.ReadCloser, error) {
+	archiveURL, err := g.GetArchiveUrl(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := g.get(ctx, archiveURL)
+	if err != nil {
+		return nil, errors.Errorf("downloading archive: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errors.Errorf("invalid tag or reference '%s'", args.Ref)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("downloading archive: %s", resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+func (g *GitlabProvider) GetPermalink(ctx context.Context, args Source, commitHash string, file string) (string, error) {
+	host, project, err := parseGitlabRepo(args.Repo)
+	if err != nil {
+		return "", errors.Errorf("parsing gitlab repository: %w", err)
+	}
+	if file == "" && args.Path == "" {
+		// archive permalink
+		url, err := g.GetArchiveUrl(ctx, args)
+		if err != nil {
+			return "", errors.Errorf("getting archive url: %w", err)
+		}
+		return url, nil
+	}
+	return fmt.Sprintf("%s/%s/-/raw/%s/%s", g.webURL(args, host), project, commitHash, file), nil
+}
+
+func (g *GitlabProvider) GetSourceInfo(ctx context.Context, args Source, commitHash string) (string, error) {
+	host, project, err := parseGitlabRepo(args.Repo)
+	if err != nil {
+		return "", errors.Errorf("parsing gitlab repository: %w", err)
+	}
+	return fmt.Sprintf("%s/%s@%s", host, project, commitHash), nil
+}
+
+// GetArchiveUrl returns the URL to download the repository archive at the resolved commit, archives
+// are cached by commit so a moving ref must not pick what is downloaded
+func (g *GitlabProvider) GetArchiveUrl(ctx context.Context, args Source) (string, error) {
+	projectURL, err := g.projectURL(args)
+	if err != nil {
+		return "", err
+	}
+
+	commitHash, err := g.GetCommitHash(ctx, args)
+	if err != nil {
+		return "", errors.Errorf("getting commit hash: %w", err)
+	}
+
+	return fmt.Sprintf("%s/repository/archive.tar.gz?sha=%s", projectURL, url.QueryEscape(commitHash)), nil
+}
+
+func (g *GitlabProvider) GetLicense(ctx context.Context, args Source, commitHash string) (LicenseEntry, error) {
+	projectURL, err := g.projectURL(args)
+	if err != nil {
+		return LicenseEntry{}, err
+	}
+
+	var data struct {
+		LicenseURL string `json:"license_url"`
+		License    *struct {
+			Key  string `json:"key"`
+			Name string `json:"name"`
+		} `json:"license"`
+	}
+
+	if _, err := g.getJSON(ctx, projectURL+"?license=true", &data); err != nil {
+		return LicenseEntry{}, errors.Errorf("fetching license: %w", err)
+	}
+
+	if data.License == nil {
+		return LicenseEntry{}, nil
+	}
+
+	return LicenseEntry{
+		SPDX:      spdxFromKey(data.License.Key),
+		Name:      data.License.Name,
+		Permalink: data.LicenseURL,
+	}, nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 🧪 fakeGitlab serves the subset of the v4 api the provider uses for group/sub/repo
+func fakeGitlab(t *testing.T, files map[string]string) *httptest.Server {
+	t.Helper()
+
+	const project = "/api/v4/projects/group%2Fsub%2Frepo"
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		path := r.URL.EscapedPath()
+		switch {
+		case path == project && r.URL.Query().Get("license") == "true":
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"license_url": "https://gitlab.example.com/group/sub/repo/-/blob/main/LICENSE",
+				"license":     map[string]string{"key": "apache-2.0", "name": "Apache License 2.0"},
+			})
+		case path == project+"/repository/commits/v1.0.0":
+			_ = json.NewEncoder(w).Encode(map[string]string{"id": commit})
+		case path == project+"/repository/tree":
+			assert.Equal(t, commit, r.URL.Query().Get("ref"))
+			var entries []map[string]string
+			for _, name := range slices.Sorted(maps.Keys(files)) {
+				if strings.HasPrefix(name, r.URL.Query().Get("path")+"/") {
+					entries = append(entries, map[string]string{"id": "sha-" + name, "path": name, "type": "blob"})
+				}
+			}
+			entries = append(entries, map[string]string{"path": r.URL.Query().Get("path") + "/nested", "type": "tree"})
+			// split the listing over two pages to exercise pagination
+			half := len(entries) / 2
+			if r.URL.Query().Get("page") != "2" {
+				w.Header().Set("X-Next-Page", "2")
+				_ = json.NewEncoder(w).Encode(entries[:half])
+			} else {
+				_ = json.NewEncoder(w).Encode(entries[half:])
+			}
+		case strings.HasPrefix(path, project+"/repository/files/") && strings.HasSuffix(path, "/raw"):
+			assert.Equal(t, commit, r.URL.Query().Get("ref"))
+			name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v4/projects/group/sub/repo/repository/files/"), "/raw")
+			content, ok := files[name]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write([]byte(content))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestParseGitlabRepo(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		wantHost    string
+		wantProject string
+		wantErr     bool
+	}{
+		{name: "simple repo", input: "gitlab.com/org/repo", wantHost: "gitlab.com", wantProject: "org/repo"},
+		{name: "nested groups", input: "gitlab.com/group/sub/sub/repo", wantHost: "gitlab.com", wantProject: "group/sub/sub/repo"},
+		{name: "self hosted with ref", input: "gitlab.example.com/group/repo.git@main", wantHost: "gitlab.example.com", wantProject: "group/repo"},
+		{name: "missing project", input: "gitlab.com/org", wantErr: true},
+		{name: "empty segment", input: "gitlab.com//repo", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, project, err := parseGitlabRepo(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantHost, host)
+			assert.Equal(t, tt.wantProject, project)
+		})
+	}
+}
+
+func TestGitlabProvider(t *testing.T) {
+	files := map[string]string{
+		"pkg/main.go":          "package pkg\n",
+		"pkg/nested/helper.go": "package nested\n",
+		"pkg/README.md":        "# readme\n",
+	}
+	server := fakeGitlab(t, files)
+	defer server.Close()
+
+	t.Setenv("GITLAB_TOKEN", "secret")
+
+	provider, err := NewGitlabProvider("", "")
+	require.NoError(t, err)
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	src := Source{
+		Repo:    "gitlab.example.com/group/sub/repo",
+		Ref:     "tags/v1.0.0",
+		Path:    "pkg",
+		BaseURL: server.URL,
+	}
+
+	t.Run("GetCommitHash", func(t *testing.T) {
+		hash, err := provider.GetCommitHash(ctx, src)
+		require.NoError(t, err)
+		assert.Equal(t, "0123456789abcdef0123456789abcdef01234567", hash)
+	})
+
+	t.Run("ListFiles", func(t *testing.T) {
+		got, err := provider.ListFiles(ctx, src, true)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []ProviderFile{
+			{Path: "pkg/main.go", Sha: "sha-pkg/main.go"},
+			{Path: "pkg/nested/helper.go", Sha: "sha-pkg/nested/helper.go"},
+			{Path: "pkg/README.md", Sha: "sha-pkg/README.md"},
+		}, got)
+	})
+
+	t.Run("GetFile", func(t *testing.T) {
+		data, err := provider.GetFile(ctx, src, "pkg/nested/helper.go")
+		require.NoError(t, err)
+		assert.Equal(t, "package nested\n", string(data))
+	})
+
+	t.Run("GetLicense", func(t *testing.T) {
+		license, err := provider.GetLicense(ctx, src, "0123456789abcdef0123456789abcdef01234567")
+		require.NoError(t, err)
+		assert.Equal(t, "Apache-2.0", license.SPDX)
+		assert.Equal(t, "Apache License 2.0", license.Name)
+	})
+
+	t.Run("GetPermalink", func(t *testing.T) {
+		link, err := provider.GetPermalink(ctx, src, "abc123", "pkg/main.go")
+		require.NoError(t, err)
+		assert.Equal(t, server.URL+"/group/sub/repo/-/raw/abc123/pkg/main.go", link)
+
+		link, err = provider.GetArchiveUrl(ctx, src)
+		require.NoError(t, err)
+		assert.Equal(t, server.URL+"/api/v4/projects/group%2Fsub%2Frepo/repository/archive.tar.gz?sha=0123456789abcdef0123456789abcdef01234567", link, "archives are downloaded by the resolved commit")
+	})
+
+	t.Run("missing_token", func(t *testing.T) {
+		t.Setenv("GITLAB_TOKEN", "")
+		_, err := provider.ListFiles(ctx, src, false)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "GITLAB_TOKEN")
+	})
+
+	t.Run("process", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      src,
+			Destination: Destination{Path: t.TempDir()},
+			CopyArgs:    &CopyEntry_Options{Recursive: true, FilePatterns: []string{"**/*.go"}},
+		}
+		require.NoError(t, process(ctx, cfg, provider))
+
+		content, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "nested", "helper.go"))
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "package nested")
+		assert.Contains(t, string(content), "license: Apache-2.0")
+	})
+}
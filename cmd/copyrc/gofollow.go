@@ -0,0 +1,225 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"go/parser"
+	"go/token"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+	"golang.org/x/mod/modfile"
+)
+
+// followImports runs followGoImports for a copy with follow_imports. It returns the files and a
+// copy of cfg.CopyArgs with the computed import rewrites, which are not stored in the lock file.
+func followImports(ctx context.Context, provider RepoProvider, cfg *SingleConfig, commitHash string, files []ProviderFile) ([]ProviderFile, *CopyEntry_Options, error) {
+	files, rewrites, err := followGoImports(ctx, provider, cfg, commitHash, files)
+	if err != nil {
+		return nil, nil, errors.Errorf("following go imports: %w", err)
+	}
+	withRewrites := *cfg.CopyArgs
+	transform := *cfg.CopyArgs.Go
+	transform.ImportRewrites = rewrites
+	withRewrites.Go = &transform
+	return files, &withRewrites, nil
+}
+
+// 🕸️ followGoImports walks the import graph of the Go files being copied and adds every package
+// of the upstream module they import, transitively. The packages are mirrored under the
+// destination like the copied files (relative to the source path when they are below it, to the
+// repository root otherwise). It returns the files and the import rewrites that point the
+// upstream packages at their copies.
+func followGoImports(ctx context.Context, provider RepoProvider, cfg *SingleConfig, commitHash string, files []ProviderFile) ([]ProviderFile, map[string]string, error) {
+	transform := cfg.CopyArgs.Go
+
+	module := transform.Module
+	if module == "" {
+		data, err := fetchRepoFile(ctx, provider, cfg.Source, commitHash, "go.mod")
+		if err != nil {
+			return nil, nil, errors.Errorf("reading the upstream go.mod, set module in the go block to skip it: %w", err)
+		}
+		module = modfile.ModulePath(data)
+		if module == "" {
+			return nil, nil, errors.New("the upstream go.mod has no module path")
+		}
+	}
+
+	importPath := transform.ImportPath
+	if importPath == "" {
+		var err error
+		importPath, err = localImportPath(cfg.Destination.Path)
+		if err != nil {
+			return nil, nil, errors.Errorf("finding the import path of %s, set import_path in the go block: %w", cfg.Destination.Path, err)
+		}
+	}
+
+	files = slices.Clone(files)
+	index := make(map[string]int, len(files))
+	for i, file := range files {
+		index[file.Path] = i
+	}
+
+	// packages are directories of the repository, "" is the module root
+	packages := make(map[string]bool)
+	var queue []ProviderFile
+	for _, file := range files {
+		if matchesFilePatterns(file.Path, cfg.CopyArgs.FilePatterns, cfg.CopyArgs.IgnoreFiles) && path.Ext(file.Path) == ".go" {
+			packages[repoDir(file.Path)] = true
+			queue = append(queue, file)
+		}
+	}
+
+	for len(queue) > 0 {
+		file := queue[0]
+		queue = queue[1:]
+
+		data, err := fetchRepoFile(ctx, provider, cfg.Source, commitHash, file.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		parsed, err := parser.ParseFile(token.NewFileSet(), file.Path, data, parser.ImportsOnly)
+		if err != nil {
+			// not valid Go, nothing to follow
+			continue
+		}
+
+		for _, spec := range parsed.Imports {
+			imp, err := strconv.Unquote(spec.Path.Value)
+			if err != nil || (imp != module && !strings.HasPrefix(imp, module+"/")) {
+				continue
+			}
+			dir := strings.TrimPrefix(strings.TrimPrefix(imp, module), "/")
+			if packages[dir] {
+				continue
+			}
+			packages[dir] = true
+
+			listed, err := provider.ListFiles(ctx, Source{
+				Repo:    cfg.Source.Repo,
+				Ref:     cfg.Source.Ref,
+				RefType: cfg.Source.RefType,
+				BaseURL: cfg.Source.BaseURL,
+				Path:    dir,
+			}, false)
+			if err != nil {
+				return nil, nil, errors.Errorf("listing imported package %s: %w", imp, err)
+			}
+
+			found := false
+			for _, dep := range listed {
+				if repoDir(dep.Path) != dir || path.Ext(dep.Path) != ".go" || strings.HasSuffix(dep.Path, "_test.go") {
+					continue
+				}
+				found = true
+				dep.Imported = true
+				if i, ok := index[dep.Path]; ok {
+					files[i].Imported = true
+				} else {
+					index[dep.Path] = len(files)
+					files = append(files, dep)
+				}
+				queue = append(queue, dep)
+			}
+			if !found {
+				return nil, nil, errors.Errorf("imported package %s has no Go files at %s", imp, commitHash)
+			}
+		}
+	}
+
+	rewrites := make(map[string]string, len(packages))
+	for dir := range packages {
+		upstream := module
+		if dir != "" {
+			upstream = module + "/" + dir
+		}
+
+		mirrored := importPath
+		if rel := mirrorPath(cfg.Source.Path, dir); rel != "" {
+			mirrored = importPath + "/" + rel
+		}
+		rewrites[upstream] = mirrored
+	}
+	// the go block wins over the computed rewrites
+	maps.Copy(rewrites, transform.ImportRewrites)
+
+	return files, rewrites, nil
+}
+
+// mirrorPath is where a repository directory ends up below the destination, like copyOutPath
+func mirrorPath(srcPath string, dir string) string {
+	if dir == srcPath {
+		return ""
+	}
+	return strings.TrimPrefix(dir, srcPath+"/")
+}
+
+// repoDir is the package directory of a repository file, "" for the root
+func repoDir(file string) string {
+	if dir := path.Dir(file); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// fetchRepoFile downloads a file of the repository at commitHash through the download cache
+func fetchRepoFile(ctx context.Context, provider RepoProvider, src Source, commitHash string, file string) ([]byte, error) {
+	return cachedDownload(ctx, src, commitHash, file, func() ([]byte, error) {
+		permalink, err := provider.GetPermalink(ctx, src, commitHash, file)
+		if err != nil {
+			return nil, errors.Errorf("getting permalink: %w", err)
+		}
+		return downloadFile(ctx, provider, src, permalink, file)
+	})
+}
+
+// localImportPath returns the Go import path of dir from the go.mod above it
+func localImportPath(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", errors.Errorf("resolving %s: %w", dir, err)
+	}
+
+	for root := abs; ; root = filepath.Dir(root) {
+		data, err := os.ReadFile(filepath.Join(root, "go.mod"))
+		if err == nil {
+			module := modfile.ModulePath(data)
+			if module == "" {
+				return "", errors.Errorf("%s has no module path", filepath.Join(root, "go.mod"))
+			}
+			rel, err := filepath.Rel(root, abs)
+			if err != nil {
+				return "", errors.Errorf("resolving %s: %w", dir, err)
+			}
+			if rel == "." {
+				return module, nil
+			}
+			return module + "/" + filepath.ToSlash(rel), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", errors.Errorf("reading go.mod: %w", err)
+		}
+		if filepath.Dir(root) == root {
+			return "", errors.Errorf("no go.mod above %s", abs)
+		}
+	}
+}
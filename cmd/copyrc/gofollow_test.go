@@ -0,0 +1,149 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcess_FollowGoImports(t *testing.T) {
+	upstream := filepath.Join(t.TempDir(), "upstream")
+	writeTestFiles(t, upstream, map[string]string{
+		"go.mod":                       "module github.com/up/mod\n\ngo 1.23\n",
+		"pkg/generator/gen.go":         "package generator\n\nimport (\n\t\"fmt\"\n\n\t\"github.com/up/mod/internal/x/text\"\n)\n\nfunc F() { fmt.Println(text.X) }\n",
+		"pkg/generator/gen_test.go":    "package generator\n\nimport \"github.com/up/mod/internal/testutil\"\n\nvar _ = testutil.X\n",
+		"internal/x/text/text.go":      "package text\n\nimport \"github.com/up/mod/internal/y\"\n\nvar X = y.Y\n",
+		"internal/x/text/text_test.go": "package text\n\nimport \"github.com/up/mod/internal/testutil\"\n\nvar _ = testutil.X\n",
+		"internal/x/text/README.md":    "text\n",
+		"internal/y/y.go":              "package y\n\nconst Y = \"y\"\n",
+		"internal/testutil/util.go":    "package testutil\n\nconst X = 1\n",
+		"internal/unrelated/u.go":      "package unrelated\n",
+	})
+
+	local := t.TempDir()
+	writeTestFiles(t, local, map[string]string{
+		"go.mod": "module github.com/me/down\n\ngo 1.23\n",
+	})
+
+	ctx := NewLoggerInContext(context.Background(), NewDiscardDebugLogger(os.Stdout))
+	provider, err := NewLocalProvider()
+	require.NoError(t, err)
+
+	cfg := &SingleConfig{
+		Source:      Source{Repo: upstream, Path: "pkg/generator"},
+		Destination: Destination{Path: filepath.Join(local, "gen", "generator")},
+		CopyArgs: &CopyEntry_Options{
+			IgnoreFiles: []string{"**/*_test.go"},
+			Go:          &GoTransform{FollowImports: true},
+		},
+	}
+	require.NoError(t, process(ctx, cfg, provider))
+
+	read := func(name string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(cfg.Destination.Path, name))
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	assert.Contains(t, read("gen.go"), `"github.com/me/down/gen/generator/internal/x/text"`)
+	assert.Contains(t, read("internal/x/text/text.go"), `import "github.com/me/down/gen/generator/internal/y"`)
+	assert.Contains(t, read("internal/y/y.go"), "package y\n")
+
+	for _, name := range []string{"gen_test.go", "internal/x/text/text_test.go", "internal/x/text/README.md", "internal/testutil/util.go", "internal/unrelated/u.go"} {
+		assert.NoFileExists(t, filepath.Join(cfg.Destination.Path, name))
+	}
+
+	status, err := loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+	require.NoError(t, err)
+	assert.Contains(t, status.CoppiedFiles, "internal/y/y.go")
+
+	t.Run("diff", func(t *testing.T) {
+		copy := &CopyEntry{Source: cfg.Source, Destination: cfg.Destination, Options: cfg.CopyArgs}
+		diff, n, err := diffCopy(ctx, provider, copy)
+		require.NoError(t, err)
+		assert.Zero(t, n, diff)
+
+		gen := filepath.Join(cfg.Destination.Path, "gen.go")
+		edited := strings.Replace(read("gen.go"), "fmt.Println(text.X)", "fmt.Print(text.X)", 1)
+		require.NoError(t, os.WriteFile(gen, []byte(edited), 0644))
+
+		diff, n, err = diffCopy(ctx, provider, copy)
+		require.NoError(t, err, "the base renders with the import rewrites it was written with")
+		assert.Equal(t, 1, n)
+		assert.Contains(t, diff, "-func F() { fmt.Println(text.X) }\n+func F() { fmt.Print(text.X) }\n")
+		assert.NotContains(t, diff, "github.com/up/mod")
+	})
+
+	t.Run("explicit_paths", func(t *testing.T) {
+		explicit := *cfg
+		explicit.Destination = Destination{Path: t.TempDir()}
+		explicit.CopyArgs = &CopyEntry_Options{
+			IgnoreFiles: []string{"**/*_test.go"},
+			Go: &GoTransform{
+				FollowImports:  true,
+				Module:         "github.com/up/mod",
+				ImportPath:     "example.com/vendored",
+				ImportRewrites: map[string]string{"github.com/up/mod/internal/y": "example.com/y"},
+			},
+		}
+		require.NoError(t, process(ctx, &explicit, provider))
+
+		data, err := os.ReadFile(filepath.Join(explicit.Destination.Path, "internal/x/text/text.go"))
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `import "example.com/y"`, "the go block wins")
+
+		data, err = os.ReadFile(filepath.Join(explicit.Destination.Path, "gen.go"))
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"example.com/vendored/internal/x/text"`)
+	})
+
+	t.Run("no_local_module", func(t *testing.T) {
+		orphan := *cfg
+		orphan.Destination = Destination{Path: t.TempDir()}
+		err := process(ctx, &orphan, provider)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "set import_path in the go block")
+	})
+}
+
+func TestMirrorPath(t *testing.T) {
+	assert.Equal(t, "", mirrorPath("pkg/generator", "pkg/generator"))
+	assert.Equal(t, "sub", mirrorPath("pkg/generator", "pkg/generator/sub"))
+	assert.Equal(t, "internal/x", mirrorPath("pkg/generator", "internal/x"))
+	assert.Equal(t, "internal/x", mirrorPath("", "internal/x"))
+}
+
+func TestLocalImportPath(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"go.mod": "module github.com/me/down\n",
+	})
+
+	got, err := localImportPath(root)
+	require.NoError(t, err)
+	assert.Equal(t, "github.com/me/down", got)
+
+	got, err = localImportPath(filepath.Join(root, "a", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "github.com/me/down/a/b", got, "the directory does not have to exist yet")
+}
@@ -0,0 +1,538 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+const goproxyDefault = "https://proxy.golang.org"
+
+// goproxyMaxZipSize is the largest module zip the go command accepts
+const goproxyMaxZipSize = 500 << 20
+
+// errGoproxyNotFound is returned when no proxy in the list knows about a module or version
+var errGoproxyNotFound = errors.Base("not found")
+
+// 🏗️ Go module proxy implementation, speaks the GOPROXY protocol for repos written as go:module/path
+type GoproxyProvider struct {
+	proxies []string
+
+	mu       sync.Mutex
+	resolved map[string]string
+	zips     map[string]goproxyZip
+}
+
+type goproxyZip struct {
+	reader *zip.Reader
+	url    string // the url the zip was served from, used for permalinks
+}
+
+// NewGoproxyProvider creates a module proxy provider. An empty proxy list reads GOPROXY,
+// falling back to proxy.golang.org. Like the go command, entries are separated by commas
+// or pipes, and direct and off are skipped since there is no vcs fallback.
+func NewGoproxyProvider(proxyList string) (*GoproxyProvider, error) {
+	if proxyList == "" {
+		proxyList = os.Getenv("GOPROXY")
+	}
+
+	var proxies []string
+	for _, entry := range strings.FieldsFunc(proxyList, func(r rune) bool { return r == ',' || r == '|' }) {
+		entry = strings.TrimSuffix(strings.TrimSpace(entry), "/")
+		if entry == "" || entry == "direct" || entry == "off" {
+			continue
+		}
+		proxies = append(proxies, entry)
+	}
+	if len(proxies) == 0 {
+		proxies = []string{goproxyDefault}
+	}
+
+	return &GoproxyProvider{
+		proxies:  proxies,
+		resolved: make(map[string]string),
+		zips:     make(map[string]goproxyZip),
+	}, nil
+}
+
+// parseGoModule returns the module path of a repo like go:golang.org/x/mod
+func parseGoModule(repo string) (string, error) {
+	repo = strings.TrimPrefix(repo, "From ")
+	mod, ok := strings.CutPrefix(repo, "go:")
+	if !ok {
+		return "", errors.Errorf("invalid go module repository: %s (expected go:module/path)", repo)
+	}
+	if err := module.CheckPath(mod); err != nil {
+		return "", errors.Errorf("invalid go module path %s: %w", mod, err)
+	}
+	return mod, nil
+}
+
+// fetch reads name (e.g. @v/list) for a module from the first proxy that has it, returning the url it came from
+func (p *GoproxyProvider) fetch(ctx context.Context, mod string, name string) ([]byte, string, error) {
+	rc, url, err := p.open(ctx, mod, name)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, "", errors.Errorf("reading %s: %w", url, err)
+	}
+	return data, url, nil
+}
+
+// open streams name for a module from the first proxy that has it, returning the url it came from
+func (p *GoproxyProvider) open(ctx context.Context, mod string, name string) (io.ReadCloser, string, error) {
+	escaped, err := module.EscapePath(mod)
+	if err != nil {
+		return nil, "", errors.Errorf("escaping module path: %w", err)
+	}
+
+	for _, proxy := range p.proxies {
+		target := proxy + "/" + escaped + "/" + name
+
+		if dir, ok := strings.CutPrefix(target, "file://"); ok {
+			f, err := os.Open(filepath.FromSlash(dir))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, "", errors.Errorf("reading %s: %w", target, err)
+			}
+			return f, target, nil
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			return nil, "", errors.Errorf("creating request: %w", err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, "", errors.Errorf("requesting %s: %w", target, err)
+		}
+
+		// 404 and 410 mean "try the next proxy", as in the go command
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+			resp.Body.Close()
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, "", errors.Errorf("unexpected status code from %s: %d", target, resp.StatusCode)
+		}
+		return resp.Body, target, nil
+	}
+
+	return nil, "", errors.Errorf("%s/%s: %w", mod, name, errGoproxyNotFound)
+}
+
+func (p *GoproxyProvider) info(ctx context.Context, mod string, query string) (string, error) {
+	escaped, err := module.EscapeVersion(query)
+	if err != nil {
+		return "", errors.Errorf("escaping version: %w", err)
+	}
+
+	name := "@v/" + escaped + ".info"
+	if query == "latest" {
+		name = "@latest"
+	}
+
+	data, _, err := p.fetch(ctx, mod, name)
+	if err != nil {
+		return "", err
+	}
+
+	var info struct {
+		Version string `json:"Version"`
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return "", errors.Errorf("decoding version info: %w", err)
+	}
+	if !semver.IsValid(info.Version) {
+		return "", errors.Errorf("proxy returned invalid version %q for %s@%s", info.Version, mod, query)
+	}
+	return info.Version, nil
+}
+
+// goVersionRank orders the kinds of versions a query prefers: releases, then +incompatible releases, then prereleases
+func goVersionRank(v string) int {
+	switch {
+	case semver.Prerelease(v) != "":
+		return 0
+	case semver.Build(v) == "+incompatible":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// queryVersion resolves a version prefix like v1 or v1.2 to the highest matching version in @v/list,
+// preferring the kinds of versions in goVersionRank order
+func (p *GoproxyProvider) queryVersion(ctx context.Context, mod string, query string) (string, error) {
+	data, _, err := p.fetch(ctx, mod, "@v/list")
+	if err != nil {
+		return "", err
+	}
+
+	var best string
+	for _, v := range strings.Fields(string(data)) {
+		if !semver.IsValid(v) {
+			continue
+		}
+		if query != "latest" && v != query && !strings.HasPrefix(v, query+".") {
+			continue
+		}
+		if best == "" || goVersionRank(v) > goVersionRank(best) ||
+			(goVersionRank(v) == goVersionRank(best) && semver.Compare(v, best) > 0) {
+			best = v
+		}
+	}
+
+	if best == "" {
+		return "", errors.Errorf("no version of %s matches %s: %w", mod, query, errGoproxyNotFound)
+	}
+	return best, nil
+}
+
+// GetCommitHash resolves Source.Ref to a module version, which stands in for the commit in the lock file
+func (p *GoproxyProvider) GetCommitHash(ctx context.Context, args Source) (string, error) {
+	mod, err := parseGoModule(args.Repo)
+	if err != nil {
+		return "", err
+	}
+
+	query := args.Ref
+	if query == "" {
+		query = "latest"
+	}
+
+	key := mod + "@" + query
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if version, ok := p.resolved[key]; ok {
+		return version, nil
+	}
+
+	var version string
+	switch {
+	case semver.IsValid(query) && semver.Canonical(query) == query:
+		// full versions are checked against the proxy so typos fail early
+		version, err = p.info(ctx, mod, query)
+	case semver.IsValid(query) || query == "latest":
+		version, err = p.queryVersion(ctx, mod, query)
+		if query == "latest" && errors.Is(err, errGoproxyNotFound) {
+			// modules without tagged versions only have a pseudo-version behind @latest
+			version, err = p.info(ctx, mod, query)
+		}
+	default:
+		// branches and commit hashes, resolved to a pseudo-version by the proxy
+		version, err = p.info(ctx, mod, query)
+	}
+	if err != nil {
+		return "", errors.Errorf("resolving %s@%s: %w", mod, query, err)
+	}
+
+	// make sure the module at that version is the one we asked for
+	escaped, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", errors.Errorf("escaping version: %w", err)
+	}
+	data, _, err := p.fetch(ctx, mod, "@v/"+escaped+".mod")
+	if err != nil {
+		return "", errors.Errorf("fetching go.mod: %w", err)
+	}
+	if declared := modfile.ModulePath(data); declared != "" && declared != mod {
+		return "", errors.Errorf("module %s@%s declares its path as %s", mod, version, declared)
+	}
+
+	p.resolved[key] = version
+	return version, nil
+}
+
+// moduleZip returns the module zip for the resolved version, downloaded once per provider
+func (p *GoproxyProvider) moduleZip(ctx context.Context, args Source) (*zip.Reader, string, string, error) {
+	mod, err := parseGoModule(args.Repo)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	version, err := p.GetCommitHash(ctx, args)
+	if err != nil {
+		return nil, "", "", errors.Errorf("getting module version: %w", err)
+	}
+
+	prefix := mod + "@" + version + "/"
+
+	p.mu.Lock()
+	cached, ok := p.zips[prefix]
+	p.mu.Unlock()
+	if ok {
+		return cached.reader, prefix, version, nil
+	}
+
+	escaped, err := module.EscapeVersion(version)
+	if err != nil {
+		return nil, "", "", errors.Errorf("escaping version: %w", err)
+	}
+
+	rc, url, err := p.open(ctx, mod, "@v/"+escaped+".zip")
+	if err != nil {
+		return nil, "", "", errors.Errorf("downloading module zip: %w", err)
+	}
+	tmp, _, size, err := streamToTemp("", rc, goproxyMaxZipSize)
+	rc.Close()
+	if err != nil {
+		return nil, "", "", errors.Errorf("downloading module zip: %w", err)
+	}
+
+	// the open file keeps the data readable for the rest of the run, unlinking it right away
+	// means nothing is left behind in the temp dir however the process ends
+	f, err := os.Open(tmp)
+	os.Remove(tmp)
+	if err != nil {
+		return nil, "", "", errors.Errorf("opening module zip: %w", err)
+	}
+
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		f.Close()
+		return nil, "", "", errors.Errorf("reading module zip: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cached, ok := p.zips[prefix]; ok {
+		// another entry downloaded the same version meanwhile
+		f.Close()
+		return cached.reader, prefix, version, nil
+	}
+	p.zips[prefix] = goproxyZip{reader: zr, url: url}
+
+	return zr, prefix, version, nil
+}
+
+func (p *GoproxyProvider) ListFiles(ctx context.Context, args Source, recursive bool) ([]ProviderFile, error) {
+	zr, prefix, _, err := p.moduleZip(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := path.Clean("/" + args.Path)[1:]
+
+	result := []ProviderFile{}
+	for _, f := range zr.File {
+		name, ok := strings.CutPrefix(f.Name, prefix)
+		if !ok || strings.HasSuffix(name, "/") {
+			continue
+		}
+		if dir != "" && !strings.HasPrefix(name, dir+"/") {
+			continue
+		}
+		if !recursive && path.Dir(name) != path.Clean("./"+dir) {
+			continue
+		}
+		result = append(result, ProviderFile{
+			Path: name,
+		})
+	}
+	return result, nil
+}
+
+// GetFile returns a file from the module zip
+func (p *GoproxyProvider) GetFile(ctx context.Context, args Source, file string) ([]byte, error) {
+	zr, prefix, version, err := p.moduleZip(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := zr.Open(prefix + file)
+	if err != nil {
+		return nil, errors.Errorf("opening %s at %s: %w", file, version, err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, errors.Errorf("reading %s: %w", file, err)
+	}
+	return data, nil
+}
+
+// OpenArchive repacks the module zip as the tar.gz archive entries expect, streamed as it is
+// written. Module zips name their files module@version/..., the tarball puts them below a single
+// base@version/ directory instead.
+func (p *GoproxyProvider) OpenArchive(ctx context.Context, args Source) (io.ReadCloser, error) {
+	zr, prefix, version, err := p.moduleZip(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	root := repoBaseName(args.Repo) + "@" + version + "/"
+
+	return pipeArchive(func(w io.Writer) error {
+		gw := gzip.NewWriter(w)
+		tw := tar.NewWriter(gw)
+
+		for _, f := range zr.File {
+			name, ok := strings.CutPrefix(f.Name, prefix)
+			if !ok || strings.HasSuffix(name, "/") {
+				continue
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				return errors.Errorf("opening %s: %w", f.Name, err)
+			}
+
+			if err := tw.WriteHeader(&tar.Header{
+				Name:    root + name,
+				Size:    int64(f.UncompressedSize64),
+				Mode:    0644,
+				ModTime: f.Modified,
+			}); err != nil {
+				rc.Close()
+				return errors.Errorf("writing tar header: %w", err)
+			}
+
+			_, err = io.Copy(tw, rc)
+			rc.Close()
+			if err != nil {
+				return errors.Errorf("writing tar content: %w", err)
+			}
+		}
+
+		if err := tw.Close(); err != nil {
+			return errors.Errorf("closing tar writer: %w", err)
+		}
+		if err := gw.Close(); err != nil {
+			return errors.Errorf("closing gzip writer: %w", err)
+		}
+		return nil
+	}), nil
+}
+
+// zipURL returns the url the module zip was downloaded from, or its url on the first configured proxy
+func (p *GoproxyProvider) zipURL(mod string, version string) (string, error) {
+	p.mu.Lock()
+	cached, ok := p.zips[mod+"@"+version+"/"]
+	p.mu.Unlock()
+	if ok {
+		return cached.url, nil
+	}
+
+	escapedPath, err := module.EscapePath(mod)
+	if err != nil {
+		return "", errors.Errorf("escaping module path: %w", err)
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", errors.Errorf("escaping version: %w", err)
+	}
+	return fmt.Sprintf("%s/%s/@v/%s.zip", p.proxies[0], escapedPath, escapedVersion), nil
+}
+
+func (p *GoproxyProvider) GetPermalink(ctx context.Context, args Source, commitHash string, file string) (string, error) {
+	mod, err := parseGoModule(args.Repo)
+	if err != nil {
+		return "", err
+	}
+
+	url, err := p.zipURL(mod, commitHash)
+	if err != nil {
+		return "", err
+	}
+
+	if file == "" {
+		return url, nil
+	}
+	return url + "#" + file, nil
+}
+
+func (p *GoproxyProvider) GetSourceInfo(ctx context.Context, args Source, commitHash string) (string, error) {
+	mod, err := parseGoModule(args.Repo)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s@%s", mod, commitHash), nil
+}
+
+// GetArchiveUrl returns the URL of the module zip, OpenArchive converts it to a tarball
+func (p *GoproxyProvider) GetArchiveUrl(ctx context.Context, args Source) (string, error) {
+	mod, err := parseGoModule(args.Repo)
+	if err != nil {
+		return "", err
+	}
+
+	version, err := p.GetCommitHash(ctx, args)
+	if err != nil {
+		return "", errors.Errorf("getting module version: %w", err)
+	}
+
+	return p.zipURL(mod, version)
+}
+
+// GetLicense detects the license from the license file at the root of the module zip
+func (p *GoproxyProvider) GetLicense(ctx context.Context, args Source, commitHash string) (LicenseEntry, error) {
+	zr, prefix, version, err := p.moduleZip(ctx, args)
+	if err != nil {
+		return LicenseEntry{}, err
+	}
+
+	for _, f := range zr.File {
+		name, ok := strings.CutPrefix(f.Name, prefix)
+		if !ok || strings.Contains(name, "/") || !isLicenseFile(name) {
+			continue
+		}
+
+		data, err := p.GetFile(ctx, args, name)
+		if err != nil {
+			return LicenseEntry{}, errors.Errorf("reading license: %w", err)
+		}
+
+		permalink, err := p.GetPermalink(ctx, args, version, name)
+		if err != nil {
+			return LicenseEntry{}, err
+		}
+
+		spdx, licenseName := detectLicense(data)
+		return LicenseEntry{
+			SPDX:      spdx,
+			Name:      licenseName,
+			Permalink: permalink,
+		}, nil
+	}
+
+	return LicenseEntry{}, nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 🧪 goproxyTestDir writes a file:// GOPROXY serving the given versions of example.com/Tools/sub
+func goproxyTestDir(t *testing.T, versions map[string]map[string]string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	// module paths are case-encoded on the proxy, uppercase letters become !lowercase
+	dir := filepath.Join(root, "example.com", "!tools", "sub", "@v")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+
+	var list []string
+	for version, files := range versions {
+		list = append(list, version)
+
+		require.NoError(t, os.WriteFile(filepath.Join(dir, version+".info"), []byte(`{"Version":"`+version+`","Time":"2025-01-01T00:00:00Z"}`), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, version+".mod"), []byte("module example.com/Tools/sub\n\ngo 1.21\n"), 0644))
+
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, content := range files {
+			w, err := zw.Create("example.com/Tools/sub@" + version + "/" + name)
+			require.NoError(t, err)
+			_, err = w.Write([]byte(content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, zw.Close())
+		require.NoError(t, os.WriteFile(filepath.Join(dir, version+".zip"), buf.Bytes(), 0644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "list"), []byte(strings.Join(list, "\n")+"\n"), 0644))
+
+	return "file://" + root
+}
+
+func TestParseGoModule(t *testing.T) {
+	mod, err := parseGoModule("go:golang.org/x/mod")
+	require.NoError(t, err)
+	assert.Equal(t, "golang.org/x/mod", mod)
+
+	_, err = parseGoModule("golang.org/x/mod")
+	require.Error(t, err)
+
+	_, err = parseGoModule("go:not a module")
+	require.Error(t, err)
+}
+
+func TestGoproxyProvider(t *testing.T) {
+	files := map[string]string{
+		"LICENSE":            testMITLicense,
+		"go.mod":             "module example.com/Tools/sub\n\ngo 1.21\n",
+		"tool.go":            "package sub\n",
+		"internal/x/x.go":    "package x\n",
+		"internal/readme.md": "# internal\n",
+	}
+	proxy := goproxyTestDir(t, map[string]map[string]string{
+		"v1.0.0":              files,
+		"v1.2.0":              files,
+		"v1.2.1":              files,
+		"v1.3.0-rc.1":         files,
+		"v2.0.0+incompatible": files,
+	})
+
+	// GOPROXY lists are tried in order, direct is skipped
+	t.Setenv("GOPROXY", "file:///does/not/exist,"+proxy+"|direct")
+
+	provider, err := NewGoproxyProvider("")
+	require.NoError(t, err)
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	t.Run("GetCommitHash", func(t *testing.T) {
+		tests := []struct {
+			ref  string
+			want string
+		}{
+			{ref: "v1.0.0", want: "v1.0.0"},
+			{ref: "v1.2", want: "v1.2.1"},
+			{ref: "v1", want: "v1.2.1"},
+			{ref: "latest", want: "v1.2.1"},
+			{ref: "", want: "v1.2.1"},
+			{ref: "v1.3.0-rc.1", want: "v1.3.0-rc.1"},
+		}
+		for _, tt := range tests {
+			version, err := provider.GetCommitHash(ctx, Source{Repo: "go:example.com/Tools/sub", Ref: tt.ref})
+			require.NoError(t, err, tt.ref)
+			assert.Equal(t, tt.want, version, tt.ref)
+		}
+
+		_, err := provider.GetCommitHash(ctx, Source{Repo: "go:example.com/Tools/sub", Ref: "v9.9.9"})
+		require.Error(t, err)
+	})
+
+	src := Source{Repo: "go:example.com/Tools/sub", Ref: "v1.2", Path: "internal"}
+
+	t.Run("ListFiles", func(t *testing.T) {
+		got, err := provider.ListFiles(ctx, src, false)
+		require.NoError(t, err)
+		assert.Equal(t, []ProviderFile{{Path: "internal/readme.md"}}, got)
+
+		got, err = provider.ListFiles(ctx, src, true)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []ProviderFile{{Path: "internal/readme.md"}, {Path: "internal/x/x.go"}}, got)
+	})
+
+	t.Run("GetFile", func(t *testing.T) {
+		data, err := provider.GetFile(ctx, src, "internal/x/x.go")
+		require.NoError(t, err)
+		assert.Equal(t, "package x\n", string(data))
+	})
+
+	t.Run("GetLicense", func(t *testing.T) {
+		license, err := provider.GetLicense(ctx, src, "v1.2.1")
+		require.NoError(t, err)
+		assert.Equal(t, "MIT", license.SPDX)
+		assert.Equal(t, proxy+"/example.com/!tools/sub/@v/v1.2.1.zip#LICENSE", license.Permalink)
+	})
+
+	t.Run("OpenArchive", func(t *testing.T) {
+		data, err := GetFileFromTarball(ctx, provider, Source{Repo: "go:example.com/Tools/sub", Ref: "v1.0.0"})
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x1f, 0x8b}, data[0:2], "should be gzipped data")
+
+		entries, err := readArchive(data)
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		assert.Contains(t, names, "sub@v1.0.0/internal/x/x.go", "files are below a single top-level directory")
+	})
+
+	t.Run("extract", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      src,
+			Destination: Destination{Path: t.TempDir()},
+			ArchiveArgs: &ArchiveEntry_Options{Extract: true},
+		}
+		require.NoError(t, process(ctx, cfg, provider))
+
+		content, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "x", "x.go"))
+		require.NoError(t, err)
+		assert.Equal(t, "package x\n", string(content))
+		assert.FileExists(t, filepath.Join(cfg.Destination.Path, "readme.md"))
+		assert.NoFileExists(t, filepath.Join(cfg.Destination.Path, "tool.go"))
+	})
+
+	t.Run("repack", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      Source{Repo: "go:example.com/Tools/sub", Ref: "v1.2"},
+			Destination: Destination{Path: t.TempDir()},
+			ArchiveArgs: &ArchiveEntry_Options{FilePatterns: []string{"**/*.go"}},
+		}
+		require.NoError(t, process(ctx, cfg, provider))
+
+		data, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "sub.tar.gz"))
+		require.NoError(t, err)
+		entries, err := readArchive(data)
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		assert.ElementsMatch(t, []string{"sub@v1.2.1/tool.go", "sub@v1.2.1/internal/x/x.go"}, names)
+	})
+
+	t.Run("process", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      src,
+			Destination: Destination{Path: t.TempDir()},
+			CopyArgs:    &CopyEntry_Options{Recursive: true},
+		}
+		require.NoError(t, process(ctx, cfg, provider))
+
+		content, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "x", "x.go"))
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "package x")
+		assert.Contains(t, string(content), "license: MIT")
+
+		status, err := loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+		require.NoError(t, err)
+		assert.Equal(t, "v1.2.1", status.CommitHash)
+	})
+}
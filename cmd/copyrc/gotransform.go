@@ -0,0 +1,112 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// 🐹 GoTransform rewrites copied .go files through their syntax tree instead of as text
+type GoTransform struct {
+	Package        map[string]string `json:"package,omitempty" yaml:"package,omitempty" hcl:"package,optional" cty:"package"`                                 // 📦 Upstream package name -> new name, _test packages follow their package
+	ImportRewrites map[string]string `json:"import_rewrites,omitempty" yaml:"import_rewrites,omitempty" hcl:"import_rewrites,optional" cty:"import_rewrites"` // 🔀 Import path prefix -> replacement prefix
+	FollowImports  bool              `json:"follow_imports,omitempty" yaml:"follow_imports,omitempty" hcl:"follow_imports,optional" cty:"follow_imports"`     // 🕸️ Also copy the packages of the upstream module the copied files import
+	Module         string            `json:"module,omitempty" yaml:"module,omitempty" hcl:"module,optional" cty:"module"`                                     // Upstream module path, read from the go.mod at the repository root when empty
+	ImportPath     string            `json:"import_path,omitempty" yaml:"import_path,omitempty" hcl:"import_path,optional" cty:"import_path"`                 // Import path of the destination, found from the local go.mod when empty
+}
+
+// rewriteImport returns the path rewritten by the longest matching prefix, a prefix matches the
+// path itself and the packages below it
+func (g *GoTransform) rewriteImport(path string) (string, bool) {
+	best := ""
+	for prefix := range g.ImportRewrites {
+		if (path == prefix || strings.HasPrefix(path, prefix+"/")) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return path, false
+	}
+	return g.ImportRewrites[best] + strings.TrimPrefix(path, best), true
+}
+
+// renamePackage returns the new name of package name. An external test package is renamed with
+// its package unless it has an entry of its own.
+func (g *GoTransform) renamePackage(name string) (string, bool) {
+	if pkg, ok := g.Package[name]; ok {
+		return pkg, true
+	}
+	base, isTest := strings.CutSuffix(name, "_test")
+	if !isTest {
+		return name, false
+	}
+	pkg, ok := g.Package[base]
+	if !ok {
+		return name, false
+	}
+	return pkg + "_test", true
+}
+
+// apply rewrites the package clause and imports of src and formats the result. lineOffset is
+// added to the line numbers of the changes, like for replacements. Files that do not parse are
+// returned as they are, upstream keeps broken Go files around as test fixtures.
+func (g *GoTransform) apply(name string, src []byte, lineOffset int) ([]byte, []string, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+	if err != nil {
+		return src, []string{fmt.Sprintf("Not rewritten, not valid Go: %s", err)}, nil
+	}
+
+	var changes []string
+	line := func(pos token.Pos) int {
+		return fset.Position(pos).Line + lineOffset
+	}
+
+	if pkg, ok := g.renamePackage(file.Name.Name); ok && pkg != file.Name.Name {
+		changes = append(changes, fmt.Sprintf("Line %d: Rewrote package '%s' to '%s'", line(file.Name.Pos()), file.Name.Name, pkg))
+		file.Name.Name = pkg
+	}
+
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			return nil, nil, errors.Errorf("reading import %s: %w", spec.Path.Value, err)
+		}
+		rewritten, ok := g.rewriteImport(path)
+		if !ok || rewritten == path {
+			continue
+		}
+		// the name, if any, is left alone so the code keeps referring to the same identifier
+		spec.Path.Value = strconv.Quote(rewritten)
+		changes = append(changes, fmt.Sprintf("Line %d: Rewrote import '%s' to '%s'", line(spec.Path.Pos()), path, rewritten))
+	}
+
+	ast.SortImports(fset, file)
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		return nil, nil, errors.Errorf("formatting %s: %w", name, err)
+	}
+	return buf.Bytes(), changes, nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoTransform(t *testing.T) {
+	transform := &GoTransform{
+		Package: map[string]string{"generator": "reformat"},
+		ImportRewrites: map[string]string{
+			"github.com/atombender/go-jsonschema":                 "github.com/walteh/schema2go/pkg/reformat",
+			"github.com/atombender/go-jsonschema/internal/x/text": "github.com/walteh/schema2go/pkg/text",
+		},
+	}
+
+	tests := []struct {
+		name    string
+		src     string
+		want    string
+		changes []string
+	}{
+		{
+			name: "package_and_imports",
+			src: `// Package generator generates code.
+package generator
+
+import (
+	"fmt"
+
+	"github.com/atombender/go-jsonschema/pkg/codegen"
+	jtext "github.com/atombender/go-jsonschema/internal/x/text"
+	"github.com/atombender/go-jsonschema-extra/other"
+)
+
+func F() { fmt.Println(codegen.X, jtext.Y, other.Z) }
+`,
+			want: `// Package generator generates code.
+package reformat
+
+import (
+	"fmt"
+
+	"github.com/atombender/go-jsonschema-extra/other"
+	"github.com/walteh/schema2go/pkg/reformat/pkg/codegen"
+	jtext "github.com/walteh/schema2go/pkg/text"
+)
+
+func F() { fmt.Println(codegen.X, jtext.Y, other.Z) }
+`,
+			changes: []string{
+				"Line 2: Rewrote package 'generator' to 'reformat'",
+				"Line 7: Rewrote import 'github.com/atombender/go-jsonschema/pkg/codegen' to 'github.com/walteh/schema2go/pkg/reformat/pkg/codegen'",
+				"Line 8: Rewrote import 'github.com/atombender/go-jsonschema/internal/x/text' to 'github.com/walteh/schema2go/pkg/text'",
+			},
+		},
+		{
+			name: "test_package",
+			src:  "package generator_test\n\nimport \"github.com/atombender/go-jsonschema\"\n\nvar _ = gojsonschema.X\n",
+			want: "package reformat_test\n\nimport \"github.com/walteh/schema2go/pkg/reformat\"\n\nvar _ = gojsonschema.X\n",
+			changes: []string{
+				"Line 1: Rewrote package 'generator_test' to 'reformat_test'",
+				"Line 3: Rewrote import 'github.com/atombender/go-jsonschema' to 'github.com/walteh/schema2go/pkg/reformat'",
+			},
+		},
+		{
+			name: "other_package",
+			src:  "package schema\n\nimport \"github.com/atombender/go-jsonschema/other\"\n\nvar _ = other.X\n",
+			want: "package schema\n\nimport \"github.com/walteh/schema2go/pkg/reformat/other\"\n\nvar _ = other.X\n",
+			changes: []string{
+				"Line 3: Rewrote import 'github.com/atombender/go-jsonschema/other' to 'github.com/walteh/schema2go/pkg/reformat/other'",
+			},
+		},
+		{
+			name: "gofmt",
+			src:  "package reformat\nfunc  F( ) {\n}\n",
+			want: "package reformat\n\nfunc F() {\n}\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changes, err := transform.apply("x.go", []byte(tt.src), 0)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+			assert.Equal(t, tt.changes, changes)
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		src := "package generator\n\nfunc {\n"
+		got, changes, err := transform.apply("x.go", []byte(src), 0)
+		require.NoError(t, err)
+		assert.Equal(t, src, string(got))
+		require.Len(t, changes, 1)
+		assert.Contains(t, changes[0], "not valid Go")
+	})
+}
+
+func TestProcess_GoTransform(t *testing.T) {
+	ctx := NewLoggerInContext(context.Background(), NewDiscardDebugLogger(os.Stdout))
+
+	mock := NewMockProvider(t)
+	mock.AddFile("gen.go", []byte("package generator\n\nimport \"github.com/org/up/internal/x/text\"\n\nvar _ = text.X\n"))
+	mock.AddFile("data.json", []byte("{\"package\": \"generator\"}\n"))
+
+	cfg := &SingleConfig{
+		Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+		Destination: Destination{Path: t.TempDir()},
+		CopyArgs: &CopyEntry_Options{Go: &GoTransform{
+			Package:        map[string]string{"generator": "reformat"},
+			ImportRewrites: map[string]string{"github.com/org/up": "github.com/me/down"},
+		}},
+	}
+	require.NoError(t, process(ctx, cfg, mock))
+
+	content, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "gen.go"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "// 📦 originally copied by copyrc")
+	assert.Contains(t, string(content), "package reformat\n")
+	assert.Contains(t, string(content), `import "github.com/me/down/internal/x/text"`)
+
+	other, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "data.json"))
+	require.NoError(t, err)
+	assert.Equal(t, "{\"package\": \"generator\"}\n", string(other), "only .go files are rewritten")
+
+	status, err := loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"Line 6: Rewrote package 'generator' to 'reformat'",
+		"Line 8: Rewrote import 'github.com/org/up/internal/x/text' to 'github.com/me/down/internal/x/text'",
+	}, status.CoppiedFiles["gen.go"].Changes)
+
+	t.Run("changed_transform", func(t *testing.T) {
+		cfg.CopyArgs.Go.Package = map[string]string{"generator": "other"}
+		require.NoError(t, process(ctx, cfg, mock))
+
+		content, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "gen.go"))
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "package other\n")
+	})
+}
+
+func TestLoadConfig_GoTransform(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".copyrc.hcl")
+	require.NoError(t, os.WriteFile(path, []byte(`
+copy {
+	source {
+		repo = "github.com/omissis/go-jsonschema"
+		ref  = "main"
+	}
+	destination {
+		path = "pkg/reformat"
+	}
+	options {
+		go {
+			package = { generator = "reformat" }
+			import_rewrites = {
+				"github.com/atombender/go-jsonschema" = "github.com/walteh/schema2go/pkg/reformat"
+			}
+		}
+	}
+}
+`), 0644))
+
+	cfg, err := LoadConfig(path, Input{})
+	require.NoError(t, err)
+	require.Len(t, cfg.Copies, 1)
+	assert.Equal(t, &GoTransform{
+		Package:        map[string]string{"generator": "reformat"},
+		ImportRewrites: map[string]string{"github.com/atombender/go-jsonschema": "github.com/walteh/schema2go/pkg/reformat"},
+	}, cfg.Copies[0].Options.Go)
+}
@@ -0,0 +1,151 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// defaultJobs bounds concurrent downloads when -jobs is not set
+const defaultJobs = 8
+
+// jobs returns the number of concurrent downloads and entries allowed
+func (f FlagsBlock) jobs() int {
+	if f.Jobs > 0 {
+		return f.Jobs
+	}
+	return defaultJobs
+}
+
+// 🚦 jobLimiter bounds the downloads in flight across every entry of a run
+type jobLimiter chan struct{}
+
+type jobLimiterContextKey struct{}
+
+// withJobLimit puts a limiter of n slots in ctx, unless it already has one
+func withJobLimit(ctx context.Context, n int) context.Context {
+	if _, ok := ctx.Value(jobLimiterContextKey{}).(jobLimiter); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, jobLimiterContextKey{}, make(jobLimiter, max(n, 1)))
+}
+
+// acquireJob waits for a download slot, the returned func gives it back
+func acquireJob(ctx context.Context) (func(), error) {
+	limiter, ok := ctx.Value(jobLimiterContextKey{}).(jobLimiter)
+	if !ok {
+		return func() {}, nil
+	}
+	select {
+	case limiter <- struct{}{}:
+		return func() { <-limiter }, nil
+	case <-ctx.Done():
+		return nil, errors.Errorf("waiting for a download slot: %w", ctx.Err())
+	}
+}
+
+// runEntry is one copy, archive or url entry of a config
+type runEntry struct {
+	index int
+	dest  string
+	run   func(ctx context.Context) error
+}
+
+// destinationsOverlap reports whether a and b are the same directory or one contains the other
+func destinationsOverlap(a, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	if a == b || a == "." || b == "." {
+		return true
+	}
+	sep := string(filepath.Separator)
+	return strings.HasPrefix(a, b+sep) || strings.HasPrefix(b, a+sep)
+}
+
+// groupByDestination puts entries whose destinations overlap in one group, in config order.
+// Groups share no files so they can run at the same time.
+func groupByDestination(entries []runEntry) [][]runEntry {
+	var groups [][]runEntry
+	for _, entry := range entries {
+		merged := []runEntry{entry}
+		kept := groups[:0]
+		for _, group := range groups {
+			overlaps := slices.ContainsFunc(group, func(e runEntry) bool {
+				return destinationsOverlap(e.dest, entry.dest)
+			})
+			if overlaps {
+				merged = append(merged, group...)
+			} else {
+				kept = append(kept, group)
+			}
+		}
+		slices.SortFunc(merged, func(a, b runEntry) int {
+			return a.index - b.index
+		})
+		groups = append(kept, merged)
+	}
+	slices.SortFunc(groups, func(a, b []runEntry) int {
+		return a[0].index - b[0].index
+	})
+	return groups
+}
+
+// runEntries runs the groups of entries with at most jobs of them at a time. Entries of a group
+// run one after another and stop at the first error, other groups carry on. Console output is
+// buffered per group so it comes out in one piece.
+func runEntries(ctx context.Context, jobs int, entries []runEntry) error {
+	groups := groupByDestination(entries)
+	if jobs <= 1 || len(groups) <= 1 {
+		for _, entry := range entries {
+			if err := entry.run(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	logger := loggerFromContext(ctx)
+	sem := make(chan struct{}, jobs)
+	errs := make([]error, len(groups))
+
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			buffered := logger.buffered()
+			defer logger.flush(buffered)
+
+			groupCtx := NewLoggerInContext(ctx, buffered)
+			for _, entry := range group {
+				if err := entry.run(groupCtx); err != nil {
+					errs[i] = err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,154 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+)
+
+func TestGroupByDestination(t *testing.T) {
+	entries := []runEntry{
+		{index: 0, dest: "gen/a"},
+		{index: 1, dest: "gen/b"},
+		{index: 2, dest: "gen/a/nested"},
+		{index: 3, dest: "./gen/b/"},
+		{index: 4, dest: "gen/ab"},
+		{index: 5, dest: "gen"},
+	}
+
+	indexes := func(groups [][]runEntry) [][]int {
+		var out [][]int
+		for _, group := range groups {
+			var idx []int
+			for _, e := range group {
+				idx = append(idx, e.index)
+			}
+			out = append(out, idx)
+		}
+		return out
+	}
+
+	assert.Equal(t, [][]int{{0, 2}, {1, 3}, {4}}, indexes(groupByDestination(entries[:5])))
+	assert.Equal(t, [][]int{{0, 1, 2, 3, 4, 5}}, indexes(groupByDestination(entries)), "a parent destination joins every group below it")
+}
+
+func TestProcess_BoundedJobs(t *testing.T) {
+	ctx := NewLoggerInContext(context.Background(), NewDiscardDebugLogger(os.Stdout))
+
+	mock := NewMockProvider(t)
+	mock.latency = 20 * time.Millisecond
+	for i := range 12 {
+		mock.AddFile(fmt.Sprintf("f%02d.go", i), []byte(fmt.Sprintf("package f%d\n", i)))
+	}
+
+	require.NoError(t, process(ctx, &SingleConfig{
+		Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+		Destination: Destination{Path: t.TempDir()},
+		CopyArgs:    &CopyEntry_Options{},
+		Flags:       FlagsBlock{Async: true, Jobs: 3},
+	}, mock))
+
+	assert.Len(t, mock.fetched, 12)
+	assert.LessOrEqual(t, mock.maxInFlight, 3)
+	assert.Greater(t, mock.maxInFlight, 1, "files are downloaded concurrently")
+}
+
+func TestRunAll_Parallel(t *testing.T) {
+	logger := newTestLogger(t)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	mock := NewMockProvider(t)
+	mock.latency = 20 * time.Millisecond
+	mock.AddFile("a.go", []byte("package a\n"))
+	mock.AddFile("b.go", []byte("package b\n"))
+
+	dir := t.TempDir()
+	cfg := &CopyConfig{Flags: &FlagsBlock{Jobs: 4}}
+	for _, name := range []string{"one", "two", "three", "four"} {
+		cfg.Copies = append(cfg.Copies, &CopyEntry{
+			Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+			Destination: Destination{Path: filepath.Join(dir, name)},
+			Options:     &CopyEntry_Options{},
+		})
+	}
+
+	require.NoError(t, cfg.RunAll(ctx, mock))
+	assert.Greater(t, mock.maxInFlight, 1, "entries with different destinations run at the same time")
+
+	for _, copy := range cfg.Copies {
+		assert.FileExists(t, filepath.Join(copy.Destination.Path, "a.go"))
+	}
+
+	// every destination prints as one block: its header followed by its own files only
+	output := logger.CopyOfCurrentConsoleOutputInTest()
+	blocks := strings.Split(output, "[syncing ")[1:]
+	require.Len(t, blocks, 4)
+	for _, block := range blocks {
+		assert.Equal(t, 1, strings.Count(block, "a.go"), block)
+		assert.Equal(t, 1, strings.Count(block, "b.go"), block)
+		assert.Equal(t, 1, strings.Count(block, ".copyrc.lock"), block)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		broken := &CopyConfig{Flags: &FlagsBlock{Jobs: 4, Force: true}}
+		broken.Copies = append(broken.Copies, cfg.Copies...)
+		broken.Copies = append(broken.Copies, &CopyEntry{
+			Source:      Source{Repo: "github.com/test/broken", Ref: "main"},
+			Destination: Destination{Path: filepath.Join(dir, "broken")},
+			Options:     &CopyEntry_Options{},
+		})
+		for _, copy := range cfg.Copies {
+			require.NoError(t, os.Remove(filepath.Join(copy.Destination.Path, "a.go")))
+		}
+
+		err := broken.RunAll(ctx, brokenResolver{mock})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "running copy "+filepath.Join(dir, "broken"))
+
+		for _, copy := range cfg.Copies {
+			assert.FileExists(t, filepath.Join(copy.Destination.Path, "a.go"), "other destinations still finish")
+		}
+	})
+}
+
+// brokenResolver serves github.com/test/broken with a provider that cannot resolve a commit
+type brokenResolver struct {
+	*MockProvider
+}
+
+func (r brokenResolver) ProviderFor(src Source) (RepoProvider, error) {
+	if src.Repo == "github.com/test/broken" {
+		return brokenProvider{r.MockProvider}, nil
+	}
+	return r.MockProvider, nil
+}
+
+type brokenProvider struct {
+	*MockProvider
+}
+
+func (brokenProvider) GetCommitHash(ctx context.Context, args Source) (string, error) {
+	return "", errors.New("unreachable")
+}
@@ -0,0 +1,84 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// 📝 knownLicenses maps a distinctive phrase of a license text to its SPDX id and name.
+// Order matters, more specific licenses must come before the ones they contain.
+var knownLicenses = []struct {
+	markers []string
+	spdx    string
+	name    string
+}{
+	{[]string{"gnu affero general public license", "version 3"}, "AGPL-3.0", "GNU Affero General Public License v3.0"},
+	{[]string{"gnu lesser general public license", "version 3"}, "LGPL-3.0", "GNU Lesser General Public License v3.0"},
+	{[]string{"gnu lesser general public license", "version 2.1"}, "LGPL-2.1", "GNU Lesser General Public License v2.1"},
+	{[]string{"gnu general public license", "version 3"}, "GPL-3.0", "GNU General Public License v3.0"},
+	{[]string{"gnu general public license", "version 2"}, "GPL-2.0", "GNU General Public License v2.0"},
+	{[]string{"apache license", "version 2.0"}, "Apache-2.0", "Apache License 2.0"},
+	{[]string{"mozilla public license", "2.0"}, "MPL-2.0", "Mozilla Public License 2.0"},
+	{[]string{"permission is hereby granted, free of charge"}, "MIT", "MIT License"},
+	{[]string{"permission to use, copy, modify, and/or distribute this software for any purpose"}, "ISC", "ISC License"},
+	{[]string{"redistribution and use in source and binary forms", "neither the name"}, "BSD-3-Clause", "BSD 3-Clause \"New\" or \"Revised\" License"},
+	{[]string{"redistribution and use in source and binary forms"}, "BSD-2-Clause", "BSD 2-Clause \"Simplified\" License"},
+	{[]string{"this is free and unencumbered software released into the public domain"}, "Unlicense", "The Unlicense"},
+}
+
+// isLicenseFile reports whether name looks like a top level license file
+func isLicenseFile(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, prefix := range []string{"LICENSE", "LICENCE", "COPYING"} {
+		if upper == prefix || strings.HasPrefix(upper, prefix+".") || strings.HasPrefix(upper, prefix+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// detectLicense guesses the SPDX id of a license text, for providers that don't expose one
+func detectLicense(data []byte) (spdx string, name string) {
+	text := strings.Join(strings.Fields(string(bytes.ToLower(data))), " ")
+	for _, l := range knownLicenses {
+		matched := true
+		for _, m := range l.markers {
+			if !strings.Contains(text, m) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return l.spdx, l.name
+		}
+	}
+	// same values the github api reports for licenses it can't identify
+	return "NOASSERTION", "Other"
+}
+
+// spdxFromKey maps a lowercase license key, as reported by gitlab or npm, to its SPDX id
+func spdxFromKey(key string) string {
+	for _, l := range knownLicenses {
+		if strings.EqualFold(l.spdx, key) {
+			return l.spdx
+		}
+	}
+	if key == "" {
+		return "NOASSERTION"
+	}
+	return key
+}
@@ -0,0 +1,51 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectLicense(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		wantSPDX string
+	}{
+		{name: "mit", content: testMITLicense, wantSPDX: "MIT"},
+		{name: "apache", content: "                                 Apache License\n                           Version 2.0, January 2004", wantSPDX: "Apache-2.0"},
+		{name: "lgpl_before_gpl", content: "GNU LESSER GENERAL PUBLIC LICENSE\nVersion 3, 29 June 2007\n... GNU General Public License ...", wantSPDX: "LGPL-3.0"},
+		{name: "bsd3", content: "Redistribution and use in source and binary forms ... Neither the name of Google Inc.", wantSPDX: "BSD-3-Clause"},
+		{name: "unknown", content: "all rights reserved", wantSPDX: "NOASSERTION"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spdx, _ := detectLicense([]byte(tt.content))
+			assert.Equal(t, tt.wantSPDX, spdx)
+		})
+	}
+}
+
+func TestIsLicenseFile(t *testing.T) {
+	for _, name := range []string{"LICENSE", "LICENSE.md", "license.txt", "COPYING", "LICENCE-MIT"} {
+		assert.True(t, isLicenseFile(name), name)
+	}
+	for _, name := range []string{"README.md", "licenses.go", "NOTICE"} {
+		assert.False(t, isLicenseFile(name), name)
+	}
+}
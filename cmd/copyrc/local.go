@@ -0,0 +1,363 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// 🏗️ Local directory implementation, copies from a sibling checkout including uncommitted changes
+type LocalProvider struct {
+	mu       sync.Mutex
+	resolved map[string]string
+}
+
+func NewLocalProvider() (*LocalProvider, error) {
+	return &LocalProvider{
+		resolved: make(map[string]string),
+	}, nil
+}
+
+// isLocalPath reports whether repo is a plain filesystem path rather than a remote
+func isLocalPath(repo string) bool {
+	repo = strings.TrimPrefix(repo, "From ")
+	return repo == "." || repo == ".." ||
+		strings.HasPrefix(repo, "/") || strings.HasPrefix(repo, "./") || strings.HasPrefix(repo, "../")
+}
+
+// isBareGitRepo reports whether dir is a bare repository, which the git provider serves instead
+func isBareGitRepo(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return false
+	}
+	head, err := os.Stat(filepath.Join(dir, "HEAD"))
+	if err != nil || head.IsDir() {
+		return false
+	}
+	objects, err := os.Stat(filepath.Join(dir, "objects"))
+	return err == nil && objects.IsDir()
+}
+
+// localRepoRef returns repo as written in the config, relative paths stay relative so lock files
+// and headers don't record where one machine keeps its checkouts
+func localRepoRef(repo string) string {
+	repo = strings.TrimPrefix(repo, "From ")
+	repo = strings.TrimPrefix(repo, "file://")
+	if repo != "/" {
+		repo = strings.TrimSuffix(filepath.ToSlash(repo), "/")
+	}
+	return repo
+}
+
+// parseLocalRepo returns the absolute directory of a repo written as file:///path or a plain path
+func parseLocalRepo(repo string) (string, error) {
+	repo = strings.TrimPrefix(repo, "From ")
+	dir := strings.TrimPrefix(repo, "file://")
+	if dir == "" {
+		return "", errors.Errorf("invalid local repository: %s (expected file:///path or a path)", repo)
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", errors.Errorf("resolving %s: %w", dir, err)
+	}
+
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", errors.Errorf("reading local repository: %w", err)
+	}
+	if !info.IsDir() {
+		return "", errors.Errorf("local repository %s is not a directory", abs)
+	}
+	return abs, nil
+}
+
+// walk returns every file under root, relative to root and slash separated. Inside a git
+// working tree ignored files are skipped, untracked ones are kept since they may not be committed yet.
+func (l *LocalProvider) walk(ctx context.Context, root string) ([]string, error) {
+	if out, err := runGit(ctx, root, "ls-files", "-z", "--cached", "--others", "--exclude-standard"); err == nil {
+		var files []string
+		for _, file := range strings.Split(string(out), "\x00") {
+			if file == "" {
+				continue
+			}
+			// deleted but not yet staged files are still listed by --cached
+			if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(file))); err != nil {
+				continue
+			}
+			files = append(files, file)
+		}
+		slices.Sort(files)
+		return files, nil
+	}
+
+	var files []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Errorf("walking %s: %w", root, err)
+	}
+	return files, nil
+}
+
+func (l *LocalProvider) ListFiles(ctx context.Context, args Source, recursive bool) ([]ProviderFile, error) {
+	root, err := parseLocalRepo(args.Repo)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := l.walk(ctx, root)
+	if err != nil {
+		return nil, errors.Errorf("listing files: %w", err)
+	}
+
+	dir := path.Clean("/" + args.Path)[1:]
+
+	result := []ProviderFile{}
+	for _, file := range files {
+		if dir != "" && !strings.HasPrefix(file, dir+"/") {
+			continue
+		}
+		if !recursive && path.Dir(file) != path.Clean("./"+dir) {
+			continue
+		}
+		result = append(result, ProviderFile{
+			Path: file,
+		})
+	}
+	return result, nil
+}
+
+// contentDigest hashes the names and contents of files so uncommitted changes get their own hash
+func contentDigest(root string, files []string) (string, error) {
+	h := sha256.New()
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(file)))
+		if err != nil {
+			return "", errors.Errorf("reading %s: %w", file, err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", file, len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12], nil
+}
+
+// GetCommitHash returns HEAD of the working tree, with a digest of the contents under args.Path
+// appended when they have uncommitted changes. Outside of git the digest alone is used.
+func (l *LocalProvider) GetCommitHash(ctx context.Context, args Source) (string, error) {
+	root, err := parseLocalRepo(args.Repo)
+	if err != nil {
+		return "", err
+	}
+	dir := path.Clean("/" + args.Path)[1:]
+
+	// pin the hash for the lifetime of the provider so every file of a run reports the same one
+	key := root + "\x00" + dir
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if hash, ok := l.resolved[key]; ok {
+		return hash, nil
+	}
+
+	// changes outside of the copied directory don't change what is copied
+	all, err := l.walk(ctx, root)
+	if err != nil {
+		return "", errors.Errorf("listing files: %w", err)
+	}
+	files := all[:0:0]
+	for _, file := range all {
+		if dir == "" || strings.HasPrefix(file, dir+"/") {
+			files = append(files, file)
+		}
+	}
+
+	pathspec := "."
+	if dir != "" {
+		pathspec = dir
+	}
+
+	var hash string
+	if out, err := runGit(ctx, root, "rev-parse", "HEAD"); err == nil {
+		hash = strings.TrimSpace(string(out))
+
+		status, err := runGit(ctx, root, "status", "--porcelain", "--", pathspec)
+		if err != nil {
+			return "", errors.Errorf("checking working tree: %w", err)
+		}
+		if len(bytes.TrimSpace(status)) > 0 {
+			digest, err := contentDigest(root, files)
+			if err != nil {
+				return "", err
+			}
+			hash += "-dirty-" + digest
+		}
+	} else {
+		digest, err := contentDigest(root, files)
+		if err != nil {
+			return "", err
+		}
+		hash = "local-" + digest
+	}
+
+	l.resolved[key] = hash
+	return hash, nil
+}
+
+// GetPermalink returns a file:// url with the repo as written, processCopy reads those straight
+// from disk relative to the working directory like the repo itself
+func (l *LocalProvider) GetPermalink(ctx context.Context, args Source, commitHash string, file string) (string, error) {
+	if _, err := parseLocalRepo(args.Repo); err != nil {
+		return "", err
+	}
+	return "file://" + localRepoRef(args.Repo) + "/" + file, nil
+}
+
+func (l *LocalProvider) GetSourceInfo(ctx context.Context, args Source, commitHash string) (string, error) {
+	if _, err := parseLocalRepo(args.Repo); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s@%s", localRepoRef(args.Repo), commitHash), nil
+}
+
+func (l *LocalProvider) GetArchiveUrl(ctx context.Context, args Source) (string, error) {
+	if _, err := parseLocalRepo(args.Repo); err != nil {
+		return "", err
+	}
+	return "file://" + localRepoRef(args.Repo), nil
+}
+
+// OpenArchive packs the directory as a tar.gz, streamed as it is written. The archive url points at a directory.
+func (l *LocalProvider) OpenArchive(ctx context.Context, args Source) (io.ReadCloser, error) {
+	root, err := parseLocalRepo(args.Repo)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := l.walk(ctx, root)
+	if err != nil {
+		return nil, errors.Errorf("listing files: %w", err)
+	}
+
+	prefix := filepath.Base(root) + "/"
+	return pipeArchive(func(w io.Writer) error {
+		gw := gzip.NewWriter(w)
+		tw := tar.NewWriter(gw)
+
+		for _, file := range files {
+			if err := addLocalFile(tw, filepath.Join(root, filepath.FromSlash(file)), prefix+file); err != nil {
+				return errors.Errorf("reading %s: %w", file, err)
+			}
+		}
+
+		if err := tw.Close(); err != nil {
+			return errors.Errorf("closing tar writer: %w", err)
+		}
+		if err := gw.Close(); err != nil {
+			return errors.Errorf("closing gzip writer: %w", err)
+		}
+		return nil
+	}), nil
+}
+
+// addLocalFile copies the file at full into tw as name
+func addLocalFile(tw *tar.Writer, full string, name string) error {
+	f, err := os.Open(full)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Size:    info.Size(),
+		Mode:    int64(info.Mode().Perm()),
+		ModTime: info.ModTime(),
+	}); err != nil {
+		return errors.Errorf("writing tar header: %w", err)
+	}
+	if _, err := io.CopyN(tw, f, info.Size()); err != nil {
+		return errors.Errorf("writing tar content: %w", err)
+	}
+	return nil
+}
+
+// GetLicense detects the license from a license file at the root of the directory
+func (l *LocalProvider) GetLicense(ctx context.Context, args Source, commitHash string) (LicenseEntry, error) {
+	root, err := parseLocalRepo(args.Repo)
+	if err != nil {
+		return LicenseEntry{}, err
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return LicenseEntry{}, errors.Errorf("reading %s: %w", root, err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !isLicenseFile(entry.Name()) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(root, entry.Name()))
+		if err != nil {
+			return LicenseEntry{}, errors.Errorf("reading license: %w", err)
+		}
+
+		spdx, name := detectLicense(data)
+		return LicenseEntry{
+			SPDX:      spdx,
+			Name:      name,
+			Permalink: "file://" + localRepoRef(args.Repo) + "/" + entry.Name(),
+		}, nil
+	}
+
+	return LicenseEntry{}, nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(content), 0644))
+	}
+}
+
+func TestLocalProvider_Directory(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"LICENSE":          testMITLicense,
+		"pkg/main.go":      "package pkg\n",
+		"pkg/sub/sub.go":   "package sub\n",
+		"other/ignored.go": "package other\n",
+	})
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	src := Source{Repo: "file://" + root, Path: "pkg"}
+
+	provider, err := NewLocalProvider()
+	require.NoError(t, err)
+
+	t.Run("GetCommitHash", func(t *testing.T) {
+		hash, err := provider.GetCommitHash(ctx, src)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(hash, "local-"), hash)
+
+		// the digest follows the contents
+		writeTestFiles(t, root, map[string]string{"pkg/main.go": "package pkg // changed\n"})
+		fresh, err := NewLocalProvider()
+		require.NoError(t, err)
+		changed, err := fresh.GetCommitHash(ctx, src)
+		require.NoError(t, err)
+		assert.NotEqual(t, hash, changed)
+	})
+
+	t.Run("ListFiles", func(t *testing.T) {
+		files, err := provider.ListFiles(ctx, src, false)
+		require.NoError(t, err)
+		assert.Equal(t, []ProviderFile{{Path: "pkg/main.go"}}, files)
+
+		files, err = provider.ListFiles(ctx, src, true)
+		require.NoError(t, err)
+		assert.Equal(t, []ProviderFile{{Path: "pkg/main.go"}, {Path: "pkg/sub/sub.go"}}, files)
+	})
+
+	t.Run("GetLicense", func(t *testing.T) {
+		license, err := provider.GetLicense(ctx, src, "")
+		require.NoError(t, err)
+		assert.Equal(t, "MIT", license.SPDX)
+	})
+
+	t.Run("OpenArchive", func(t *testing.T) {
+		data, err := GetFileFromTarball(ctx, provider, Source{Repo: root})
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x1f, 0x8b}, data[0:2], "should be gzipped data")
+	})
+
+	t.Run("process", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      src,
+			Destination: Destination{Path: t.TempDir()},
+			CopyArgs:    &CopyEntry_Options{Recursive: true},
+		}
+		require.NoError(t, process(ctx, cfg, provider))
+
+		content, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "sub", "sub.go"))
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "package sub")
+		assert.Contains(t, string(content), "source: file://"+filepath.Join(root, "pkg", "sub", "sub.go"))
+	})
+}
+
+func TestLocalProvider_GitWorkingTree(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	root := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", root}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "git %v: %s", args, out)
+		return strings.TrimSpace(string(out))
+	}
+
+	git("init", "-q", "-b", "main")
+	writeTestFiles(t, root, map[string]string{
+		".gitignore":  "*.tmp\n",
+		"pkg/main.go": "package pkg\n",
+	})
+	git("add", "-A")
+	git("commit", "-q", "-m", "initial")
+	head := git("rev-parse", "HEAD")
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	src := Source{Repo: root, Path: "pkg"}
+
+	t.Run("clean", func(t *testing.T) {
+		provider, err := NewLocalProvider()
+		require.NoError(t, err)
+
+		hash, err := provider.GetCommitHash(ctx, src)
+		require.NoError(t, err)
+		assert.Equal(t, head, hash)
+	})
+
+	t.Run("changes_outside_path", func(t *testing.T) {
+		writeTestFiles(t, root, map[string]string{"docs/notes.md": "# notes\n"})
+
+		provider, err := NewLocalProvider()
+		require.NoError(t, err)
+
+		hash, err := provider.GetCommitHash(ctx, src)
+		require.NoError(t, err)
+		assert.Equal(t, head, hash, "only changes under path make the tree dirty")
+	})
+
+	t.Run("dirty", func(t *testing.T) {
+		writeTestFiles(t, root, map[string]string{
+			"pkg/new.go":      "package pkg\n",
+			"pkg/scratch.tmp": "ignored\n",
+		})
+
+		provider, err := NewLocalProvider()
+		require.NoError(t, err)
+
+		hash, err := provider.GetCommitHash(ctx, src)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(hash, head+"-dirty-"), hash)
+
+		files, err := provider.ListFiles(ctx, src, true)
+		require.NoError(t, err)
+		assert.Equal(t, []ProviderFile{{Path: "pkg/main.go"}, {Path: "pkg/new.go"}}, files, "untracked files are synced, ignored ones are not")
+	})
+}
+
+func TestLocalProvider_RelativeRepo(t *testing.T) {
+	work := t.TempDir()
+	writeTestFiles(t, work, map[string]string{
+		"upstream/LICENSE":     testMITLicense,
+		"upstream/pkg/main.go": "package pkg\n",
+	})
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(work))
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	cfg := &SingleConfig{
+		Source:      Source{Repo: "./upstream", Path: "pkg"},
+		Destination: Destination{Path: "dest"},
+		CopyArgs:    &CopyEntry_Options{},
+	}
+	provider, err := NewLocalProvider()
+	require.NoError(t, err)
+	require.NoError(t, process(ctx, cfg, provider))
+
+	content, err := os.ReadFile(filepath.Join("dest", "main.go"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "source: file://./upstream/pkg/main.go")
+
+	lock, err := os.ReadFile(filepath.Join("dest", ".copyrc.lock"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(lock), work, "the lock file records the repo as written, not where it is on this machine")
+	assert.Contains(t, string(lock), "file://./upstream/pkg/main.go")
+
+	// the relative permalinks are read again on the next run
+	require.NoError(t, os.WriteFile(filepath.Join("upstream", "pkg", "main.go"), []byte("package pkg // changed\n"), 0644))
+	provider, err = NewLocalProvider()
+	require.NoError(t, err)
+	require.NoError(t, process(ctx, cfg, provider))
+	content, err = os.ReadFile(filepath.Join("dest", "main.go"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "package pkg // changed")
+}
@@ -51,7 +51,8 @@ type FileInfo struct {
 	IsNew        bool
 	IsUntracked  bool
 	IsCustomized bool
-	Replacements int // Number of replacements made to this file
+	IsConflicted bool // Upstream and local changes overlap, the file has conflict markers
+	Replacements int  // Number of replacements made to this file
 }
 
 // FileType represents the source/type of a file
@@ -122,6 +123,24 @@ var (
 		Text: "CUSTOMIZED",
 	}
 
+	ConflictedFile = FileStatus{
+		Symbol: '✗',
+		Style: StatusStyle{
+			SymbolColor: color.FgRed,
+			TextColor:   color.FgRed,
+		},
+		Text: "CONFLICT",
+	}
+
+	MergedFile = FileStatus{
+		Symbol: '⟳',
+		Style: StatusStyle{
+			SymbolColor: CustomizedColor,
+			TextColor:   color.Faint,
+		},
+		Text: "MERGED",
+	}
+
 	UnmodifiedCopyFile = FileStatus{
 		Symbol: '•',
 		Style: StatusStyle{
@@ -237,8 +256,47 @@ func NewDiscardDebugLogger(console io.Writer) *Logger {
 	}
 }
 
+// lockedBuffer collects the console output of a buffered logger, its writers hold different locks
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// buffered returns a logger that holds its console output until flush, so entries running
+// at the same time do not interleave their lines
+func (l *Logger) buffered() *Logger {
+	return &Logger{
+		zlog:       l.zlog,
+		consoleOut: &lockedBuffer{},
+	}
+}
+
+// flush writes the console output held by child in one piece
+func (l *Logger) flush(child *Logger) {
+	buf, ok := child.consoleOut.(*lockedBuffer)
+	if !ok {
+		return
+	}
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = buf.buf.WriteTo(l.consoleOut)
+}
+
 func (me FileInfo) Status() FileStatus {
-	if me.IsCustomized {
+	if me.IsConflicted {
+		return ConflictedFile
+	} else if me.IsCustomized && me.IsModified {
+		return MergedFile
+	} else if me.IsCustomized {
 		return CustomizedFile
 	} else if me.IsUntracked {
 		return UntrackedFile
@@ -20,16 +20,24 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"gitlab.com/tozd/go/errors"
 )
 
-// 🔄 Replacement represents a string replacement
+// 🔄 Replacement represents a string replacement. With regex, Old is a regular expression and
+// New can refer to its groups ($1, ${name}). HCL only takes old and new in the replacements
+// list, the other fields need a replacement block.
 type Replacement struct {
-	Old  string  `json:"old" hcl:"old" yaml:"old" cty:"old"`
-	New  string  `json:"new" hcl:"new" yaml:"new" cty:"new"`
-	File *string `json:"file,omitempty" hcl:"file,optional" yaml:"file,omitempty"`
+	Old       string  `json:"old" hcl:"old" yaml:"old" cty:"old"`
+	New       string  `json:"new" hcl:"new" yaml:"new" cty:"new"`
+	File      *string `json:"file,omitempty" hcl:"file,optional" yaml:"file,omitempty"`
+	Regex     bool    `json:"regex,omitempty" hcl:"regex,optional" yaml:"regex,omitempty"`                // 🧩 Old is a regular expression
+	Count     int     `json:"count,omitempty" hcl:"count,optional" yaml:"count,omitempty"`                // 🔢 Replace at most this many matches per file
+	LineRange string  `json:"line_range,omitempty" hcl:"line_range,optional" yaml:"line_range,omitempty"` // 📏 Only replace within these lines of the upstream file, e.g. "10-20"
+	Required  bool    `json:"required,omitempty" hcl:"required,optional" yaml:"required,omitempty"`       // ❗ Fail when nothing in the entry matches
 }
 
 // 📦 Input represents raw command line input
@@ -46,6 +54,9 @@ type Input struct {
 	RemoteStatus boolFlag   // Whether to check remote status
 	Force        boolFlag   // Whether to force update even if status is ok
 	Async        boolFlag   // Whether to process files asynchronously
+	Frozen       boolFlag   // Whether to require and verify every digest in the lock file
+	Offline      boolFlag   // Whether to work from the lock file and download cache only
+	Jobs         int        // Concurrent downloads and entries, 0 keeps the config or default
 }
 
 // 🏭 Create config from input (backward compatibility)
@@ -79,15 +90,52 @@ func NewConfigFromInput(input Input, provider RepoProvider) (*SingleConfig, erro
 			RemoteStatus: input.RemoteStatus.value,
 			Force:        input.Force.value,
 			Async:        input.Async.value,
+			Frozen:       input.Frozen.value,
+			Offline:      input.Offline.value,
+			Jobs:         input.Jobs,
 		},
 	}, nil
 }
 
 func main() {
-	ctx := context.Background()
+	// 🛑 Ctrl-C cancels the context, the entry in progress is rolled back instead of half written.
+	// The handler is released right away so a second Ctrl-C kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	logger := NewDiscardDebugLogger(os.Stdout)
 	ctx = NewLoggerInContext(ctx, logger)
 
+	// 🧹 copyrc cache prune
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		if err := runCacheCommand(ctx, os.Args[2:]); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	// 🗄️ Share downloads between entries and runs
+	cache, err := NewDownloadCache("")
+	if err != nil {
+		logger.Warningf("download cache disabled: %s", err)
+	} else {
+		ctx = NewDownloadCacheInContext(ctx, cache)
+	}
+
+	// 🩹 copyrc diff [-save-patch file]
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		if err := runDiffCommand(ctx, os.Args[2:]); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	// 🎯 Parse command line flags
 	input := Input{
 		Clean:        newDefaultFalseBoolFlag(),
@@ -95,6 +143,8 @@ func main() {
 		RemoteStatus: newDefaultFalseBoolFlag(),
 		Force:        newDefaultFalseBoolFlag(),
 		Async:        newDefaultFalseBoolFlag(),
+		Frozen:       newDefaultFalseBoolFlag(),
+		Offline:      newDefaultFalseBoolFlag(),
 	}
 	var configFile string
 	var showVersion bool
@@ -113,6 +163,9 @@ func main() {
 	flag.BoolVar(&input.RemoteStatus.value, "remote-status", false, "Check if files are up to date (includes remote check)")
 	flag.BoolVar(&input.Force.value, "force", false, "Force update even if status is ok")
 	flag.BoolVar(&input.Async.value, "async", false, "Process files asynchronously")
+	flag.BoolVar(&input.Frozen.value, "frozen", false, "Fail unless the lock file has a digest for every file and all of them match")
+	flag.BoolVar(&input.Offline.value, "offline", false, "Regenerate destinations from the lock file and download cache without network access")
+	flag.IntVar(&input.Jobs, "jobs", 0, "Maximum concurrent downloads and entries (default 8)")
 	flag.Parse()
 
 	if showVersion {
@@ -120,12 +173,6 @@ func main() {
 		os.Exit(0)
 	}
 
-	gh, err := NewGithubProvider()
-	if err != nil {
-		logger.Error(err.Error())
-		os.Exit(1)
-	}
-
 	// 🔍 Check if using config file
 	if configFile != "" {
 		cfg, err := LoadConfig(configFile, input)
@@ -134,7 +181,13 @@ func main() {
 			os.Exit(1)
 		}
 
-		if err := cfg.RunAll(ctx, gh); err != nil {
+		providers, err := NewProviderRegistry(cfg.Providers)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		if err := cfg.RunAll(ctx, providers); err != nil {
 			logger.Error(err.Error())
 			os.Exit(1)
 		}
@@ -160,13 +213,25 @@ func main() {
 	}
 
 	// 🚀 Run the copy operation
-	cfg, err := NewConfigFromInput(input, gh)
+	providers, err := NewProviderRegistry(nil)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	provider, err := providers.ProviderFor(Source{Repo: input.SrcRepo})
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	cfg, err := NewConfigFromInput(input, provider)
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
 
-	if err := process(ctx, cfg, gh); err != nil {
+	if err := process(ctx, cfg, provider); err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
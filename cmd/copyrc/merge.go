@@ -0,0 +1,239 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"gitlab.com/tozd/go/errors"
+)
+
+// 🔀 Conflict markers written around overlapping local and upstream changes
+const (
+	conflictLocal    = "<<<<<<< local\n"
+	conflictSep      = "=======\n"
+	conflictUpstream = ">>>>>>> upstream\n"
+)
+
+// previousUpstream is what an entry was synced from before this run, the merge base of
+// customized files is rendered from it
+type previousUpstream struct {
+	commitHash string
+	license    string
+	args       *CopyEntry_Options
+}
+
+type previousUpstreamContextKey struct{}
+
+func withPreviousUpstream(ctx context.Context, prev *previousUpstream) context.Context {
+	return context.WithValue(ctx, previousUpstreamContextKey{}, prev)
+}
+
+func previousUpstreamFromContext(ctx context.Context) *previousUpstream {
+	prev, _ := ctx.Value(previousUpstreamContextKey{}).(*previousUpstream)
+	return prev
+}
+
+// render downloads the file of entry at the previous commit and renders it with the previous
+// arguments and the patches it had. The result is only used when it hashes to entry.RemoteHash,
+// the content copyrc wrote last time. args are the current arguments, their computed go import
+// rewrites are reused. outPath is the local file, patches name it.
+func (p *previousUpstream) render(ctx context.Context, provider RepoProvider, src Source, args *CopyEntry_Options, outPath string, entry StatusEntry) ([]byte, error) {
+	if p.commitHash == "" || entry.Path == "" || entry.Permalink == "" || entry.RemoteHash == "" {
+		return nil, errors.New("the lock file does not record the previous upstream")
+	}
+
+	pinned := src
+	pinned.Ref = p.commitHash
+	pinned.RefType = "commit"
+	contentz, err := cachedDownload(ctx, src, p.commitHash, entry.Path, func() ([]byte, error) {
+		return downloadFile(ctx, provider, pinned, entry.Permalink, entry.Path)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	baseArgs := p.args
+	if baseArgs != nil && baseArgs.Go != nil && baseArgs.Go.FollowImports && args != nil && args.Go != nil {
+		withRewrites := *baseArgs
+		transform := *baseArgs.Go
+		transform.ImportRewrites = args.Go.ImportRewrites
+		withRewrites.Go = &transform
+		baseArgs = &withRewrites
+	}
+
+	rendered, err := renderCopy(entry.Path, entry.Permalink, p.license, contentz, baseArgs)
+	if err != nil {
+		return nil, err
+	}
+	base := rendered.content
+	if !bytes.HasSuffix(base, []byte("\n")) {
+		base = append(base, '\n')
+	}
+
+	patches, err := patchesFromContext(ctx).subset(entry.Patches)
+	if err != nil {
+		return nil, err
+	}
+	base, _, err = patches.apply(outPath, base)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(base)
+	if base64.URLEncoding.EncodeToString(sum[:]) != entry.RemoteHash {
+		return nil, errors.Errorf("%s at %s no longer renders to the content in the lock file", entry.Path, p.commitHash)
+	}
+	return base, nil
+}
+
+// mergeConflicts collects the files of a run that were written with conflict markers
+type mergeConflicts struct {
+	mu    sync.Mutex
+	files []string
+}
+
+type mergeConflictsContextKey struct{}
+
+func withMergeConflicts(ctx context.Context) (context.Context, *mergeConflicts) {
+	conflicts := &mergeConflicts{}
+	return context.WithValue(ctx, mergeConflictsContextKey{}, conflicts), conflicts
+}
+
+// recordConflict notes that file was written with conflict markers
+func recordConflict(ctx context.Context, file string) {
+	conflicts, ok := ctx.Value(mergeConflictsContextKey{}).(*mergeConflicts)
+	if !ok {
+		return
+	}
+	conflicts.mu.Lock()
+	defer conflicts.mu.Unlock()
+	conflicts.files = append(conflicts.files, file)
+}
+
+// err fails a run that left conflict markers behind, after its files were written
+func (c *mergeConflicts) err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.files) == 0 {
+		return nil
+	}
+	files := slices.Sorted(slices.Values(c.files))
+	return errors.Errorf("merge conflicts in %s, resolve the conflict markers and run copyrc again", strings.Join(files, ", "))
+}
+
+// merge3 is a line based three-way merge of the local and upstream changes to base, like diff3.
+// Changes to different lines are combined, overlapping changes are written between conflict
+// markers. It reports whether there was a conflict.
+func merge3(base, local, upstream []byte) ([]byte, bool) {
+	baseLines := splitLines(base)
+	localLines := splitLines(local)
+	upstreamLines := splitLines(upstream)
+
+	toLocal := matchLines(baseLines, localLines)
+	toUpstream := matchLines(baseLines, upstreamLines)
+
+	var out bytes.Buffer
+	conflict := false
+
+	// emit resolves the chunk in front of the next line all three agree on
+	emit := func(b, l, u []string) {
+		switch {
+		case slices.Equal(l, b):
+			writeLines(&out, u)
+		case slices.Equal(u, b), slices.Equal(l, u):
+			writeLines(&out, l)
+		default:
+			conflict = true
+			out.WriteString(conflictLocal)
+			writeLines(&out, l)
+			endLine(&out)
+			out.WriteString(conflictSep)
+			writeLines(&out, u)
+			endLine(&out)
+			out.WriteString(conflictUpstream)
+		}
+	}
+
+	i, l, u := 0, 0, 0
+	for j := range baseLines {
+		lj, lok := toLocal[j]
+		uj, uok := toUpstream[j]
+		if !lok || !uok {
+			continue
+		}
+		emit(baseLines[i:j], localLines[l:lj], upstreamLines[u:uj])
+		out.WriteString(baseLines[j])
+		i, l, u = j+1, lj+1, uj+1
+	}
+	emit(baseLines[i:], localLines[l:], upstreamLines[u:])
+
+	return out.Bytes(), conflict
+}
+
+// matchLines maps the lines of a that are kept in b to their index in b
+func matchLines(a, b []string) map[int]int {
+	dmp := diffmatchpatch.New()
+	chars1, chars2, _ := dmp.DiffLinesToRunes(strings.Join(a, ""), strings.Join(b, ""))
+	diffs := dmp.DiffMainRunes(chars1, chars2, false)
+
+	matched := make(map[int]int)
+	i, j := 0, 0
+	for _, diff := range diffs {
+		n := len([]rune(diff.Text))
+		switch diff.Type {
+		case diffmatchpatch.DiffEqual:
+			for k := 0; k < n; k++ {
+				matched[i+k] = j + k
+			}
+			i += n
+			j += n
+		case diffmatchpatch.DiffDelete:
+			i += n
+		case diffmatchpatch.DiffInsert:
+			j += n
+		}
+	}
+	return matched
+}
+
+// splitLines splits content after each newline, the last line may have none
+func splitLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func writeLines(out *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		out.WriteString(line)
+	}
+}
+
+// endLine keeps a conflict marker on its own line after a last line without newline
+func endLine(out *bytes.Buffer) {
+	if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteByte('\n')
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerge3(t *testing.T) {
+	const base = "a\nb\nc\nd\ne\n"
+
+	tests := []struct {
+		name     string
+		local    string
+		upstream string
+		want     string
+		conflict bool
+	}{
+		{
+			name:     "unchanged",
+			local:    base,
+			upstream: base,
+			want:     base,
+		},
+		{
+			name:     "upstream_only",
+			local:    base,
+			upstream: "a\nB\nc\nd\ne\n",
+			want:     "a\nB\nc\nd\ne\n",
+		},
+		{
+			name:     "local_only",
+			local:    "a\nb\nc\nd\nE\n",
+			upstream: base,
+			want:     "a\nb\nc\nd\nE\n",
+		},
+		{
+			name:     "separate_lines",
+			local:    "a\nb\nc\nd\nE\nf\n",
+			upstream: "A\nb\nc\nd\ne\n",
+			want:     "A\nb\nc\nd\nE\nf\n",
+		},
+		{
+			name:     "same_change",
+			local:    "a\nb\nC\nd\ne\n",
+			upstream: "a\nb\nC\nd\ne\n",
+			want:     "a\nb\nC\nd\ne\n",
+		},
+		{
+			name:     "deleted_upstream",
+			local:    "a\nb\nc\nd\nE\n",
+			upstream: "a\nd\ne\n",
+			want:     "a\nd\nE\n",
+		},
+		{
+			name:     "conflict",
+			local:    "a\nb\nlocal\nd\ne\n",
+			upstream: "a\nb\nupstream\nd\ne\n",
+			want:     "a\nb\n<<<<<<< local\nlocal\n=======\nupstream\n>>>>>>> upstream\nd\ne\n",
+			conflict: true,
+		},
+		{
+			name:     "conflict_without_newline",
+			local:    "a\nb\nc\nd\nlocal",
+			upstream: "a\nb\nc\nd\nupstream",
+			want:     "a\nb\nc\nd\n<<<<<<< local\nlocal\n=======\nupstream\n>>>>>>> upstream\n",
+			conflict: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, conflict := merge3([]byte(base), []byte(tt.local), []byte(tt.upstream))
+			assert.Equal(t, tt.want, string(got))
+			assert.Equal(t, tt.conflict, conflict)
+		})
+	}
+}
+
+func TestProcess_MergeCustomizations(t *testing.T) {
+	logger := newTestLogger(t)
+	ctx := NewLoggerInContext(context.Background(), logger)
+	cache, err := NewDownloadCache(t.TempDir())
+	require.NoError(t, err)
+	ctx = NewDownloadCacheInContext(ctx, cache)
+
+	mock := NewMockProvider(t)
+	mock.AddFile("a.go", []byte("package a\n\nfunc A() {}\n\nfunc B() {}\n"))
+
+	cfg := &SingleConfig{
+		Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+		Destination: Destination{Path: t.TempDir()},
+		CopyArgs:    &CopyEntry_Options{},
+	}
+	require.NoError(t, process(ctx, cfg, mock))
+
+	path := filepath.Join(cfg.Destination.Path, "a.go")
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte(strings.Replace(string(content), "func B() {}", "func B() { println() }", 1)), 0644))
+
+	t.Run("merged", func(t *testing.T) {
+		mock.AddFile("a.go", []byte("package a\n\nfunc A() int { return 1 }\n\nfunc B() {}\n"))
+		mock.commitHash = "def456"
+		require.NoError(t, process(ctx, cfg, mock))
+
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "func A() int { return 1 }")
+		assert.Contains(t, string(content), "func B() { println() }")
+		assert.Contains(t, string(content), "// 🔗 source: mock://a.go")
+
+		status, err := loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+		require.NoError(t, err)
+		assert.NotEmpty(t, status.CoppiedFiles["a.go"].DiffDelta, "the file is still customized")
+		assert.Contains(t, logger.CopyOfCurrentConsoleOutputInTest(), "MERGED")
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		mock.AddFile("a.go", []byte("package a\n\nfunc A() int { return 1 }\n\nfunc B() { panic(1) }\n"))
+		mock.commitHash = "ghi789"
+		err := process(ctx, cfg, mock)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "merge conflicts in a.go")
+
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "<<<<<<< local\nfunc B() { println() }\n=======\nfunc B() { panic(1) }\n>>>>>>> upstream\n")
+		assert.Contains(t, logger.CopyOfCurrentConsoleOutputInTest(), "CONFLICT")
+
+		status, err := loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+		require.NoError(t, err)
+		assert.Equal(t, "ghi789", status.CommitHash, "the conflicted sync is written")
+	})
+
+	t.Run("no_base", func(t *testing.T) {
+		resolved := "package a\n\nfunc B() { println() }\n"
+		require.NoError(t, os.WriteFile(path, []byte(resolved), 0644))
+
+		mock.AddFile("a.go", []byte("package a\n\nfunc C() {}\n"))
+		mock.commitHash = "jkl012"
+		noCache := NewLoggerInContext(context.Background(), logger)
+		err := process(noCache, cfg, mock)
+		require.Error(t, err, "without the previous upstream the upstream changes can't be merged")
+		assert.Contains(t, err.Error(), "cannot merge the upstream changes into customized a.go")
+
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, resolved, string(content))
+
+		status, err := loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+		require.NoError(t, err)
+		assert.Equal(t, "ghi789", status.CommitHash, "the lock keeps the merge base of the next run")
+
+		// taking the upstream version is how to get out of it
+		require.NoError(t, os.Remove(path))
+		require.NoError(t, process(noCache, cfg, mock))
+		content, err = os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "func C() {}")
+	})
+}
@@ -19,9 +19,13 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -37,6 +41,21 @@ type MockProvider struct {
 	repo       string
 	path       string
 	t          *testing.T
+
+	mu      sync.Mutex
+	fetched []string // files downloaded through GetFile, in order
+
+	latency     time.Duration // how long GetFile takes
+	inFlight    int
+	maxInFlight int // most GetFile calls seen at the same time
+}
+
+// gitBlobSha returns the sha git assigns to a blob with the given content
+func gitBlobSha(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 func NewMockProvider(t *testing.T) *MockProvider {
@@ -51,6 +70,11 @@ func NewMockProvider(t *testing.T) *MockProvider {
 	}
 }
 
+// ProviderFor lets the mock stand in for a ProviderResolver
+func (m *MockProvider) ProviderFor(src Source) (RepoProvider, error) {
+	return m, nil
+}
+
 // Helper methods for testing
 func (m *MockProvider) AddFile(name string, content []byte) {
 	m.files[name] = content
@@ -66,6 +90,7 @@ func (m *MockProvider) ListFiles(ctx context.Context, args Source, recursive boo
 	for f := range m.files {
 		files = append(files, ProviderFile{
 			Path: f,
+			Sha:  gitBlobSha(m.files[f]),
 		})
 	}
 	logger := loggerFromContext(ctx)
@@ -168,6 +193,18 @@ func (m *MockProvider) GetFile(ctx context.Context, args Source, file string) ([
 		return nil, errors.Errorf("file not found: %s", file)
 	}
 
+	m.mu.Lock()
+	m.fetched = append(m.fetched, cleanFile)
+	m.inFlight++
+	m.maxInFlight = max(m.maxInFlight, m.inFlight)
+	m.mu.Unlock()
+
+	time.Sleep(m.latency)
+
+	m.mu.Lock()
+	m.inFlight--
+	m.mu.Unlock()
+
 	// Return the content directly
 	return content, nil
 }
@@ -0,0 +1,605 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const npmDefaultRegistry = "https://registry.npmjs.org"
+
+// 🏗️ npm implementation, serves package tarballs from an npm registry for repos written as npm:package
+type NpmProvider struct {
+	registry string
+	tokenEnv string
+
+	mu       sync.Mutex
+	versions map[string]npmVersion
+	tarballs map[string]*npmTarball
+}
+
+type npmVersion struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Dist    struct {
+		Tarball   string `json:"tarball"`
+		Integrity string `json:"integrity"`
+		Shasum    string `json:"shasum"`
+	} `json:"dist"`
+}
+
+// npmTarball is a downloaded and verified package tarball, kept in unlinked temp files
+type npmTarball struct {
+	archive *os.File // the tarball as published
+	size    int64
+	content *os.File           // the uncompressed tar, files are read from it by offset
+	files   map[string]npmFile // by path, without the package/ prefix
+	order   []string
+}
+
+// npmFile is where a file's contents start in the uncompressed tar
+type npmFile struct {
+	offset int64
+	size   int64
+}
+
+// read returns the contents of a file of the package
+func (tb *npmTarball) read(name string) ([]byte, bool, error) {
+	f, ok := tb.files[name]
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := io.ReadAll(io.NewSectionReader(tb.content, f.offset, f.size))
+	if err != nil {
+		return nil, true, errors.Errorf("reading %s: %w", name, err)
+	}
+	return data, true, nil
+}
+
+func (tb *npmTarball) Close() error {
+	tb.content.Close()
+	return tb.archive.Close()
+}
+
+// NewNpmProvider creates an npm provider. An empty registry reads NPM_CONFIG_REGISTRY, falling back
+// to registry.npmjs.org, and an empty tokenEnv reads the token from NPM_TOKEN.
+func NewNpmProvider(registry string, tokenEnv string) (*NpmProvider, error) {
+	if registry == "" {
+		registry = os.Getenv("NPM_CONFIG_REGISTRY")
+	}
+	if registry == "" {
+		registry = npmDefaultRegistry
+	}
+	if tokenEnv == "" {
+		tokenEnv = "NPM_TOKEN"
+	}
+	return &NpmProvider{
+		registry: strings.TrimSuffix(registry, "/"),
+		tokenEnv: tokenEnv,
+		versions: make(map[string]npmVersion),
+		tarballs: make(map[string]*npmTarball),
+	}, nil
+}
+
+// parseNpmPackage returns the package name of a repo like npm:vscode-jsonrpc or npm:@scope/name
+func parseNpmPackage(repo string) (string, error) {
+	repo = strings.TrimPrefix(repo, "From ")
+	name, ok := strings.CutPrefix(repo, "npm:")
+	if !ok || name == "" {
+		return "", errors.Errorf("invalid npm repository: %s (expected npm:package or npm:@scope/package)", repo)
+	}
+
+	if scope, pkg, scoped := strings.Cut(name, "/"); scoped {
+		if !strings.HasPrefix(scope, "@") || len(scope) == 1 || pkg == "" || strings.Contains(pkg, "/") {
+			return "", errors.Errorf("invalid npm package name: %s", name)
+		}
+	} else if strings.HasPrefix(name, "@") {
+		return "", errors.Errorf("invalid npm package name: %s (scoped packages need a name)", name)
+	}
+	return name, nil
+}
+
+func (n *NpmProvider) get(ctx context.Context, target string) ([]byte, error) {
+	body, err := n.open(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, errors.Errorf("reading response: %w", err)
+	}
+	return data, nil
+}
+
+// isRegistryHost reports whether u is served by the configured registry
+func (n *NpmProvider) isRegistryHost(u *url.URL) bool {
+	registry, err := url.Parse(n.registry)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, registry.Host)
+}
+
+// open is get without reading the response
+func (n *NpmProvider) open(ctx context.Context, target string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, errors.Errorf("creating request: %w", err)
+	}
+
+	// Add npm token if available, only for the registry itself: dist.tarball may point at
+	// any host and the token must not leak to it
+	if token := os.Getenv(n.tokenEnv); token != "" && n.isRegistryHost(req.URL) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("requesting %s: %w", target, err)
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		resp.Body.Close()
+		return nil, errors.Errorf("unexpected status code: %d - try setting %s", resp.StatusCode, n.tokenEnv)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("unexpected status code from %s: %d", target, resp.StatusCode)
+	}
+
+	return resp.Body, nil
+}
+
+// version resolves Source.Ref, a version or dist-tag, to the registry metadata of that version
+func (n *NpmProvider) version(ctx context.Context, args Source) (npmVersion, error) {
+	name, err := parseNpmPackage(args.Repo)
+	if err != nil {
+		return npmVersion{}, err
+	}
+
+	ref := args.Ref
+	if ref == "" {
+		ref = "latest"
+	}
+
+	key := name + "@" + ref
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if v, ok := n.versions[key]; ok {
+		return v, nil
+	}
+
+	// scoped packages keep their @ but escape the slash
+	data, err := n.get(ctx, n.registry+"/"+strings.Replace(name, "/", "%2f", 1))
+	if err != nil {
+		return npmVersion{}, errors.Errorf("fetching package metadata: %w", err)
+	}
+
+	var packument struct {
+		DistTags map[string]string     `json:"dist-tags"`
+		Versions map[string]npmVersion `json:"versions"`
+	}
+	if err := json.Unmarshal(data, &packument); err != nil {
+		return npmVersion{}, errors.Errorf("decoding package metadata: %w", err)
+	}
+
+	version := ref
+	if tagged, ok := packument.DistTags[ref]; ok {
+		version = tagged
+	}
+
+	v, ok := packument.Versions[version]
+	if !ok {
+		// accept git style tags like v1.2.3
+		v, ok = packument.Versions[strings.TrimPrefix(version, "v")]
+	}
+	if !ok {
+		return npmVersion{}, errors.Errorf("invalid version or dist-tag '%s' for %s", ref, name)
+	}
+
+	if v.Dist.Tarball == "" {
+		return npmVersion{}, errors.Errorf("%s@%s has no tarball", name, v.Version)
+	}
+
+	n.versions[key] = v
+	return v, nil
+}
+
+// npmIntegrity hashes a tarball as it is written to it with every supported hash of the registry
+// integrity, or with sha1 for the shasum of packages that only have that
+type npmIntegrity struct {
+	integrity string
+	shasum    string
+	hashes    []hash.Hash
+	expected  []string
+	sha1      hash.Hash
+}
+
+func newNpmIntegrity(integrity string, shasum string) (*npmIntegrity, error) {
+	if integrity == "" && shasum == "" {
+		return nil, errors.New("registry returned neither integrity nor shasum")
+	}
+
+	v := &npmIntegrity{integrity: integrity, shasum: shasum}
+	for _, entry := range strings.Fields(integrity) {
+		algo, expected, ok := strings.Cut(entry, "-")
+		if !ok {
+			continue
+		}
+		var h hash.Hash
+		switch algo {
+		case "sha512":
+			h = sha512.New()
+		case "sha384":
+			h = sha512.New384()
+		case "sha256":
+			h = sha256.New()
+		default:
+			continue
+		}
+		v.hashes = append(v.hashes, h)
+		v.expected = append(v.expected, expected)
+	}
+
+	if len(v.hashes) == 0 {
+		if shasum == "" {
+			return nil, errors.Errorf("unsupported integrity %q", integrity)
+		}
+		v.sha1 = sha1.New()
+	}
+	return v, nil
+}
+
+func (v *npmIntegrity) Write(p []byte) (int, error) {
+	for _, h := range v.hashes {
+		h.Write(p)
+	}
+	if v.sha1 != nil {
+		v.sha1.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify checks what was written, an integrity string may list several hashes and any one matching is enough
+func (v *npmIntegrity) verify() error {
+	for i, h := range v.hashes {
+		if base64.StdEncoding.EncodeToString(h.Sum(nil)) == v.expected[i] {
+			return nil
+		}
+	}
+	if len(v.hashes) > 0 {
+		return errors.Errorf("integrity mismatch: expected %s", v.integrity)
+	}
+
+	if !strings.EqualFold(hex.EncodeToString(v.sha1.Sum(nil)), v.shasum) {
+		return errors.Errorf("shasum mismatch: expected %s", v.shasum)
+	}
+	return nil
+}
+
+// npmVerifyingReader fails the read that reaches the end of a tarball that does not match its integrity
+type npmVerifyingReader struct {
+	io.ReadCloser
+	integrity *npmIntegrity
+	name      string
+}
+
+func (r *npmVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.integrity.Write(p[:n])
+	if err == io.EOF {
+		if verr := r.integrity.verify(); verr != nil {
+			return n, errors.Errorf("verifying %s: %w", r.name, verr)
+		}
+	}
+	return n, err
+}
+
+// tarball downloads, verifies and unpacks the tarball of the resolved version once per provider.
+// Both the download and the unpacked tar go to temp files, the files are unlinked as soon as
+// they are open so nothing is left behind however the process ends.
+func (n *NpmProvider) tarball(ctx context.Context, args Source) (*npmTarball, npmVersion, error) {
+	v, err := n.version(ctx, args)
+	if err != nil {
+		return nil, npmVersion{}, err
+	}
+
+	n.mu.Lock()
+	cached, ok := n.tarballs[v.Dist.Tarball]
+	n.mu.Unlock()
+	if ok {
+		return cached, v, nil
+	}
+
+	integrity, err := newNpmIntegrity(v.Dist.Integrity, v.Dist.Shasum)
+	if err != nil {
+		return nil, npmVersion{}, errors.Errorf("verifying %s@%s: %w", v.Name, v.Version, err)
+	}
+
+	body, err := n.open(ctx, v.Dist.Tarball)
+	if err != nil {
+		return nil, npmVersion{}, errors.Errorf("downloading tarball: %w", err)
+	}
+	tmp, _, size, err := streamToTemp("", io.TeeReader(body, integrity), 0)
+	body.Close()
+	if err != nil {
+		return nil, npmVersion{}, errors.Errorf("downloading tarball: %w", err)
+	}
+
+	archive, err := os.Open(tmp)
+	os.Remove(tmp)
+	if err != nil {
+		return nil, npmVersion{}, errors.Errorf("opening tarball: %w", err)
+	}
+
+	if err := integrity.verify(); err != nil {
+		archive.Close()
+		return nil, npmVersion{}, errors.Errorf("verifying %s@%s: %w", v.Name, v.Version, err)
+	}
+
+	tb, err := unpackNpmTarball(archive, size)
+	if err != nil {
+		archive.Close()
+		return nil, npmVersion{}, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if cached, ok := n.tarballs[v.Dist.Tarball]; ok {
+		// another entry downloaded the same version meanwhile
+		tb.Close()
+		return cached, v, nil
+	}
+	n.tarballs[v.Dist.Tarball] = tb
+
+	return tb, v, nil
+}
+
+// unpackNpmTarball decompresses a verified tarball into a temp tar, recording where each file starts
+func unpackNpmTarball(archive *os.File, size int64) (*npmTarball, error) {
+	gr, err := gzip.NewReader(io.NewSectionReader(archive, 0, size))
+	if err != nil {
+		return nil, errors.Errorf("reading tarball: %w", err)
+	}
+	defer gr.Close()
+
+	content, err := os.CreateTemp("", ".copyrc-npm-*")
+	if err != nil {
+		return nil, errors.Errorf("creating temp file: %w", err)
+	}
+	os.Remove(content.Name())
+
+	tb := &npmTarball{archive: archive, size: size, content: content, files: make(map[string]npmFile)}
+
+	// everything the tar reader consumes is copied to content, so right after a header is read
+	// the write position is where that entry's data begins
+	tr := tar.NewReader(io.TeeReader(gr, content))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			content.Close()
+			return nil, errors.Errorf("reading tarball: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// entries live under package/, a few old packages use another top level directory
+		_, name, ok := strings.Cut(path.Clean(header.Name), "/")
+		if !ok || name == "" {
+			continue
+		}
+
+		offset, err := content.Seek(0, io.SeekCurrent)
+		if err != nil {
+			content.Close()
+			return nil, errors.Errorf("reading tarball: %w", err)
+		}
+		if _, dup := tb.files[name]; !dup {
+			tb.order = append(tb.order, name)
+		}
+		tb.files[name] = npmFile{offset: offset, size: header.Size}
+	}
+
+	return tb, nil
+}
+
+func (n *NpmProvider) ListFiles(ctx context.Context, args Source, recursive bool) ([]ProviderFile, error) {
+	tb, _, err := n.tarball(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := path.Clean("/" + args.Path)[1:]
+
+	result := []ProviderFile{}
+	for _, name := range tb.order {
+		if dir != "" && !strings.HasPrefix(name, dir+"/") {
+			continue
+		}
+		if !recursive && path.Dir(name) != path.Clean("./"+dir) {
+			continue
+		}
+		result = append(result, ProviderFile{
+			Path: name,
+		})
+	}
+	return result, nil
+}
+
+// GetCommitHash returns the resolved version, npm has no commits
+func (n *NpmProvider) GetCommitHash(ctx context.Context, args Source) (string, error) {
+	v, err := n.version(ctx, args)
+	if err != nil {
+		return "", err
+	}
+	return v.Version, nil
+}
+
+// GetFile returns a file from the verified package tarball
+func (n *NpmProvider) GetFile(ctx context.Context, args Source, file string) ([]byte, error) {
+	tb, v, err := n.tarball(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok, err := tb.read(file)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.Errorf("file %s not found in %s@%s", file, v.Name, v.Version)
+	}
+	return data, nil
+}
+
+// OpenArchive streams the package tarball as published, it is checked against the registry
+// integrity as it is read. A tarball the provider already downloaded is not downloaded again.
+func (n *NpmProvider) OpenArchive(ctx context.Context, args Source) (io.ReadCloser, error) {
+	v, err := n.version(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	cached, ok := n.tarballs[v.Dist.Tarball]
+	n.mu.Unlock()
+	if ok {
+		return io.NopCloser(io.NewSectionReader(cached.archive, 0, cached.size)), nil
+	}
+
+	integrity, err := newNpmIntegrity(v.Dist.Integrity, v.Dist.Shasum)
+	if err != nil {
+		return nil, errors.Errorf("verifying %s@%s: %w", v.Name, v.Version, err)
+	}
+
+	body, err := n.open(ctx, v.Dist.Tarball)
+	if err != nil {
+		return nil, errors.Errorf("downloading tarball: %w", err)
+	}
+	return &npmVerifyingReader{ReadCloser: body, integrity: integrity, name: v.Name + "@" + v.Version}, nil
+}
+
+func (n *NpmProvider) GetPermalink(ctx context.Context, args Source, commitHash string, file string) (string, error) {
+	v, err := n.version(ctx, args)
+	if err != nil {
+		return "", err
+	}
+	if file == "" {
+		return v.Dist.Tarball, nil
+	}
+	return v.Dist.Tarball + "#" + file, nil
+}
+
+func (n *NpmProvider) GetSourceInfo(ctx context.Context, args Source, commitHash string) (string, error) {
+	name, err := parseNpmPackage(args.Repo)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("npm:%s@%s", name, commitHash), nil
+}
+
+// GetArchiveUrl returns the tarball url from the registry metadata
+func (n *NpmProvider) GetArchiveUrl(ctx context.Context, args Source) (string, error) {
+	v, err := n.version(ctx, args)
+	if err != nil {
+		return "", err
+	}
+	return v.Dist.Tarball, nil
+}
+
+// GetLicense reads the license from package.json, which holds an SPDX expression
+func (n *NpmProvider) GetLicense(ctx context.Context, args Source, commitHash string) (LicenseEntry, error) {
+	tb, v, err := n.tarball(ctx, args)
+	if err != nil {
+		return LicenseEntry{}, err
+	}
+
+	data, ok, err := tb.read("package.json")
+	if err != nil {
+		return LicenseEntry{}, err
+	}
+	if !ok {
+		return LicenseEntry{}, errors.Errorf("package.json not found in %s@%s", v.Name, v.Version)
+	}
+
+	var pkg struct {
+		License  json.RawMessage   `json:"license"`
+		Licenses []json.RawMessage `json:"licenses"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return LicenseEntry{}, errors.Errorf("decoding package.json: %w", err)
+	}
+
+	// license is usually a string, older packages use {"type": ...} or a licenses array
+	raw := pkg.License
+	if len(raw) == 0 && len(pkg.Licenses) > 0 {
+		raw = pkg.Licenses[0]
+	}
+	if len(raw) == 0 {
+		return LicenseEntry{}, nil
+	}
+
+	var spdx string
+	if err := json.Unmarshal(raw, &spdx); err != nil {
+		var typed struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(raw, &typed); err != nil {
+			return LicenseEntry{}, errors.Errorf("decoding license in package.json: %w", err)
+		}
+		spdx = typed.Type
+	}
+
+	spdx = spdxFromKey(spdx)
+	name := spdx
+	for _, l := range knownLicenses {
+		if l.spdx == spdx {
+			name = l.name
+			break
+		}
+	}
+
+	return LicenseEntry{
+		SPDX:      spdx,
+		Name:      name,
+		Permalink: v.Dist.Tarball + "#package.json",
+	}, nil
+}
@@ -0,0 +1,294 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 🧪 npmTestTarball packs files under package/ the way npm publishes them
+func npmTestTarball(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "package/" + name, Size: int64(len(content)), Mode: 0644, Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+// 🧪 fakeNpmRegistry serves @scope/jsonrpc with a good 1.0.0 (dist-tag latest) and a corrupted 2.0.0 (dist-tag next)
+func fakeNpmRegistry(t *testing.T, files map[string]string) *httptest.Server {
+	t.Helper()
+
+	good := npmTestTarball(t, files)
+	sum := sha512.Sum512(good)
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.EscapedPath() {
+		case "/@scope%2fjsonrpc":
+			version := func(v string) map[string]any {
+				return map[string]any{
+					"name":    "@scope/jsonrpc",
+					"version": v,
+					"dist": map[string]string{
+						"tarball":   server.URL + "/@scope/jsonrpc/-/jsonrpc-" + v + ".tgz",
+						"integrity": "sha512-" + base64.StdEncoding.EncodeToString(sum[:]),
+					},
+				}
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"name":      "@scope/jsonrpc",
+				"dist-tags": map[string]string{"latest": "1.0.0", "next": "2.0.0"},
+				"versions":  map[string]any{"1.0.0": version("1.0.0"), "2.0.0": version("2.0.0")},
+			})
+		case "/@scope/jsonrpc/-/jsonrpc-1.0.0.tgz":
+			_, _ = w.Write(good)
+		case "/@scope/jsonrpc/-/jsonrpc-2.0.0.tgz":
+			_, _ = w.Write(npmTestTarball(t, map[string]string{"package.json": "{}"}))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server
+}
+
+func TestParseNpmPackage(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "npm:vscode-jsonrpc", want: "vscode-jsonrpc"},
+		{input: "npm:@vscode/l10n", want: "@vscode/l10n"},
+		{input: "vscode-jsonrpc", wantErr: true},
+		{input: "npm:@vscode", wantErr: true},
+		{input: "npm:scope/pkg", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseNpmPackage(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNpmProvider(t *testing.T) {
+	server := fakeNpmRegistry(t, map[string]string{
+		"package.json":   `{"name": "@scope/jsonrpc", "version": "1.0.0", "license": "MIT"}`,
+		"lib/main.js":    "module.exports = {}\n",
+		"lib/node/io.js": "module.exports = {}\n",
+		"README.md":      "# jsonrpc\n",
+	})
+	defer server.Close()
+
+	t.Setenv("NPM_TOKEN", "secret")
+
+	provider, err := NewNpmProvider(server.URL, "")
+	require.NoError(t, err)
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	src := Source{Repo: "npm:@scope/jsonrpc", Ref: "latest", Path: "lib"}
+
+	t.Run("GetCommitHash", func(t *testing.T) {
+		for _, ref := range []string{"latest", "", "1.0.0", "v1.0.0"} {
+			version, err := provider.GetCommitHash(ctx, Source{Repo: src.Repo, Ref: ref})
+			require.NoError(t, err, ref)
+			assert.Equal(t, "1.0.0", version, ref)
+		}
+
+		_, err := provider.GetCommitHash(ctx, Source{Repo: src.Repo, Ref: "9.9.9"})
+		require.Error(t, err)
+	})
+
+	t.Run("ListFiles", func(t *testing.T) {
+		files, err := provider.ListFiles(ctx, src, false)
+		require.NoError(t, err)
+		assert.Equal(t, []ProviderFile{{Path: "lib/main.js"}}, files)
+
+		files, err = provider.ListFiles(ctx, src, true)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []ProviderFile{{Path: "lib/main.js"}, {Path: "lib/node/io.js"}}, files)
+	})
+
+	t.Run("GetFile", func(t *testing.T) {
+		// files are read back by offset from the unpacked tar
+		for name, want := range map[string]string{
+			"lib/main.js": "module.exports = {}\n",
+			"README.md":   "# jsonrpc\n",
+		} {
+			data, err := provider.GetFile(ctx, src, name)
+			require.NoError(t, err, name)
+			assert.Equal(t, want, string(data), name)
+		}
+
+		_, err := provider.GetFile(ctx, src, "lib/missing.js")
+		require.Error(t, err)
+	})
+
+	t.Run("GetLicense", func(t *testing.T) {
+		license, err := provider.GetLicense(ctx, src, "1.0.0")
+		require.NoError(t, err)
+		assert.Equal(t, "MIT", license.SPDX)
+		assert.Equal(t, "MIT License", license.Name)
+	})
+
+	t.Run("integrity_mismatch", func(t *testing.T) {
+		_, err := provider.ListFiles(ctx, Source{Repo: src.Repo, Ref: "next"}, true)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "integrity mismatch")
+	})
+
+	t.Run("archive_integrity_mismatch", func(t *testing.T) {
+		rc, err := provider.OpenArchive(ctx, Source{Repo: src.Repo, Ref: "next"})
+		require.NoError(t, err)
+		defer rc.Close()
+
+		_, err = io.ReadAll(rc)
+		require.Error(t, err, "the streamed tarball is checked once it is read to the end")
+		assert.Contains(t, err.Error(), "integrity mismatch")
+	})
+
+	t.Run("missing_token", func(t *testing.T) {
+		t.Setenv("NPM_TOKEN", "")
+		fresh, err := NewNpmProvider(server.URL, "")
+		require.NoError(t, err)
+		_, err = fresh.GetCommitHash(ctx, src)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "NPM_TOKEN")
+	})
+
+	t.Run("archive", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      Source{Repo: src.Repo, Ref: "latest"},
+			Destination: Destination{Path: t.TempDir()},
+			ArchiveArgs: &ArchiveEntry_Options{GoEmbed: true},
+		}
+		require.NoError(t, process(ctx, cfg, provider))
+
+		tarball, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "jsonrpc.tar.gz"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x1f, 0x8b}, tarball[0:2], "should be gzipped data")
+
+		embed, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "embed.gen.go"))
+		require.NoError(t, err)
+		assert.Contains(t, string(embed), "package jsonrpc")
+		assert.Contains(t, string(embed), `Commit     = "1.0.0"`)
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      src,
+			Destination: Destination{Path: t.TempDir()},
+			CopyArgs:    &CopyEntry_Options{Recursive: true},
+		}
+		require.NoError(t, process(ctx, cfg, provider))
+
+		content, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "node", "io.js"))
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "module.exports")
+		assert.Contains(t, string(content), "license: MIT")
+	})
+}
+
+func TestNpmProvider_TokenScope(t *testing.T) {
+	tarball := npmTestTarball(t, map[string]string{"package.json": `{"name": "jsonrpc", "version": "1.0.0"}`})
+	sum := sha512.Sum512(tarball)
+
+	// the tarball lives on another host, like a cdn, which must never see the registry token
+	var cdnAuth []string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdnAuth = append(cdnAuth, r.Header.Get("Authorization"))
+		_, _ = w.Write(tarball)
+	}))
+	defer cdn.Close()
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"name":      "jsonrpc",
+			"dist-tags": map[string]string{"latest": "1.0.0"},
+			"versions": map[string]any{"1.0.0": map[string]any{
+				"name":    "jsonrpc",
+				"version": "1.0.0",
+				"dist": map[string]string{
+					"tarball":   cdn.URL + "/jsonrpc-1.0.0.tgz",
+					"integrity": "sha512-" + base64.StdEncoding.EncodeToString(sum[:]),
+				},
+			}},
+		})
+	}))
+	defer registry.Close()
+
+	t.Setenv("NPM_TOKEN", "secret")
+
+	provider, err := NewNpmProvider(registry.URL, "")
+	require.NoError(t, err)
+
+	ctx := NewLoggerInContext(context.Background(), NewDiscardDebugLogger(os.Stdout))
+	src := Source{Repo: "npm:jsonrpc", Ref: "latest"}
+
+	_, err = provider.GetFile(ctx, src, "package.json")
+	require.NoError(t, err, "the registry still gets the token")
+
+	// a fresh provider, so the archive is downloaded rather than served from the first one
+	fresh, err := NewNpmProvider(registry.URL, "")
+	require.NoError(t, err)
+	archive, err := fresh.OpenArchive(ctx, src)
+	require.NoError(t, err)
+	_, err = io.ReadAll(archive)
+	archive.Close()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"", ""}, cdnAuth, "the tarball host should not receive the token")
+}
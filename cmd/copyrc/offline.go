@@ -0,0 +1,159 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// ✈️ OfflineProvider serves a source from its lock file and the download cache, without
+// touching the network. The lock file stands in for the provider: it has the commit, the
+// files with their permalinks and the license, the cache has the content.
+type OfflineProvider struct {
+	cache      *DownloadCache
+	src        Source
+	commitHash string
+	archiveURL string
+	license    LicenseEntry
+	sourceInfo string
+	files      []ProviderFile
+	permalinks map[string]string
+}
+
+// NewOfflineProvider checks that everything status needs is in cache. Missing items are
+// listed in the error instead of falling back to a download.
+func NewOfflineProvider(cache *DownloadCache, src Source, status *StatusFile, archive bool) (*OfflineProvider, error) {
+	if cache == nil {
+		return nil, errors.New("offline: no download cache")
+	}
+	if status.CommitHash == "" {
+		return nil, errors.New("offline: no lock file")
+	}
+
+	// copied from the status up front, processing updates it while the provider is in use
+	p := &OfflineProvider{
+		cache:      cache,
+		src:        src,
+		commitHash: status.CommitHash,
+		archiveURL: status.ArchiveURL,
+		license:    status.License,
+		permalinks: make(map[string]string, len(status.CoppiedFiles)),
+	}
+	for _, entry := range status.OrderedCoppiedFiles() {
+		if p.sourceInfo == "" {
+			p.sourceInfo = entry.Source
+		}
+		if entry.Path != "" {
+			p.files = append(p.files, ProviderFile{Path: entry.Path, Sha: entry.BlobSha})
+			p.permalinks[entry.Path] = entry.Permalink
+		}
+	}
+
+	var missing []string
+	if archive {
+		if !cache.Has(p.key("")) {
+			missing = append(missing, src.Repo+"@"+status.CommitHash+" (archive)")
+		}
+	} else {
+		for _, entry := range status.OrderedCoppiedFiles() {
+			if entry.Path == "" {
+				return nil, errors.Errorf("offline: the lock file has no upstream path for %s, run copyrc once online to record it", entry.File)
+			}
+			if !cache.Has(p.key(entry.Path)) {
+				missing = append(missing, src.Repo+"@"+status.CommitHash+":"+entry.Path)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.Errorf("offline: missing from the download cache:\n\t%s", strings.Join(missing, "\n\t"))
+	}
+
+	return p, nil
+}
+
+func (p *OfflineProvider) key(file string) CacheKey {
+	return CacheKey{
+		Provider: repoHost(p.src.Repo),
+		Repo:     p.src.Repo,
+		Commit:   p.commitHash,
+		Path:     file,
+	}
+}
+
+func (p *OfflineProvider) read(file string) ([]byte, error) {
+	data, ok := p.cache.lookup(p.key(file))
+	if !ok {
+		return nil, errors.Errorf("offline: %s@%s:%s is not in the download cache", p.src.Repo, p.commitHash, file)
+	}
+	return data, nil
+}
+
+// ListFiles returns the files recorded in the lock file, they were filtered when it was written
+func (p *OfflineProvider) ListFiles(ctx context.Context, args Source, recursive bool) ([]ProviderFile, error) {
+	return slices.Clone(p.files), nil
+}
+
+func (p *OfflineProvider) GetCommitHash(ctx context.Context, args Source) (string, error) {
+	return p.commitHash, nil
+}
+
+func (p *OfflineProvider) GetPermalink(ctx context.Context, args Source, commitHash string, file string) (string, error) {
+	permalink, ok := p.permalinks[file]
+	if !ok {
+		return "", errors.Errorf("offline: %s is not in the lock file", file)
+	}
+	return permalink, nil
+}
+
+func (p *OfflineProvider) GetSourceInfo(ctx context.Context, args Source, commitHash string) (string, error) {
+	if p.sourceInfo == "" {
+		return "", errors.New("offline: the lock file has no source info")
+	}
+	return p.sourceInfo, nil
+}
+
+func (p *OfflineProvider) GetArchiveUrl(ctx context.Context, args Source) (string, error) {
+	if p.archiveURL == "" {
+		return "", errors.New("offline: the lock file has no archive url, run copyrc once online to record it")
+	}
+	return p.archiveURL, nil
+}
+
+func (p *OfflineProvider) GetLicense(ctx context.Context, args Source, commitHash string) (LicenseEntry, error) {
+	return p.license, nil
+}
+
+func (p *OfflineProvider) GetFile(ctx context.Context, args Source, file string) ([]byte, error) {
+	return p.read(file)
+}
+
+// OpenArchive opens the cached archive, the caller checks its sha256 against the lock file
+func (p *OfflineProvider) OpenArchive(ctx context.Context, args Source) (io.ReadCloser, error) {
+	object, _, ok := p.cache.lookupObject(p.key(""))
+	if !ok {
+		return nil, errors.Errorf("offline: %s@%s is not in the download cache", p.src.Repo, p.commitHash)
+	}
+	f, err := os.Open(object)
+	if err != nil {
+		return nil, errors.Errorf("offline: opening cached archive: %w", err)
+	}
+	return f, nil
+}
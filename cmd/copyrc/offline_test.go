@@ -0,0 +1,166 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcess_Offline(t *testing.T) {
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	cache, err := NewDownloadCache(t.TempDir())
+	require.NoError(t, err)
+	cachedCtx := NewDownloadCacheInContext(ctx, cache)
+
+	upstream := NewMockProvider(t)
+	upstream.AddFile("a.go", []byte("package a\n"))
+	upstream.AddFile("b.go", []byte("package b\n"))
+
+	// a provider that has nothing to offer, offline runs must not ask it
+	unreachable := NewMockProvider(t)
+	unreachable.commitHash = "unreachable"
+
+	t.Run("copy", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+			Destination: Destination{Path: t.TempDir()},
+			CopyArgs:    &CopyEntry_Options{Replacements: []Replacement{{Old: "package a", New: "package aa"}}},
+		}
+		require.NoError(t, process(cachedCtx, cfg, upstream))
+
+		want, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "a.go"))
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(filepath.Join(cfg.Destination.Path, "a.go")))
+		require.NoError(t, os.Remove(filepath.Join(cfg.Destination.Path, "b.go")))
+
+		cfg.Flags.Offline = true
+		require.NoError(t, process(cachedCtx, cfg, unreachable))
+		assert.Empty(t, unreachable.fetched)
+
+		got, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "a.go"))
+		require.NoError(t, err)
+		assert.Equal(t, string(want), string(got))
+
+		status, err := loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+		require.NoError(t, err)
+		assert.Equal(t, "abc123", status.CommitHash)
+		assert.Equal(t, "a.go", status.CoppiedFiles["a.go"].Path)
+
+		t.Run("missing", func(t *testing.T) {
+			empty, err := NewDownloadCache(t.TempDir())
+			require.NoError(t, err)
+
+			err = process(NewDownloadCacheInContext(ctx, empty), cfg, unreachable)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "missing from the download cache")
+			assert.Contains(t, err.Error(), "github.com/test/repo@abc123:a.go")
+			assert.Contains(t, err.Error(), "github.com/test/repo@abc123:b.go")
+		})
+
+		t.Run("changed_config", func(t *testing.T) {
+			changed := *cfg
+			changed.CopyArgs = &CopyEntry_Options{}
+			err := process(cachedCtx, &changed, unreachable)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "configuration has changed")
+		})
+	})
+
+	t.Run("no_lock", func(t *testing.T) {
+		err := process(cachedCtx, &SingleConfig{
+			Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+			Destination: Destination{Path: t.TempDir()},
+			CopyArgs:    &CopyEntry_Options{},
+			Flags:       FlagsBlock{Offline: true},
+		}, unreachable)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no lock file")
+	})
+
+	t.Run("extract", func(t *testing.T) {
+		upstream := NewMockProvider(t)
+		upstream.path = "repo-abc123"
+		upstream.AddFile("a.go", []byte("package a\n"))
+		upstream.AddFile("b.go", []byte("package b\n"))
+
+		cfg := &SingleConfig{
+			Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+			Destination: Destination{Path: t.TempDir()},
+			ArchiveArgs: &ArchiveEntry_Options{Extract: true, GoEmbed: true},
+		}
+		require.NoError(t, process(cachedCtx, cfg, upstream))
+
+		embed, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "embed.gen.go"))
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(filepath.Join(cfg.Destination.Path, "b.go")))
+
+		cfg.Flags.Offline = true
+		require.NoError(t, process(cachedCtx, cfg, unreachable))
+
+		got, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "b.go"))
+		require.NoError(t, err)
+		assert.Equal(t, "package b\n", string(got))
+
+		regenerated, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "embed.gen.go"))
+		require.NoError(t, err)
+		assert.Equal(t, string(embed), string(regenerated))
+	})
+}
+
+func TestProcessURLs_Offline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"type": "object"}`))
+	}))
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	cache, err := NewDownloadCache(t.TempDir())
+	require.NoError(t, err)
+	ctx = NewDownloadCacheInContext(ctx, cache)
+
+	entry := &URLEntry{
+		URL:         server.URL + "/schema.json",
+		Destination: Destination{Path: t.TempDir()},
+	}
+	require.NoError(t, processURLs(ctx, entry, FlagsBlock{}))
+	server.Close()
+
+	outPath := filepath.Join(entry.Destination.Path, "schema.json")
+	want, err := os.ReadFile(outPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(outPath))
+
+	require.NoError(t, processURLs(ctx, entry, FlagsBlock{Offline: true}))
+	got, err := os.ReadFile(outPath)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), string(got))
+
+	empty, err := NewDownloadCache(t.TempDir())
+	require.NoError(t, err)
+	err = processURLs(NewDownloadCacheInContext(ctx, empty), entry, FlagsBlock{Offline: true})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), server.URL+"/schema.json")
+}
@@ -0,0 +1,581 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"gitlab.com/tozd/go/errors"
+)
+
+// 🩹 patchFile is a unified diff, plain or git format, applied on top of the copied files
+type patchFile struct {
+	name   string // path of the patch as matched by the patches option
+	sha256 string
+	files  []*filePatch
+}
+
+// filePatch is the part of a patch that changes one file
+type filePatch struct {
+	path  string // relative to the working directory, like destination paths
+	hunks []*patchHunk
+}
+
+type patchHunk struct {
+	header   string   // the @@ line
+	oldStart int      // 1-based line of the first old line
+	old      []string // context and removed lines
+	new      []string // context and added lines
+	text     string   // the hunk as written in the patch, for errors
+}
+
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// parsePatch reads the file sections of a patch. Anything outside of them, like the commit
+// message and diffstat of git format-patch or the diff --git and index lines, is skipped.
+func parsePatch(name string, data []byte) (*patchFile, error) {
+	p := &patchFile{name: name, sha256: sha256Hex(data)}
+	lines := splitLines(data)
+
+	var current *filePatch
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			oldPath, newPath := patchPath(line[4:]), patchPath(lines[i+1][4:])
+			if oldPath == "/dev/null" {
+				return nil, errors.Errorf("patch %s creates %s, patches can only change copied files", name, strings.TrimPrefix(newPath, "b/"))
+			}
+			if newPath == "/dev/null" {
+				return nil, errors.Errorf("patch %s deletes %s, use ignore_files instead", name, strings.TrimPrefix(oldPath, "a/"))
+			}
+			// git prefixes the paths with a/ and b/
+			if strings.HasPrefix(oldPath, "a/") && strings.HasPrefix(newPath, "b/") {
+				newPath = newPath[2:]
+			}
+			current = &filePatch{path: filepath.Clean(filepath.FromSlash(newPath))}
+			p.files = append(p.files, current)
+			i++
+
+		case strings.HasPrefix(line, "@@ "):
+			if current == nil {
+				return nil, errors.Errorf("patch %s: hunk %s has no file header", name, strings.TrimSpace(line))
+			}
+			hunk, next, err := parseHunk(lines, i)
+			if err != nil {
+				return nil, errors.Errorf("patch %s: %s: %w", name, current.path, err)
+			}
+			current.hunks = append(current.hunks, hunk)
+			i = next
+		}
+	}
+
+	if len(p.files) == 0 {
+		return nil, errors.Errorf("patch %s changes no files", name)
+	}
+	return p, nil
+}
+
+// parseHunk reads the hunk starting at lines[start] and returns the index of its last line
+func parseHunk(lines []string, start int) (*patchHunk, int, error) {
+	header := strings.TrimRight(lines[start], "\n")
+	m := hunkHeader.FindStringSubmatch(header)
+	if m == nil {
+		return nil, 0, errors.Errorf("invalid hunk header %s", header)
+	}
+	count := func(s string) int {
+		if s == "" {
+			return 1
+		}
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	oldStart, _ := strconv.Atoi(m[1])
+	oldLeft, newLeft := count(m[2]), count(m[4])
+
+	h := &patchHunk{header: header, oldStart: oldStart}
+	var text strings.Builder
+	text.WriteString(lines[start])
+
+	// "\ No newline at end of file" is about the line before it
+	var last byte
+	noNewline := func() {
+		trim := func(s []string) {
+			if len(s) > 0 {
+				s[len(s)-1] = strings.TrimSuffix(s[len(s)-1], "\n")
+			}
+		}
+		if last != '+' {
+			trim(h.old)
+		}
+		if last != '-' {
+			trim(h.new)
+		}
+	}
+
+	i := start
+	for oldLeft > 0 || newLeft > 0 || (i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\\")) {
+		i++
+		if i >= len(lines) {
+			return nil, 0, errors.Errorf("hunk %s is truncated", header)
+		}
+		line := lines[i]
+		text.WriteString(line)
+		if line == "\n" {
+			// editors strip the space of empty context lines
+			line = " \n"
+		}
+
+		switch line[0] {
+		case ' ':
+			h.old = append(h.old, line[1:])
+			h.new = append(h.new, line[1:])
+			oldLeft--
+			newLeft--
+		case '-':
+			h.old = append(h.old, line[1:])
+			oldLeft--
+		case '+':
+			h.new = append(h.new, line[1:])
+			newLeft--
+		case '\\':
+			noNewline()
+			continue
+		default:
+			return nil, 0, errors.Errorf("hunk %s: unexpected line %q", header, strings.TrimRight(line, "\n"))
+		}
+		last = line[0]
+		if oldLeft < 0 || newLeft < 0 {
+			return nil, 0, errors.Errorf("hunk %s has more lines than its header says", header)
+		}
+	}
+
+	h.text = text.String()
+	return h, i, nil
+}
+
+// patchPath is the path of a ---/+++ line, without the timestamp diff -u adds
+func patchPath(s string) string {
+	s = strings.TrimRight(s, "\r\n")
+	if before, _, ok := strings.Cut(s, "\t"); ok {
+		s = before
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	return s
+}
+
+// apply applies the hunks in order. A hunk is looked for at its line, moved by what the hunks
+// before it added and removed, and then at the nearest lines its context matches.
+func (fp *filePatch) apply(content []byte) ([]byte, error) {
+	lines := splitLines(content)
+
+	offset, floor := 0, 0
+	for _, h := range fp.hunks {
+		pos := h.oldStart - 1
+		if len(h.old) == 0 {
+			// pure insertions name the line they go after
+			pos = h.oldStart
+		}
+
+		at := findHunk(lines, h.old, pos+offset, floor)
+		if at < 0 {
+			return nil, errors.Errorf("hunk %s of %s does not apply:\n%s", h.header, fp.path, h.text)
+		}
+
+		lines = slices.Concat(lines[:at], h.new, lines[at+len(h.old):])
+		offset = at - pos + len(h.new) - len(h.old)
+		floor = at + len(h.new)
+	}
+
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// findHunk returns where old is in lines closest to want and not before floor, -1 when it is not
+func findHunk(lines []string, old []string, want int, floor int) int {
+	last := len(lines) - len(old)
+	if last < floor {
+		return -1
+	}
+	want = min(max(want, floor), last)
+
+	for delta := 0; want-delta >= floor || want+delta <= last; delta++ {
+		for _, at := range []int{want - delta, want + delta} {
+			if at >= floor && at <= last && slices.Equal(lines[at:at+len(old)], old) {
+				return at
+			}
+		}
+	}
+	return -1
+}
+
+// 🩹 patchSet is the patches of a copy entry in the order they are applied
+type patchSet struct {
+	patches []*patchFile
+}
+
+// loadPatches reads the patches matched by the patches option of args, each pattern sorted
+// by name and in the order of the patterns
+func loadPatches(args *CopyEntry_Options) (*patchSet, error) {
+	if args == nil || len(args.Patches) == 0 {
+		return nil, nil
+	}
+
+	set := &patchSet{}
+	seen := make(map[string]bool)
+	for _, pattern := range args.Patches {
+		matches, err := doublestar.FilepathGlob(pattern)
+		if err != nil {
+			return nil, errors.Errorf("matching patches %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("patches %q matches no files", pattern)
+		}
+		slices.Sort(matches)
+
+		for _, name := range matches {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return nil, errors.Errorf("reading patch: %w", err)
+			}
+			p, err := parsePatch(filepath.ToSlash(name), data)
+			if err != nil {
+				return nil, err
+			}
+			set.patches = append(set.patches, p)
+		}
+	}
+	return set, nil
+}
+
+// apply patches content, the rendered copy of file. file is relative to the working directory
+// like the paths in the patches. It returns the names of the patches that changed it.
+func (s *patchSet) apply(file string, content []byte) ([]byte, []string, error) {
+	if s == nil {
+		return content, nil, nil
+	}
+
+	file = filepath.Clean(file)
+	var applied []string
+	for _, p := range s.patches {
+		for _, fp := range p.files {
+			if fp.path != file {
+				continue
+			}
+			patched, err := fp.apply(content)
+			if err != nil {
+				return nil, nil, errors.Errorf("applying patch %s: %w", p.name, err)
+			}
+			content = patched
+			if !slices.Contains(applied, p.name) {
+				applied = append(applied, p.name)
+			}
+		}
+	}
+	return content, applied, nil
+}
+
+// subset returns the patches called names, the ones a file was patched with before
+func (s *patchSet) subset(names []string) (*patchSet, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	sub := &patchSet{}
+	for _, name := range names {
+		i := -1
+		if s != nil {
+			i = slices.IndexFunc(s.patches, func(p *patchFile) bool { return p.name == name })
+		}
+		if i < 0 {
+			return nil, errors.Errorf("patch %s is no longer configured", name)
+		}
+		sub.patches = append(sub.patches, s.patches[i])
+	}
+	return sub, nil
+}
+
+// missing fails for patches of files that are not among the copied files
+func (s *patchSet) missing(copied []string) error {
+	if s == nil {
+		return nil
+	}
+
+	have := make(map[string]bool, len(copied))
+	for _, file := range copied {
+		have[filepath.Clean(file)] = true
+	}
+
+	var missing []string
+	for _, p := range s.patches {
+		for _, fp := range p.files {
+			if !have[fp.path] {
+				missing = append(missing, fmt.Sprintf("%s (%s)", fp.path, p.name))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("patches change files this entry does not copy: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// entries is the patch list recorded in the lock file
+func (s *patchSet) entries() []PatchEntry {
+	if s == nil {
+		return nil
+	}
+	entries := make([]PatchEntry, 0, len(s.patches))
+	for _, p := range s.patches {
+		entries = append(entries, PatchEntry{File: p.name, Sha256: p.sha256})
+	}
+	return entries
+}
+
+type patchSetContextKey struct{}
+
+func withPatches(ctx context.Context, set *patchSet) context.Context {
+	return context.WithValue(ctx, patchSetContextKey{}, set)
+}
+
+func patchesFromContext(ctx context.Context) *patchSet {
+	set, _ := ctx.Value(patchSetContextKey{}).(*patchSet)
+	return set
+}
+
+// unifiedDiff is a git style diff of path from old to new with three lines of context, empty
+// when they are the same
+func unifiedDiff(path string, old, new []byte) string {
+	a, b := splitLines(old), splitLines(new)
+	matched := matchLines(a, b)
+
+	type op struct {
+		kind byte
+		line string
+	}
+	var ops []op
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		if i >= len(a) {
+			ops = append(ops, op{'+', b[j]})
+			j++
+			continue
+		}
+		bj, ok := matched[i]
+		if !ok {
+			ops = append(ops, op{'-', a[i]})
+			i++
+			continue
+		}
+		for ; j < bj; j++ {
+			ops = append(ops, op{'+', b[j]})
+		}
+		ops = append(ops, op{' ', a[i]})
+		i++
+		j++
+	}
+
+	const contextLines = 3
+	var out strings.Builder
+	for start := 0; start < len(ops); {
+		first := slices.IndexFunc(ops[start:], func(o op) bool { return o.kind != ' ' })
+		if first < 0 {
+			break
+		}
+		first += start
+
+		// extend the hunk while the next change is close enough to share context
+		end := first
+		for k := first; k < len(ops) && k <= end+2*contextLines; k++ {
+			if ops[k].kind != ' ' {
+				end = k
+			}
+		}
+		from, to := max(first-contextLines, 0), min(end+contextLines+1, len(ops))
+
+		oldLine, newLine := 1, 1
+		for _, o := range ops[:from] {
+			if o.kind != '+' {
+				oldLine++
+			}
+			if o.kind != '-' {
+				newLine++
+			}
+		}
+		oldCount, newCount := 0, 0
+		for _, o := range ops[from:to] {
+			if o.kind != '+' {
+				oldCount++
+			}
+			if o.kind != '-' {
+				newCount++
+			}
+		}
+		if oldCount == 0 {
+			oldLine--
+		}
+		if newCount == 0 {
+			newLine--
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "diff --git a/%s b/%s\n--- a/%s\n+++ b/%s\n", path, path, path, path)
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", oldLine, oldCount, newLine, newCount)
+		for _, o := range ops[from:to] {
+			out.WriteByte(o.kind)
+			out.WriteString(o.line)
+			if !strings.HasSuffix(o.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = to
+	}
+	return out.String()
+}
+
+// 🩹 runDiffCommand implements `copyrc diff`, the local edits to customized files as a patch
+func runDiffCommand(ctx context.Context, args []string) error {
+	logger := loggerFromContext(ctx)
+
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	configFile := flags.String("config", ".copyrc.hcl", "path to config file")
+	savePatch := flags.String("save-patch", "", "write the patch to this file instead of printing it")
+	if err := flags.Parse(args); err != nil {
+		return errors.Errorf("parsing flags: %w", err)
+	}
+
+	cfg, err := LoadConfig(*configFile, Input{})
+	if err != nil {
+		return err
+	}
+	providers, err := NewProviderRegistry(cfg.Providers)
+	if err != nil {
+		return err
+	}
+
+	var out strings.Builder
+	files := 0
+	for _, copy := range cfg.Copies {
+		provider, err := providers.ProviderFor(copy.Source)
+		if err != nil {
+			return errors.Errorf("resolving provider for copy %s: %w", copy.Destination.Path, err)
+		}
+		diff, n, err := diffCopy(ctx, provider, copy)
+		if err != nil {
+			return errors.Errorf("diffing copy %s: %w", copy.Destination.Path, err)
+		}
+		out.WriteString(diff)
+		files += n
+	}
+
+	if files == 0 {
+		logger.Info("no local edits to copied files")
+		return nil
+	}
+	if *savePatch == "" {
+		fmt.Fprint(os.Stdout, out.String())
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*savePatch), 0755); err != nil {
+		return errors.Errorf("creating directory for %s: %w", *savePatch, err)
+	}
+	if err := os.WriteFile(*savePatch, []byte(out.String()), 0644); err != nil {
+		return errors.Errorf("writing patch: %w", err)
+	}
+	logger.Infof("saved the local edits to %d files in %s", files, *savePatch)
+	return nil
+}
+
+// diffCopy diffs the customized files of a copy entry against the content copyrc wrote, which
+// is rebuilt from the upstream commit, arguments and patches in the lock file
+func diffCopy(ctx context.Context, provider RepoProvider, copy *CopyEntry) (string, int, error) {
+	cfg := &SingleConfig{Source: copy.Source, Destination: copy.Destination, CopyArgs: copy.Options}
+	status, err := loadStatusFile(filepath.Join(cfg.statusDir(), ".copyrc.lock"))
+	if err != nil {
+		return "", 0, errors.Errorf("loading status file: %w", err)
+	}
+	if status == nil {
+		return "", 0, nil
+	}
+
+	patches, err := loadPatches(status.Args.CopyArgs)
+	if err != nil {
+		return "", 0, err
+	}
+	ctx = withPatches(ctx, patches)
+	prev := &previousUpstream{
+		commitHash: status.CommitHash,
+		license:    status.License.SPDX,
+		args:       status.Args.CopyArgs,
+	}
+
+	// the follow_imports rewrites are computed at sync time, compute them again for the locked commit
+	args := status.Args.CopyArgs
+	if args != nil && args.Go != nil && args.Go.FollowImports {
+		pinned := cfg.Source
+		pinned.Ref = status.CommitHash
+		pinned.RefType = "commit"
+		locked := &SingleConfig{Source: pinned, Destination: cfg.Destination, CopyArgs: args}
+		listed, err := provider.ListFiles(ctx, pinned, args.Recursive)
+		if err != nil {
+			return "", 0, errors.Errorf("listing files: %w", err)
+		}
+		if _, args, err = followImports(ctx, provider, locked, status.CommitHash, listed); err != nil {
+			return "", 0, err
+		}
+	}
+
+	var out strings.Builder
+	files := 0
+	for _, entry := range status.OrderedCoppiedFiles() {
+		path := filepath.Join(cfg.Destination.Path, entry.File)
+		local, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", 0, errors.Errorf("reading file: %w", err)
+		}
+		if hashContents(local) == entry.RemoteHash {
+			continue
+		}
+
+		base, err := prev.render(ctx, provider, cfg.Source, args, path, entry)
+		if err != nil {
+			return "", 0, errors.Errorf("rebuilding what copyrc wrote to %s: %w", path, err)
+		}
+		if diff := unifiedDiff(filepath.ToSlash(path), base, local); diff != "" {
+			out.WriteString(diff)
+			files++
+		}
+	}
+	return out.String(), files, nil
+}
@@ -0,0 +1,246 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchApply(t *testing.T) {
+	const formatPatch = `From 1234 Mon Sep 17 00:00:00 2001
+From: dev <dev@example.com>
+Subject: [PATCH] tweak
+
+---
+ gen/a.go | 3 ++-
+ 1 file changed, 2 insertions(+), 1 deletion(-)
+
+diff --git a/gen/a.go b/gen/a.go
+index 1111111..2222222 100644
+--- a/gen/a.go
++++ b/gen/a.go
+@@ -2,3 +2,4 @@ package a
+
+ func A() {}
+-func B() {}
++func B() { println() }
++func C() {}
+@@ -8,2 +9,2 @@ func D() {}
+ func E() {}
+-func F() {}
+\ No newline at end of file
++func F() { panic(1) }
+--
+2.40.0
+`
+
+	patch, err := parsePatch("patches/001.patch", []byte(formatPatch))
+	require.NoError(t, err)
+	require.Len(t, patch.files, 1)
+	assert.Equal(t, filepath.Join("gen", "a.go"), patch.files[0].path)
+	require.Len(t, patch.files[0].hunks, 2)
+
+	t.Run("offset", func(t *testing.T) {
+		// two lines more in front than the patch expects
+		got, err := patch.files[0].apply([]byte("// header\n// header\npackage a\n\nfunc A() {}\nfunc B() {}\nfunc D() {}\nfunc X() {}\nfunc Y() {}\nfunc E() {}\nfunc F() {}"))
+		require.NoError(t, err)
+		assert.Equal(t, "// header\n// header\npackage a\n\nfunc A() {}\nfunc B() { println() }\nfunc C() {}\nfunc D() {}\nfunc X() {}\nfunc Y() {}\nfunc E() {}\nfunc F() { panic(1) }\n", string(got))
+	})
+
+	t.Run("does_not_apply", func(t *testing.T) {
+		_, err := patch.files[0].apply([]byte("package a\n\nfunc A() {}\nfunc B() { return }\n"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "hunk @@ -2,3 +2,4 @@ package a of gen/a.go does not apply")
+		assert.Contains(t, err.Error(), "-func B() {}\n+func B() { println() }\n")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := parsePatch("x.patch", []byte("--- /dev/null\n+++ b/new.go\n@@ -0,0 +1 @@\n+package x\n"))
+		assert.ErrorContains(t, err, "creates new.go")
+
+		_, err = parsePatch("x.patch", []byte("not a patch\n"))
+		assert.ErrorContains(t, err, "changes no files")
+
+		_, err = parsePatch("x.patch", []byte("--- a/x.go\n+++ b/x.go\n@@ -1,2 +1,2 @@\n-a\n"))
+		assert.ErrorContains(t, err, "is truncated")
+	})
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	long := strings.Repeat("line\n", 20)
+
+	tests := []struct {
+		name     string
+		old, new string
+	}{
+		{name: "change", old: "a\nb\nc\n", new: "a\nB\nc\n"},
+		{name: "far_apart", old: "first\n" + long + "last\n", new: "FIRST\n" + long + "LAST\n"},
+		{name: "append", old: "a\n", new: "a\nb\nc\n"},
+		{name: "remove_all", old: "a\nb\n", new: ""},
+		{name: "no_newline", old: "a\nb", new: "a\nc"},
+		{name: "add_newline", old: "a\nb", new: "a\nb\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := unifiedDiff("gen/x.go", []byte(tt.old), []byte(tt.new))
+			require.True(t, strings.HasPrefix(diff, "diff --git a/gen/x.go b/gen/x.go\n--- a/gen/x.go\n+++ b/gen/x.go\n@@ "), diff)
+
+			patch, err := parsePatch("x.patch", []byte(diff))
+			require.NoError(t, err, diff)
+			got, err := patch.files[0].apply([]byte(tt.old))
+			require.NoError(t, err, diff)
+			assert.Equal(t, tt.new, string(got), diff)
+		})
+	}
+
+	t.Run("far_apart_hunks", func(t *testing.T) {
+		diff := unifiedDiff("x", []byte("first\n"+long+"last\n"), []byte("FIRST\n"+long+"LAST\n"))
+		assert.Equal(t, 2, strings.Count(diff, "\n@@ "))
+	})
+
+	assert.Empty(t, unifiedDiff("x", []byte("same\n"), []byte("same\n")))
+}
+
+func TestProcess_Patches(t *testing.T) {
+	ctx := NewLoggerInContext(context.Background(), NewDiscardDebugLogger(os.Stdout))
+
+	mock := NewMockProvider(t)
+	mock.AddFile("a.go", []byte("package a\n\nfunc A() {}\n\nfunc B() {}\n"))
+	mock.AddFile("b.go", []byte("package a\n"))
+
+	dest := t.TempDir()
+	patches := t.TempDir()
+	writePatch := func(name string, content string) {
+		require.NoError(t, os.WriteFile(filepath.Join(patches, name), []byte(content), 0644))
+	}
+	aPath := filepath.ToSlash(filepath.Join(dest, "a.go"))
+
+	cfg := &SingleConfig{
+		Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+		Destination: Destination{Path: dest},
+		CopyArgs: &CopyEntry_Options{
+			NoHeaderComments: true,
+			Replacements:     []Replacement{{Old: "func A()", New: "func AA()"}},
+			Patches:          []string{filepath.Join(patches, "*.patch")},
+		},
+	}
+
+	writePatch("001-b.patch", "--- a/"+aPath+"\n+++ b/"+aPath+"\n@@ -5 +5 @@\n-func B() {}\n+func B() { println() }\n")
+	writePatch("002-aa.patch", "--- a/"+aPath+"\n+++ b/"+aPath+"\n@@ -3 +3 @@\n-func AA() {}\n+func AA() int { return 1 }\n")
+	require.NoError(t, process(ctx, cfg, mock))
+
+	content, err := os.ReadFile(filepath.Join(dest, "a.go"))
+	require.NoError(t, err)
+	assert.Equal(t, "package a\n\nfunc AA() int { return 1 }\n\nfunc B() { println() }\n", string(content), "patches apply after the replacements, in order")
+
+	status, err := loadStatusFile(filepath.Join(dest, ".copyrc.lock"))
+	require.NoError(t, err)
+	first, second := filepath.ToSlash(filepath.Join(patches, "001-b.patch")), filepath.ToSlash(filepath.Join(patches, "002-aa.patch"))
+	require.Len(t, status.Patches, 2)
+	assert.Equal(t, first, status.Patches[0].File)
+	assert.Len(t, status.Patches[0].Sha256, 64)
+	assert.Equal(t, []string{first, second}, status.CoppiedFiles["a.go"].Patches)
+	assert.Contains(t, status.CoppiedFiles["a.go"].Changes, "Applied patch "+first)
+	assert.Empty(t, status.CoppiedFiles["b.go"].Patches)
+
+	t.Run("edited_patch", func(t *testing.T) {
+		writePatch("001-b.patch", "--- a/"+aPath+"\n+++ b/"+aPath+"\n@@ -5 +5 @@\n-func B() {}\n+func B() { panic(1) }\n")
+		require.NoError(t, process(ctx, cfg, mock), "the same commit is synced again when a patch changes")
+
+		content, err := os.ReadFile(filepath.Join(dest, "a.go"))
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "func B() { panic(1) }")
+	})
+
+	t.Run("does_not_apply", func(t *testing.T) {
+		writePatch("003-bad.patch", "--- a/"+aPath+"\n+++ b/"+aPath+"\n@@ -1 +1 @@\n-package b\n+package c\n")
+		defer os.Remove(filepath.Join(patches, "003-bad.patch"))
+
+		err := process(ctx, cfg, mock)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "applying patch "+filepath.ToSlash(filepath.Join(patches, "003-bad.patch")))
+		assert.Contains(t, err.Error(), "-package b\n+package c\n")
+	})
+
+	t.Run("not_copied", func(t *testing.T) {
+		other := filepath.ToSlash(filepath.Join(dest, "other.go"))
+		writePatch("003-other.patch", "--- a/"+other+"\n+++ b/"+other+"\n@@ -1 +1 @@\n-x\n+y\n")
+		defer os.Remove(filepath.Join(patches, "003-other.patch"))
+
+		err := process(ctx, cfg, mock)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "patches change files this entry does not copy")
+	})
+}
+
+func TestDiffCopy_SavePatch(t *testing.T) {
+	ctx := NewLoggerInContext(context.Background(), NewDiscardDebugLogger(os.Stdout))
+
+	mock := NewMockProvider(t)
+	mock.AddFile("a.go", []byte("package a\n\nfunc A() {}\n"))
+	mock.AddFile("b.go", []byte("package b\n"))
+
+	patches := t.TempDir()
+	copy := &CopyEntry{
+		Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+		Destination: Destination{Path: t.TempDir()},
+		Options:     &CopyEntry_Options{},
+	}
+	cfg := &SingleConfig{Source: copy.Source, Destination: copy.Destination, CopyArgs: copy.Options}
+	require.NoError(t, process(ctx, cfg, mock))
+
+	diff, n, err := diffCopy(ctx, mock, copy)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Empty(t, diff)
+
+	path := filepath.Join(copy.Destination.Path, "a.go")
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	edited := strings.Replace(string(content), "func A() {}", "func A() { println() }", 1)
+	require.NoError(t, os.WriteFile(path, []byte(edited), 0644))
+
+	diff, n, err = diffCopy(ctx, mock, copy)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Contains(t, diff, "-func A() {}\n+func A() { println() }\n")
+	require.NoError(t, os.WriteFile(filepath.Join(patches, "local.patch"), []byte(diff), 0644))
+
+	// the saved patch takes over the local edit
+	copy.Options.Patches = []string{filepath.Join(patches, "*.patch")}
+	require.NoError(t, process(ctx, cfg, mock))
+
+	content, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, edited, string(content))
+
+	status, err := loadStatusFile(filepath.Join(copy.Destination.Path, ".copyrc.lock"))
+	require.NoError(t, err)
+	assert.Equal(t, hashContents(content), status.CoppiedFiles["a.go"].RemoteHash, "the file is no longer customized")
+	assert.Empty(t, status.CoppiedFiles["a.go"].DiffDelta)
+	assert.Equal(t, []string{filepath.ToSlash(filepath.Join(patches, "local.patch"))}, status.CoppiedFiles["a.go"].Patches)
+
+	diff, n, err = diffCopy(ctx, mock, copy)
+	require.NoError(t, err)
+	assert.Zero(t, n, diff)
+}
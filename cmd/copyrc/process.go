@@ -17,15 +17,17 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"slices"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/bmatcuk/doublestar/v4"
 	"gitlab.com/tozd/go/errors"
@@ -53,20 +55,20 @@ func cleanDestination(ctx context.Context, status *StatusFile, destPath string)
 
 	for _, entry := range status.CoppiedFiles {
 		logger.AddFileOperation(FileInfo{Name: entry.File, IsRemoved: true})
-		if err := os.Remove(filepath.Join(destPath, entry.File)); err != nil {
+		if err := deleteFile(ctx, filepath.Join(destPath, entry.File)); err != nil {
 			return errors.Errorf("removing file: %w", err)
 		}
 	}
 
 	for _, entry := range status.GeneratedFiles {
 		logger.AddFileOperation(FileInfo{Name: entry.File, IsRemoved: true})
-		if err := os.Remove(filepath.Join(destPath, entry.File)); err != nil {
+		if err := deleteFile(ctx, filepath.Join(destPath, entry.File)); err != nil {
 			return errors.Errorf("removing file: %w", err)
 		}
 	}
 
 	logger.AddFileOperation(FileInfo{Name: ".copyrc.lock", IsRemoved: true})
-	if err := os.Remove(filepath.Join(destPath, ".copyrc.lock")); err != nil {
+	if err := deleteFile(ctx, filepath.Join(destPath, ".copyrc.lock")); err != nil {
 		if !os.IsNotExist(err) {
 			return errors.Errorf("removing status file: %w", err)
 		}
@@ -81,22 +83,65 @@ type FileGetter interface {
 
 func processArchive(ctx context.Context, provider RepoProvider, src Source, dest Destination, args *ArchiveEntry_Options, commitHash string, status *StatusFile, mu *sync.Mutex) error {
 
+	if args != nil && args.Extract {
+		return extractArchive(ctx, provider, src, dest, args, commitHash, status, mu)
+	}
+
 	if src.Path != "" {
 		return errors.New("path is not supported in tarball mode")
 	}
 
+	format, err := archiveFormat(args)
+	if err != nil {
+		return err
+	}
+
 	// Ensure cache directory exists
-	repoName := filepath.Base(src.Repo)
+	repoName := repoBaseName(src.Repo)
 	if err := os.MkdirAll(dest.Path, 0755); err != nil {
 		return errors.Errorf("creating repo directory: %w", err)
 	}
 
-	// Download tarball
-	data, err := GetFileFromTarball(ctx, provider, src)
+	maxSize, err := archiveMaxSize(args)
+	if err != nil {
+		return err
+	}
+
+	// Download tarball, next to its destination so it can be renamed into place
+	dl, err := fetchArchive(ctx, provider, src, commitHash, dest.Path, maxSize)
 	if err != nil {
 		return errors.Errorf("getting file from tarball: %w", err)
 	}
-	tarballPath := filepath.Join(dest.Path, repoName+".tar.gz")
+	defer os.Remove(dl.Path)
+
+	sum := dl.Sha256
+	if err := verifyArchiveSha256(src, sum); err != nil {
+		return err
+	}
+	if err := verifyDigest(status, mu, repoName+"."+format, commitHash, sum); err != nil {
+		return err
+	}
+
+	// only embed the part of the archive we use, repacking and converting stream the download into a second temp file
+	contentsPath, contentsSum := dl.Path, sum
+	if args != nil && (len(args.FilePatterns) > 0 || len(args.IgnoreFiles) > 0) {
+		contentsPath, contentsSum, err = dl.rewrite(dest.Path, func(src io.ReaderAt, size int64, w io.Writer) error {
+			return repackArchive(src, size, w, format, args.FilePatterns, args.IgnoreFiles)
+		})
+		if err != nil {
+			return errors.Errorf("repacking archive: %w", err)
+		}
+		defer os.Remove(contentsPath)
+	} else if dl.Format != format {
+		contentsPath, contentsSum, err = dl.rewrite(dest.Path, func(src io.ReaderAt, size int64, w io.Writer) error {
+			return convertArchive(src, size, w, format)
+		})
+		if err != nil {
+			return errors.Errorf("converting archive to %s: %w", format, err)
+		}
+		defer os.Remove(contentsPath)
+	}
+	tarballPath := filepath.Join(dest.Path, repoName+"."+format)
 
 	// Save tarball
 	sourceInfo, err := provider.GetSourceInfo(ctx, src, commitHash)
@@ -108,65 +153,218 @@ func processArchive(ctx context.Context, provider RepoProvider, src Source, dest
 	if err != nil {
 		return errors.Errorf("getting permalink: %w", err)
 	}
+	mu.Lock()
+	status.ArchiveURL = permalink
+	mu.Unlock()
 
-	// Let writeFile handle status determination
+	// Let writeFile handle status determination, the archive is moved into place
 	if _, err := writeFile(ctx, WriteFileOpts{
 		SourcePath:     tarballPath,
 		Destination:    dest,
 		Path:           tarballPath,
-		Contents:       data,
+		ContentsPath:   contentsPath,
+		ContentsSha256: contentsSum,
 		StatusFile:     status,
 		StatusMutex:    mu,
 		RepoSourceInfo: sourceInfo,
 		Permalink:      permalink,
+		Sha256:         sum,
 	}); err != nil {
 		return errors.Errorf("writing tarball: %w", err)
 	}
 
-	if args != nil && args.GoEmbed {
+	return nil
 
-		mu.Lock()
-		tarStatus := status.CoppiedFiles[filepath.Base(tarballPath)]
-		mu.Unlock()
+}
+
+// sha256Hex returns the digest recorded for upstream content in the lock file
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyArchiveSha256 checks a downloaded archive against the sha256 pinned on its source
+func verifyArchiveSha256(src Source, sum string) error {
+	if src.Sha256 != "" && !strings.EqualFold(src.Sha256, sum) {
+		return errors.Errorf("checksum mismatch for %s@%s: expected sha256 %s, downloaded archive has %s", src.Repo, src.Ref, src.Sha256, sum)
+	}
+	return nil
+}
+
+// verifyDigest fails when content fetched for the commit already in the lock file differs from
+// the digest recorded for it. The same commit can't change, so this is never an upstream update.
+func verifyDigest(status *StatusFile, mu *sync.Mutex, name string, commitHash string, sum string) error {
+	mu.Lock()
+	entry, ok := status.CoppiedFiles[name]
+	lockCommit := status.CommitHash
+	mu.Unlock()
+
+	if !ok || entry.Sha256 == "" || lockCommit != commitHash {
+		return nil
+	}
+	if entry.Sha256 != sum {
+		return errors.Errorf("checksum mismatch for %s at %s: lock file has sha256 %s, downloaded content has %s", name, commitHash, entry.Sha256, sum)
+	}
+	return nil
+}
+
+// matchesFilePatterns reports whether name matches one of patterns (all names when empty) and none of ignore
+func matchesFilePatterns(name string, patterns []string, ignore []string) bool {
+	if len(patterns) > 0 {
+		matched := false
+		for _, pattern := range patterns {
+			if match, err := doublestar.Match(pattern, name); err == nil && match {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for _, pattern := range ignore {
+		if match, err := doublestar.Match(pattern, name); err == nil && match {
+			return false
+		}
+	}
+
+	return true
+}
+
+// extractArchive unpacks the archive into dest instead of storing it. The top-level directory of the
+// archive (repo-sha/ on github) is dropped and only files under src.Path are kept, each tracked like a copied file.
+func extractArchive(ctx context.Context, provider RepoProvider, src Source, dest Destination, args *ArchiveEntry_Options, commitHash string, status *StatusFile, mu *sync.Mutex) error {
+	logger := loggerFromContext(ctx)
+
+	if err := os.MkdirAll(dest.Path, 0755); err != nil {
+		return errors.Errorf("creating destination directory: %w", err)
+	}
+
+	maxSize, err := archiveMaxSize(args)
+	if err != nil {
+		return err
+	}
+
+	dl, err := fetchArchive(ctx, provider, src, commitHash, "", maxSize)
+	if err != nil {
+		return errors.Errorf("getting file from tarball: %w", err)
+	}
+	defer os.Remove(dl.Path)
+
+	if err := verifyArchiveSha256(src, dl.Sha256); err != nil {
+		return err
+	}
+
+	f, err := os.Open(dl.Path)
+	if err != nil {
+		return errors.Errorf("opening downloaded archive: %w", err)
+	}
+	defer f.Close()
+
+	sourceInfo, err := provider.GetSourceInfo(ctx, src, commitHash)
+	if err != nil {
+		return errors.Errorf("getting source info: %w", err)
+	}
+
+	// offline runs need the archive url to find the archive
+	archiveURL, err := provider.GetArchiveUrl(ctx, src)
+	if err != nil {
+		return errors.Errorf("getting archive url: %w", err)
+	}
+	mu.Lock()
+	status.ArchiveURL = archiveURL
+	mu.Unlock()
+
+	dir := path.Clean("/" + src.Path)[1:]
+	extracted := make(map[string]bool)
+	var symlinks []string
+
+	// entries are streamed from the download, only the one being written is in memory
+	err = walkArchive(f, dl.Size, func(entry archiveEntry, r io.Reader) error {
+		name, ok := entry.rootPath()
+		if !ok {
+			return nil
+		}
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return errors.Errorf("archive entry %s is outside of the archive root", entry.Name)
+		}
+		if dir != "" && !strings.HasPrefix(name, dir+"/") {
+			return nil
+		}
+		if !matchesFilePatterns(name, args.FilePatterns, args.IgnoreFiles) {
+			return nil
+		}
+		if entry.Link != "" {
+			symlinks = append(symlinks, name)
+			return nil
+		}
+
+		permalink, err := provider.GetPermalink(ctx, src, commitHash, name)
+		if err != nil {
+			return errors.Errorf("getting permalink: %w", err)
+		}
+
+		rel := filepath.FromSlash(strings.TrimPrefix(name, dir+"/"))
+		outPath := filepath.Join(dest.Path, rel)
+
+		contents, err := io.ReadAll(r)
+		if err != nil {
+			return errors.Errorf("reading %s: %w", entry.Name, err)
+		}
+		sum := sha256Hex(contents)
+		if err := verifyDigest(status, mu, rel, commitHash, sum); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			return errors.Errorf("creating output directory: %w", err)
+		}
 
-		// Create embed.go file
-		pkgName := strings.ReplaceAll(repoName, "-", "")
-		embedPath := filepath.Join(dest.Path, "embed.gen.go")
-		var buf bytes.Buffer
-
-		fmt.Fprintf(&buf, "// 📦 generated by copyrc. DO NOT EDIT.\n")
-		fmt.Fprintf(&buf, "// ℹ️ see .copyrc.lock for more details.\n\n")
-		fmt.Fprintf(&buf, "package %s\n\n", pkgName)
-		fmt.Fprintf(&buf, "import _ \"embed\"\n\n")
-		fmt.Fprintf(&buf, "//go:embed %s.tar.gz\n", repoName)
-		fmt.Fprintf(&buf, "var Data []byte\n\n")
-		fmt.Fprintf(&buf, "// Metadata about the downloaded repository\n")
-		fmt.Fprintf(&buf, "var (\n")
-		fmt.Fprintf(&buf, "\tRef        = %q\n", src.Ref)
-		fmt.Fprintf(&buf, "\tCommit     = %q\n", commitHash)
-		fmt.Fprintf(&buf, "\tRepository = %q\n", src.Repo)
-		fmt.Fprintf(&buf, "\tPermalink  = %q\n", permalink)
-		fmt.Fprintf(&buf, "\tDownloaded = %q\n", tarStatus.LastUpdated.Format(time.RFC3339))
-		fmt.Fprintf(&buf, ")\n")
-
-		// Let writeFile handle status determination
 		if _, err := writeFile(ctx, WriteFileOpts{
-			SourcePath:    embedPath,
-			Destination:   dest,
-			Path:          embedPath,
-			Contents:      buf.Bytes(),
-			IsManaged:     true,
-			StatusFile:    status,
-			StatusMutex:   mu,
-			EnsureNewline: true,
+			SourcePath:     name,
+			Destination:    dest,
+			Path:           outPath,
+			Contents:       contents,
+			StatusFile:     status,
+			StatusMutex:    mu,
+			RepoSourceInfo: sourceInfo,
+			Permalink:      permalink,
+			Sha256:         sum,
+			UpstreamPath:   name,
 		}); err != nil {
-			return errors.Errorf("writing embed.gen.go: %w", err)
+			return errors.Errorf("writing file: %w", err)
 		}
+		extracted[rel] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
+	if len(symlinks) > 0 {
+		logger.Warningf("skipped %d symlinks, only regular files are extracted: %s", len(symlinks), strings.Join(symlinks, ", "))
 	}
 
-	return nil
+	// an empty match is a wrong path or pattern, not an upstream that deleted everything
+	if len(extracted) == 0 {
+		return errors.Errorf("no files in the archive match path %q and the file patterns, nothing was extracted", src.Path)
+	}
+
+	// files that are gone upstream are removed as well
+	mu.Lock()
+	defer mu.Unlock()
+	for name, entry := range status.CoppiedFiles {
+		if extracted[name] {
+			continue
+		}
+		logger.AddFileOperation(FileInfo{Name: entry.File, IsRemoved: true})
+		if err := deleteFile(ctx, filepath.Join(dest.Path, name)); err != nil && !os.IsNotExist(err) {
+			return errors.Errorf("removing file: %w", err)
+		}
+		delete(status.CoppiedFiles, name)
+	}
 
+	return nil
 }
 
 func (me *ProviderFile) OutPathWithExtensionPrefix(prefix string) string {
@@ -176,31 +374,47 @@ func (me *ProviderFile) OutPathWithExtensionPrefix(prefix string) string {
 	return me.Path
 }
 
+// copyOutPath is where processCopy writes file
+func copyOutPath(src Source, dest Destination, args *CopyEntry_Options, file ProviderFile) string {
+	outPath := file.Path
+	if args != nil && args.ExtensionPrefix != "" {
+		outPath = file.OutPathWithExtensionPrefix(args.ExtensionPrefix)
+	}
+	outPath = strings.TrimPrefix(outPath, src.Path+"/")
+	return filepath.Join(dest.Path, outPath)
+}
+
 func processCopy(ctx context.Context, provider RepoProvider, src Source, dest Destination, args *CopyEntry_Options, commitHash string, status *StatusFile, mu *sync.Mutex, file ProviderFile) error {
 
 	if err := os.MkdirAll(dest.Path, 0755); err != nil {
 		return errors.Errorf("creating destination directory: %w", err)
 	}
 
-	if args != nil {
-		// Check file patterns first before doing anything else
-		if len(args.FilePatterns) > 0 {
-			matched := false
-			for _, pattern := range args.FilePatterns {
-				if match, err := doublestar.Match(pattern, file.Path); err == nil && match {
-					matched = true
-					break
-				}
-			}
-			if !matched {
-				return nil
-			}
-		}
+	// Check file patterns first before doing anything else
+	if args != nil && !file.Imported && !matchesFilePatterns(file.Path, args.FilePatterns, args.IgnoreFiles) {
+		return nil
+	}
+
+	outPath := copyOutPath(src, dest, args, file)
 
-		// Check ignore patterns
-		for _, pattern := range args.IgnoreFiles {
-			if match, err := doublestar.Match(pattern, file.Path); err == nil && match {
-				// Skip this file
+	// Skip the download when the upstream blob is the one we already copied
+	if file.Sha != "" {
+		mu.Lock()
+		entry, ok := status.CoppiedFiles[strings.TrimPrefix(outPath, dest.Path+"/")]
+		mu.Unlock()
+		if ok && entry.BlobSha == file.Sha {
+			if _, err := os.Stat(outPath); err == nil {
+				if _, err := writeFile(ctx, WriteFileOpts{
+					SourcePath:    file.Path,
+					Destination:   dest,
+					Path:          outPath,
+					Contents:      nil,
+					StatusFile:    status,
+					StatusMutex:   mu,
+					EnsureNewline: true,
+				}); err != nil {
+					return errors.Errorf("writing file: %w", err)
+				}
 				return nil
 			}
 		}
@@ -216,133 +430,215 @@ func processCopy(ctx context.Context, provider RepoProvider, src Source, dest De
 		return errors.Errorf("getting permalink: %w", err)
 	}
 
-	var contentz []byte
-	if mockProvider, ok := provider.(FileGetter); ok {
-		// For mock provider, use GetFile directly
-		contentz, err = mockProvider.GetFile(ctx, src, file.Path)
-		if err != nil {
-			return errors.Errorf("getting file content: %w", err)
-		}
-	} else if strings.HasPrefix(permalink, "file://") {
-		contentz, err = os.ReadFile(strings.TrimPrefix(permalink, "file://"))
-		if err != nil {
-			return errors.Errorf("reading file: %w", err)
+	contentz, err := cachedDownload(ctx, src, commitHash, file.Path, func() ([]byte, error) {
+		return downloadFile(ctx, provider, src, permalink, file.Path)
+	})
+	if err != nil {
+		return err
+	}
+
+	sum := sha256Hex(contentz)
+	if err := verifyDigest(status, mu, strings.TrimPrefix(outPath, dest.Path+"/"), commitHash, sum); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return errors.Errorf("creating output directory: %w", err)
+	}
+
+	rendered, err := renderCopy(file.Path, permalink, status.License.SPDX, contentz, args)
+	if err != nil {
+		return err
+	}
+
+	// patches are made against the file on disk, which ends with a newline
+	content := rendered.content
+	if !bytes.HasSuffix(content, []byte("\n")) {
+		content = append(content, '\n')
+	}
+	content, patched, err := patchesFromContext(ctx).apply(outPath, content)
+	if err != nil {
+		return err
+	}
+	for _, name := range patched {
+		rendered.changes = append(rendered.changes, fmt.Sprintf("Applied patch %s", name))
+	}
+
+	// customized files are merged with what the previous upstream rendered to
+	var mergeBase func() ([]byte, error)
+	if prev := previousUpstreamFromContext(ctx); prev != nil {
+		mu.Lock()
+		entry, ok := status.CoppiedFiles[strings.TrimPrefix(outPath, dest.Path+"/")]
+		mu.Unlock()
+		if ok {
+			mergeBase = func() ([]byte, error) {
+				return prev.render(ctx, provider, src, args, outPath, entry)
+			}
 		}
-	} else {
-		req, err := http.NewRequestWithContext(ctx, "GET", permalink, nil)
+	}
+
+	// Let writeFile handle all status management and logging
+	if _, err := writeFile(ctx, WriteFileOpts{
+		SourcePath:       file.Path,
+		Destination:      dest,
+		Path:             outPath,
+		Contents:         content,
+		StatusFile:       status,
+		StatusMutex:      mu,
+		RepoSourceInfo:   sourceInfo,
+		Permalink:        permalink,
+		Changes:          rendered.changes,
+		ReplacementCount: rendered.replacementCount,
+		Matched:          rendered.matched,
+		EnsureNewline:    true,
+		BlobSha:          file.Sha,
+		Sha256:           sum,
+		UpstreamPath:     file.Path,
+		Patches:          patched,
+		MergeBase:        mergeBase,
+	}); err != nil {
+		return errors.Errorf("writing file: %w", err)
+	}
+
+	return nil
+}
+
+// downloadFile reads file from providers that serve files themselves, from disk for file://
+// permalinks and over http otherwise
+func downloadFile(ctx context.Context, provider RepoProvider, src Source, permalink string, file string) ([]byte, error) {
+	release, err := acquireJob(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if getter, ok := provider.(FileGetter); ok {
+		contentz, err := getter.GetFile(ctx, src, file)
 		if err != nil {
-			return errors.Errorf("creating request: %w", err)
+			return nil, errors.Errorf("getting file content: %w", err)
 		}
+		return contentz, nil
+	}
 
-		resp, err := http.DefaultClient.Do(req)
+	if strings.HasPrefix(permalink, "file://") {
+		contentz, err := os.ReadFile(strings.TrimPrefix(permalink, "file://"))
 		if err != nil {
-			return errors.Errorf("downloading file: %w", err)
+			return nil, errors.Errorf("reading file: %w", err)
 		}
-		defer resp.Body.Close()
+		return contentz, nil
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			return errors.Errorf("downloading file: %s", resp.Status)
-		}
+	req, err := http.NewRequestWithContext(ctx, "GET", permalink, nil)
+	if err != nil {
+		return nil, errors.Errorf("creating request: %w", err)
+	}
 
-		contentz, err = io.ReadAll(resp.Body)
-		if err != nil {
-			return errors.Errorf("reading file: %w", err)
-		}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("downloading file: %w", err)
 	}
+	defer resp.Body.Close()
 
-	outPath := file.Path
-	if args != nil && args.ExtensionPrefix != "" {
-		outPath = file.OutPathWithExtensionPrefix(args.ExtensionPrefix)
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("downloading file: %s", resp.Status)
 	}
-	outPath = strings.TrimPrefix(outPath, src.Path+"/")
-	outPath = filepath.Join(dest.Path, outPath)
 
-	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
-		return errors.Errorf("creating output directory: %w", err)
+	contentz, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("reading file: %w", err)
 	}
+	return contentz, nil
+}
 
-	// Process content
+// renderedCopy is a copied file after its header and replacements
+type renderedCopy struct {
+	content          []byte
+	replacementCount int
+	changes          []string
+	matched          []int // indexes of the replacements that matched
+}
+
+// renderCopy prefixes contents with the copyrc header for its file type and applies the replacements
+func renderCopy(name string, permalink string, license string, contentz []byte, args *CopyEntry_Options) (*renderedCopy, error) {
 	var buf bytes.Buffer
 
 	if args == nil || !args.NoHeaderComments {
 		// Add file header based on extension
-		switch filepath.Ext(file.Path) {
+		switch filepath.Ext(name) {
 		case ".go", ".js", ".ts", ".jsx", ".tsx", ".cpp", ".c", ".h", ".hpp", ".java", ".scala", ".rs", ".php", "jsonc":
 			fmt.Fprintf(&buf, "// 📦 originally copied by copyrc\n")
 			fmt.Fprintf(&buf, "// 🔗 source: %s\n", permalink)
-			fmt.Fprintf(&buf, "// 📝 license: %s\n", status.License.SPDX)
+			fmt.Fprintf(&buf, "// 📝 license: %s\n", license)
 			fmt.Fprintf(&buf, "// ℹ️ see .copyrc.lock for more details\n\n")
 		case ".py", ".rb", ".pl", ".sh", ".yaml", ".yml":
 			fmt.Fprintf(&buf, "# 📦 originally copied by copyrc\n")
 			fmt.Fprintf(&buf, "# 🔗 source: %s\n", permalink)
-			fmt.Fprintf(&buf, "# 📝 license: %s\n", status.License.SPDX)
+			fmt.Fprintf(&buf, "# 📝 license: %s\n", license)
 			fmt.Fprintf(&buf, "# ℹ️ see .copyrc.lock for more details\n\n")
 		case ".md", ".xml":
 			fmt.Fprintf(&buf, "<!--\n")
 			fmt.Fprintf(&buf, "📦 originally copied by copyrc\n")
 			fmt.Fprintf(&buf, "🔗 source: %s\n", permalink)
-			fmt.Fprintf(&buf, "📝 license: %s\n", status.License.SPDX)
+			fmt.Fprintf(&buf, "📝 license: %s\n", license)
 			fmt.Fprintf(&buf, "ℹ️ see .copyrc.lock for more details\n")
 			fmt.Fprintf(&buf, "-->\n\n")
 		}
 	}
+	// line ranges count the lines of the upstream file, not the header
+	headerLines := bytes.Count(buf.Bytes(), []byte("\n"))
+	out := &renderedCopy{}
+
+	if args != nil && args.Go != nil && filepath.Ext(name) == ".go" {
+		rewritten, changes, err := args.Go.apply(name, contentz, headerLines)
+		if err != nil {
+			return nil, err
+		}
+		contentz = rewritten
+		out.changes = append(out.changes, changes...)
+	}
 
 	// Write original content
 	buf.Write(contentz)
-	var replacementCount int
-	var changes []string
 	if args != nil {
 		// Apply replacements
-
-		for _, r := range args.Replacements {
+		for i, r := range args.Replacements {
 			if r.File != nil && *r.File != "" {
-				matched, err := doublestar.Match(*r.File, file.Path)
+				matched, err := doublestar.Match(*r.File, name)
 				if err != nil {
-					return errors.Errorf("matching file: %w", err)
+					return nil, errors.Errorf("matching file: %w", err)
 				}
 				if !matched {
 					continue
 				}
 			}
-			if bytes.Contains(buf.Bytes(), []byte(r.Old)) {
-				// Count occurrences of the replacement
-				replacementCount += bytes.Count(buf.Bytes(), []byte(r.Old))
-
-				// Find line numbers for the changes
-				lines := bytes.Split(buf.Bytes(), []byte("\n"))
-				for i, line := range lines {
-					if bytes.Contains(line, []byte(r.Old)) {
-						change := fmt.Sprintf("Line %d: Replaced '%s' with '%s'", i+1, r.Old, r.New)
-						changes = append(changes, change)
-					}
-				}
 
-				// Apply the replacement
-				newContent := bytes.ReplaceAll(buf.Bytes(), []byte(r.Old), []byte(r.New))
-				buf.Reset()
-				buf.Write(newContent)
+			rep, err := r.compile()
+			if err != nil {
+				return nil, err
 			}
-		}
-	}
 
-	// Let writeFile handle all status management and logging
-	if _, err := writeFile(ctx, WriteFileOpts{
-		SourcePath:       file.Path,
-		Destination:      dest,
-		Path:             outPath,
-		Contents:         buf.Bytes(),
-		StatusFile:       status,
-		StatusMutex:      mu,
-		RepoSourceInfo:   sourceInfo,
-		Permalink:        permalink,
-		Changes:          changes,
-		ReplacementCount: replacementCount,
-		EnsureNewline:    true,
-	}); err != nil {
-		return errors.Errorf("writing file: %w", err)
+			newContent, count, lines := rep.apply(buf.Bytes(), headerLines)
+			if count == 0 {
+				continue
+			}
+			out.replacementCount += count
+			out.matched = append(out.matched, i)
+
+			// one change per line, like a diff
+			for j, line := range lines {
+				if j > 0 && lines[j-1] == line {
+					continue
+				}
+				out.changes = append(out.changes, fmt.Sprintf("Line %d: Replaced '%s' with '%s'", line, r.Old, r.New))
+			}
+
+			buf.Reset()
+			buf.Write(newContent)
+		}
 	}
 
-	return nil
+	out.content = buf.Bytes()
+	return out, nil
 }
 
 func processDirectory(ctx context.Context, provider RepoProvider, cfg *SingleConfig, commitHash string, status *StatusFile, mu *sync.Mutex) error {
@@ -368,6 +664,15 @@ func processDirectory(ctx context.Context, provider RepoProvider, cfg *SingleCon
 		}
 	}
 
+	// pull in the upstream packages the copied Go files import
+	copyArgs := cfg.CopyArgs
+	if cfg.ArchiveArgs == nil && copyArgs != nil && copyArgs.Go != nil && copyArgs.Go.FollowImports {
+		files, copyArgs, err = followImports(ctx, provider, cfg, commitHash, files)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Sort files by name
 	slices.SortFunc(files, func(a, b ProviderFile) int {
 		return strings.Compare(a.Path, b.Path)
@@ -388,16 +693,20 @@ func processDirectory(ctx context.Context, provider RepoProvider, cfg *SingleCon
 		var wg sync.WaitGroup
 		errChan := make(chan error, len(files))
 
+		// at most -jobs files in flight, each one holds a download
+		sem := make(chan struct{}, cfg.Flags.jobs())
 		for _, file := range files {
 			wg.Add(1)
 			go func(f ProviderFile) {
 				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
 				if cfg.ArchiveArgs != nil {
 					if err := processArchive(ctx, provider, cfg.Source, cfg.Destination, cfg.ArchiveArgs, commitHash, status, mu); err != nil {
 						errChan <- errors.Errorf("processing file %s: %w", f.Path, err)
 					}
 				} else {
-					if err := processCopy(ctx, provider, cfg.Source, cfg.Destination, cfg.CopyArgs, commitHash, status, mu, f); err != nil {
+					if err := processCopy(ctx, provider, cfg.Source, cfg.Destination, copyArgs, commitHash, status, mu, f); err != nil {
 						errChan <- errors.Errorf("processing file %s: %w", f.Path, err)
 					}
 				}
@@ -425,14 +734,34 @@ func processDirectory(ctx context.Context, provider RepoProvider, cfg *SingleCon
 				}
 			} else {
 
-				if err := processCopy(ctx, provider, cfg.Source, cfg.Destination, cfg.CopyArgs, commitHash, status, mu, file); err != nil {
+				if err := processCopy(ctx, provider, cfg.Source, cfg.Destination, copyArgs, commitHash, status, mu, file); err != nil {
 					return errors.Errorf("processing file %s: %w", file.Path, err)
 				}
 			}
 		}
 	}
 
-	if err := processUntracked(ctx, status, cfg.Destination, cfg.CopyArgs != nil && cfg.CopyArgs.Recursive); err != nil {
+	if cfg.ArchiveArgs == nil {
+		var entries []StatusEntry
+		var copied []string
+		mu.Lock()
+		for _, file := range files {
+			outPath := copyOutPath(cfg.Source, cfg.Destination, cfg.CopyArgs, file)
+			if entry, ok := status.CoppiedFiles[strings.TrimPrefix(outPath, cfg.Destination.Path+"/")]; ok {
+				entries = append(entries, entry)
+				copied = append(copied, outPath)
+			}
+		}
+		mu.Unlock()
+		if err := checkRequiredReplacements(cfg.CopyArgs, entries); err != nil {
+			return err
+		}
+		if err := patchesFromContext(ctx).missing(copied); err != nil {
+			return err
+		}
+	}
+
+	if err := processUntracked(ctx, status, cfg.Destination, cfg.recursive()); err != nil {
 		return errors.Errorf("processing untracked files: %w", err)
 	}
 
@@ -488,7 +817,8 @@ func processUntracked(ctx context.Context, status *StatusFile, dest Destination,
 
 		_, genStatus := status.GeneratedFiles[trimmedPath]
 		_, copyStatus := status.CoppiedFiles[trimmedPath]
-		return genStatus || copyStatus || entry.Info.IsDir() || entry.Info.Name() == ".copyrc.lock" || entry.Info.Name() == ".git" || entry.Info.Name() == ".DS_Store"
+		return genStatus || copyStatus || entry.Info.IsDir() || entry.Info.Name() == ".copyrc.lock" || entry.Info.Name() == ".git" || entry.Info.Name() == ".DS_Store" ||
+			strings.HasPrefix(entry.Info.Name(), stagingPrefix)
 	})
 
 	slices.SortFunc(entries, func(a, b EntryItem) int {
@@ -511,7 +841,43 @@ func processUntracked(ctx context.Context, status *StatusFile, dest Destination,
 
 }
 
+// checkFrozen refuses a frozen run unless the lock file was written with the same arguments
+// and has a digest for every file
+func checkFrozen(status *StatusFile, argsAreSame bool) error {
+	if status.CommitHash == "" && len(status.Args.URLs) == 0 {
+		return errors.New("frozen: no lock file")
+	}
+	if !argsAreSame {
+		return errors.New("frozen: configuration has changed since the lock file was written")
+	}
+
+	var missing []string
+	for _, entry := range status.OrderedCoppiedFiles() {
+		if entry.Sha256 == "" {
+			missing = append(missing, entry.File)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("frozen: the lock file has no sha256 for %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// process syncs one entry. Its files and lock file are committed together, an error or
+// interrupt leaves the destination as it was. Merge conflicts are written and then reported
+// as an error.
 func process(ctx context.Context, cfg *SingleConfig, provider RepoProvider) error {
+	ctx = withJobLimit(ctx, cfg.Flags.jobs())
+	ctx, conflicts := withMergeConflicts(ctx)
+	if err := inTransaction(ctx, func(ctx context.Context) error {
+		return processEntry(ctx, cfg, provider)
+	}); err != nil {
+		return err
+	}
+	return conflicts.err()
+}
+
+func processEntry(ctx context.Context, cfg *SingleConfig, provider RepoProvider) error {
 	logger := loggerFromContext(ctx)
 
 	logger.formatRepoDisplay(RepoDisplay{
@@ -521,10 +887,16 @@ func process(ctx context.Context, cfg *SingleConfig, provider RepoProvider) erro
 		IsArchive:   cfg.ArchiveArgs != nil,
 	})
 
-	destPath := cfg.Destination.Path
-	if cfg.ArchiveArgs != nil {
-		destPath = filepath.Join(destPath, filepath.Base(cfg.Source.Repo))
+	if err := validateReplacements(cfg.CopyArgs); err != nil {
+		return err
+	}
+	patches, err := loadPatches(cfg.CopyArgs)
+	if err != nil {
+		return err
 	}
+	ctx = withPatches(ctx, patches)
+
+	destPath := cfg.statusDir()
 
 	// Determine status file location based on mode
 	var statusFile string
@@ -563,8 +935,7 @@ func process(ctx context.Context, cfg *SingleConfig, provider RepoProvider) erro
 			argsAreSame = false
 		} else {
 			for i, r := range status.Args.CopyArgs.Replacements {
-				if r.Old != cfg.CopyArgs.Replacements[i].Old ||
-					r.New != cfg.CopyArgs.Replacements[i].New {
+				if !sameArgs(r, cfg.CopyArgs.Replacements[i]) {
 					argsAreSame = false
 					break
 				}
@@ -583,6 +954,13 @@ func process(ctx context.Context, cfg *SingleConfig, provider RepoProvider) erro
 			}
 		}
 
+		// Compare header and naming options
+		if status.Args.CopyArgs.NoHeaderComments != cfg.CopyArgs.NoHeaderComments ||
+			status.Args.CopyArgs.ExtensionPrefix != cfg.CopyArgs.ExtensionPrefix ||
+			!sameArgs(status.Args.CopyArgs.Go, cfg.CopyArgs.Go) {
+			argsAreSame = false
+		}
+
 		// Compare file patterns
 		if len(status.Args.CopyArgs.FilePatterns) != len(cfg.CopyArgs.FilePatterns) {
 			argsAreSame = false
@@ -595,6 +973,26 @@ func process(ctx context.Context, cfg *SingleConfig, provider RepoProvider) erro
 			}
 		}
 	}
+
+	// edited patch files change the output as much as changed arguments
+	if !slices.Equal(status.Patches, patches.entries()) {
+		argsAreSame = false
+	}
+
+	// Compare archive arguments
+	if cfg.ArchiveArgs != nil && !sameArgs(status.Args.ArchiveArgs, cfg.ArchiveArgs) {
+		argsAreSame = false
+	}
+	if cfg.Source.Sha256 != "" && cfg.ArchiveArgs == nil {
+		return errors.New("sha256 is only supported on archive sources")
+	}
+
+	if cfg.Flags.Frozen {
+		if err := checkFrozen(status, argsAreSame); err != nil {
+			return err
+		}
+	}
+
 	// Check if arguments have changed
 	if (cfg.Flags.Status || cfg.Flags.RemoteStatus) && !cfg.Flags.Force {
 		if !argsAreSame {
@@ -612,7 +1010,7 @@ func process(ctx context.Context, cfg *SingleConfig, provider RepoProvider) erro
 			return errors.Errorf("cleaning destination: %w", err)
 		}
 
-		if err := processUntracked(ctx, status, cfg.Destination, cfg.CopyArgs != nil && cfg.CopyArgs.Recursive); err != nil {
+		if err := processUntracked(ctx, status, cfg.Destination, cfg.recursive()); err != nil {
 			return errors.Errorf("processing untracked files: %w", err)
 		}
 
@@ -621,13 +1019,33 @@ func process(ctx context.Context, cfg *SingleConfig, provider RepoProvider) erro
 		return nil
 	}
 
+	// local sources need no network, everything else is served from the lock file and download cache
+	if cfg.Flags.Offline && repoHost(cfg.Source.Repo) != "file://" {
+		if !argsAreSame {
+			return errors.New("offline: configuration has changed since the lock file was written")
+		}
+		provider, err = NewOfflineProvider(downloadCacheFromContext(ctx), cfg.Source, status, cfg.ArchiveArgs != nil)
+		if err != nil {
+			return err
+		}
+	}
+
 	commitHash, err := provider.GetCommitHash(ctx, cfg.Source)
 	if err != nil {
 		return errors.Errorf("getting commit hash: %w", err)
 	}
 	var mu sync.Mutex
 
-	if !cfg.Flags.Force && !cfg.Flags.Clean && status.CommitHash != "" {
+	// frozen runs download everything again to check it against the lock file
+	if cfg.Flags.Frozen && commitHash != status.CommitHash {
+		return errors.Errorf("frozen: %s resolves to %s but the lock file has %s", cfg.Source.Ref, commitHash, status.CommitHash)
+	}
+	locked := make(map[string]bool, len(status.CoppiedFiles))
+	for name := range status.CoppiedFiles {
+		locked[name] = true
+	}
+
+	if !cfg.Flags.Force && !cfg.Flags.Clean && !cfg.Flags.Frozen && !cfg.Flags.Offline && status.CommitHash != "" {
 		if status.CommitHash == commitHash && argsAreSame {
 			logger.longestNeighbor = status.GetLongestNeighbor()
 
@@ -663,7 +1081,7 @@ func process(ctx context.Context, cfg *SingleConfig, provider RepoProvider) erro
 					return errors.Errorf("writing embed.gen.go: %w", err)
 				}
 			}
-			if err := processUntracked(ctx, status, cfg.Destination, cfg.CopyArgs != nil && cfg.CopyArgs.Recursive); err != nil {
+			if err := processUntracked(ctx, status, cfg.Destination, cfg.recursive()); err != nil {
 				return errors.Errorf("processing untracked files: %w", err)
 			}
 			defer func() {
@@ -683,17 +1101,44 @@ func process(ctx context.Context, cfg *SingleConfig, provider RepoProvider) erro
 		return errors.Errorf("getting license: %w", err)
 	}
 
+	// blob shas only tell us the upstream file is unchanged, the local copy also depends on the
+	// arguments and the license header so start from scratch when either changed
+	if !argsAreSame || cfg.Flags.Force || cfg.Flags.Frozen || cfg.Flags.Offline || status.License != license {
+		for name, entry := range status.CoppiedFiles {
+			entry.BlobSha = ""
+			status.CoppiedFiles[name] = entry
+		}
+	}
+
+	ctx = withPreviousUpstream(ctx, &previousUpstream{
+		commitHash: status.CommitHash,
+		license:    status.License.SPDX,
+		args:       status.Args.CopyArgs,
+	})
 	status.License = license
 
 	// Reset processed files map for each repository
-	processedFiles = sync.Map{}
+	processedFiles.Clear()
 
 	if err := processDirectory(ctx, provider, cfg, commitHash, status, &mu); err != nil {
 		return errors.Errorf("processing directory: %w", err)
 	}
 
+	if err := writeEmbed(ctx, provider, cfg, commitHash, status, &mu); err != nil {
+		return errors.Errorf("writing embed.gen.go: %w", err)
+	}
+
+	if cfg.Flags.Frozen {
+		for name := range status.CoppiedFiles {
+			if !locked[name] {
+				return errors.Errorf("frozen: %s is not in the lock file", name)
+			}
+		}
+	}
+
 	status.CommitHash = commitHash
 	status.Ref = cfg.Source.Ref
+	status.Patches = patches.entries()
 	status.Args = StatusFileArgs{
 		SrcRepo:     cfg.Source.Repo,
 		SrcRef:      cfg.Source.Ref,
@@ -702,12 +1147,7 @@ func process(ctx context.Context, cfg *SingleConfig, provider RepoProvider) erro
 		ArchiveArgs: cfg.ArchiveArgs,
 	}
 
-	dest := cfg.Destination.Path
-	if cfg.ArchiveArgs != nil {
-		dest = filepath.Join(dest, filepath.Base(cfg.Source.Repo))
-	}
-
-	if err := writeStatusFile(ctx, status, dest); err != nil {
+	if err := writeStatusFile(ctx, status, destPath); err != nil {
 		return errors.Errorf("writing status file: %w", err)
 	}
 
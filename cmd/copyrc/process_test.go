@@ -15,8 +15,13 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
@@ -519,3 +524,313 @@ func TestProcessDirectory_RecursiveCopy(t *testing.T) {
 	}
 	assert.Empty(t, expectedFiles, "all expected files should have been found")
 }
+
+func TestProcess_SkipsUnchangedBlobs(t *testing.T) {
+	mock := NewMockProvider(t)
+	mock.AddFile("a.go", []byte("package a\n"))
+	mock.AddFile("b.go", []byte("package b\n"))
+
+	cfg := &SingleConfig{
+		Source: Source{
+			Repo: "github.com/test/repo",
+			Ref:  "main",
+		},
+		Destination: Destination{
+			Path: t.TempDir(),
+		},
+		CopyArgs: &CopyEntry_Options{},
+	}
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	require.NoError(t, process(ctx, cfg, mock))
+	assert.ElementsMatch(t, []string{"a.go", "b.go"}, mock.fetched)
+
+	// 🔄 new upstream commit that only touches b.go
+	mock.AddFile("b.go", []byte("package b // changed\n"))
+	mock.commitHash = "def456"
+	mock.fetched = nil
+
+	require.NoError(t, process(ctx, cfg, mock))
+	assert.Equal(t, []string{"b.go"}, mock.fetched, "only the changed blob should be downloaded")
+
+	status, err := loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+	require.NoError(t, err)
+	assert.Equal(t, "def456", status.CommitHash)
+	assert.Equal(t, gitBlobSha([]byte("package a\n")), status.CoppiedFiles["a.go"].BlobSha)
+	assert.Equal(t, gitBlobSha([]byte("package b // changed\n")), status.CoppiedFiles["b.go"].BlobSha)
+
+	content, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "b.go"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "// changed")
+
+	// 💪 force downloads everything again
+	mock.commitHash = "fed789"
+	mock.fetched = nil
+	cfg.Flags.Force = true
+
+	require.NoError(t, process(ctx, cfg, mock))
+	assert.ElementsMatch(t, []string{"a.go", "b.go"}, mock.fetched)
+}
+
+func TestProcess_ExtractArchive(t *testing.T) {
+	upstream := filepath.Join(t.TempDir(), "upstream")
+	writeTestFiles(t, upstream, map[string]string{
+		"README.md":             "# upstream\n",
+		"lua/config/init.lua":   "return {}\n",
+		"lua/config/server.lua": "return { name = 'server' }\n",
+		"lua/config/empty.lua":  "",
+		"lua/config/test.lua":   "-- test\n",
+		"lua/config/notes.txt":  "notes\n",
+	})
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	cfg := &SingleConfig{
+		Source:      Source{Repo: upstream, Path: "lua"},
+		Destination: Destination{Path: t.TempDir()},
+		ArchiveArgs: &ArchiveEntry_Options{
+			Extract:      true,
+			FilePatterns: []string{"**/*.lua"},
+			IgnoreFiles:  []string{"**/test.lua"},
+		},
+	}
+
+	provider, err := NewLocalProvider()
+	require.NoError(t, err)
+	require.NoError(t, process(ctx, cfg, provider))
+
+	content, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "config", "server.lua"))
+	require.NoError(t, err)
+	assert.Equal(t, "return { name = 'server' }\n", string(content))
+
+	_, err = os.Stat(filepath.Join(cfg.Destination.Path, "upstream.tar.gz"))
+	assert.True(t, os.IsNotExist(err), "the tarball itself should not be stored")
+
+	status, err := loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+	require.NoError(t, err)
+	var tracked []string
+	for name := range status.CoppiedFiles {
+		tracked = append(tracked, filepath.ToSlash(name))
+	}
+	assert.ElementsMatch(t, []string{"config/init.lua", "config/server.lua", "config/empty.lua"}, tracked)
+
+	// 🗑️ files removed upstream are removed locally
+	require.NoError(t, os.Remove(filepath.Join(upstream, "lua", "config", "server.lua")))
+	provider, err = NewLocalProvider()
+	require.NoError(t, err)
+	require.NoError(t, process(ctx, cfg, provider))
+
+	_, err = os.Stat(filepath.Join(cfg.Destination.Path, "config", "server.lua"))
+	assert.True(t, os.IsNotExist(err))
+
+	status, err = loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+	require.NoError(t, err)
+	assert.NotContains(t, status.CoppiedFiles, filepath.Join("config", "server.lua"))
+
+	// 🚫 a pattern that matches nothing fails instead of removing every file
+	cfg.ArchiveArgs.FilePatterns = []string{"**/*.vim"}
+	err = process(ctx, cfg, provider)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no files in the archive match")
+	assert.FileExists(t, filepath.Join(cfg.Destination.Path, "config", "init.lua"))
+}
+
+// symlinkArchiveProvider serves a tarball with a symlink, which local directories never produce
+type symlinkArchiveProvider struct {
+	*MockProvider
+	t *testing.T
+}
+
+func (p *symlinkArchiveProvider) GetArchiveUrl(ctx context.Context, args Source) (string, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(p.t, tw.WriteHeader(&tar.Header{Name: "repo-abc123/lua/init.lua", Size: 10, Mode: 0644, Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte("return {}\n"))
+	require.NoError(p.t, err)
+	require.NoError(p.t, tw.WriteHeader(&tar.Header{Name: "repo-abc123/lua/link.lua", Linkname: "init.lua", Mode: 0777, Typeflag: tar.TypeSymlink}))
+	require.NoError(p.t, tw.Close())
+	require.NoError(p.t, gw.Close())
+
+	path := filepath.Join(p.t.TempDir(), "repo.tar.gz")
+	require.NoError(p.t, os.WriteFile(path, buf.Bytes(), 0644))
+	return "file://" + path, nil
+}
+
+func TestProcess_ExtractArchiveSymlinks(t *testing.T) {
+	logger := newTestLogger(t)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	cfg := &SingleConfig{
+		Source:      Source{Repo: "github.com/test/repo", Ref: "main", Path: "lua"},
+		Destination: Destination{Path: t.TempDir()},
+		ArchiveArgs: &ArchiveEntry_Options{Extract: true},
+	}
+	mock := NewMockProvider(t)
+	mock.AddFile("lua/init.lua", []byte("return {}\n"))
+	require.NoError(t, process(ctx, cfg, &symlinkArchiveProvider{MockProvider: mock, t: t}))
+
+	assert.FileExists(t, filepath.Join(cfg.Destination.Path, "init.lua"))
+	assert.NoFileExists(t, filepath.Join(cfg.Destination.Path, "link.lua"))
+	assert.Contains(t, logger.CopyOfCurrentConsoleOutputInTest(), "skipped 1 symlinks, only regular files are extracted: lua/link.lua")
+}
+
+func TestProcess_RepackArchive(t *testing.T) {
+	upstream := filepath.Join(t.TempDir(), "upstream")
+	writeTestFiles(t, upstream, map[string]string{
+		"README.md":      "# upstream\n",
+		"lua/init.lua":   "return {}\n",
+		"doc/manual.txt": "manual\n",
+	})
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	cfg := &SingleConfig{
+		Source:      Source{Repo: upstream},
+		Destination: Destination{Path: t.TempDir()},
+		ArchiveArgs: &ArchiveEntry_Options{FilePatterns: []string{"lua/**"}},
+	}
+
+	provider, err := NewLocalProvider()
+	require.NoError(t, err)
+	require.NoError(t, process(ctx, cfg, provider))
+
+	data, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "upstream.tar.gz"))
+	require.NoError(t, err)
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "upstream/lua/init.lua", hdr.Name)
+	_, err = tr.Next()
+	assert.Equal(t, io.EOF, err, "only the matching file should be kept")
+}
+
+func TestProcess_Checksums(t *testing.T) {
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	newConfig := func(t *testing.T) (*MockProvider, *SingleConfig) {
+		mock := NewMockProvider(t)
+		mock.AddFile("a.go", []byte("package a\n"))
+		mock.AddFile("b.go", []byte("package b\n"))
+		return mock, &SingleConfig{
+			Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+			Destination: Destination{Path: t.TempDir()},
+			CopyArgs:    &CopyEntry_Options{},
+		}
+	}
+
+	t.Run("recorded", func(t *testing.T) {
+		mock, cfg := newConfig(t)
+		require.NoError(t, process(ctx, cfg, mock))
+
+		status, err := loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+		require.NoError(t, err)
+		assert.Equal(t, sha256Hex([]byte("package a\n")), status.CoppiedFiles["a.go"].Sha256)
+	})
+
+	t.Run("same_commit_mismatch", func(t *testing.T) {
+		mock, cfg := newConfig(t)
+		require.NoError(t, process(ctx, cfg, mock))
+
+		// 😈 the same commit now serves different content
+		mock.AddFile("a.go", []byte("package a // tampered\n"))
+		cfg.Flags.Force = true
+
+		err := process(ctx, cfg, mock)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "checksum mismatch for a.go")
+	})
+
+	t.Run("new_commit", func(t *testing.T) {
+		mock, cfg := newConfig(t)
+		require.NoError(t, process(ctx, cfg, mock))
+
+		mock.AddFile("a.go", []byte("package a // changed\n"))
+		mock.commitHash = "def456"
+		require.NoError(t, process(ctx, cfg, mock), "new commits are allowed to change content")
+	})
+
+	t.Run("frozen", func(t *testing.T) {
+		mock, cfg := newConfig(t)
+		cfg.Flags.Frozen = true
+
+		err := process(ctx, cfg, mock)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no lock file")
+
+		cfg.Flags.Frozen = false
+		require.NoError(t, process(ctx, cfg, mock))
+
+		cfg.Flags.Frozen = true
+		mock.fetched = nil
+		require.NoError(t, process(ctx, cfg, mock))
+		assert.ElementsMatch(t, []string{"a.go", "b.go"}, mock.fetched, "frozen runs check every file")
+
+		mock.AddFile("b.go", []byte("package b // tampered\n"))
+		err = process(ctx, cfg, mock)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "checksum mismatch for b.go")
+
+		mock.commitHash = "def456"
+		err = process(ctx, cfg, mock)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "lock file has abc123")
+	})
+
+	t.Run("frozen_missing_digest", func(t *testing.T) {
+		mock, cfg := newConfig(t)
+		require.NoError(t, process(ctx, cfg, mock))
+
+		lockPath := filepath.Join(cfg.Destination.Path, ".copyrc.lock")
+		status, err := loadStatusFile(lockPath)
+		require.NoError(t, err)
+		entry := status.CoppiedFiles["a.go"]
+		entry.Sha256 = ""
+		status.CoppiedFiles["a.go"] = entry
+		data, err := json.Marshal(status)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(lockPath, data, 0644))
+
+		cfg.Flags.Frozen = true
+		err = process(ctx, cfg, mock)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no sha256 for a.go")
+	})
+
+	t.Run("archive_pin", func(t *testing.T) {
+		upstream := filepath.Join(t.TempDir(), "upstream")
+		writeTestFiles(t, upstream, map[string]string{"init.lua": "return {}\n"})
+
+		provider, err := NewLocalProvider()
+		require.NoError(t, err)
+		data, err := GetFileFromTarball(ctx, provider, Source{Repo: upstream})
+		require.NoError(t, err)
+
+		cfg := &SingleConfig{
+			Source:      Source{Repo: upstream, Sha256: sha256Hex([]byte("something else"))},
+			Destination: Destination{Path: t.TempDir()},
+			ArchiveArgs: &ArchiveEntry_Options{},
+		}
+		err = process(ctx, cfg, provider)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "expected sha256")
+
+		cfg.Source.Sha256 = sha256Hex(data)
+		require.NoError(t, process(ctx, cfg, provider))
+
+		copyCfg := &SingleConfig{
+			Source:      Source{Repo: upstream, Sha256: sha256Hex(data)},
+			Destination: Destination{Path: t.TempDir()},
+			CopyArgs:    &CopyEntry_Options{},
+		}
+		require.Error(t, process(ctx, copyCfg, provider), "sha256 is only for archives")
+	})
+}
@@ -1,9 +1,20 @@
 package main
 
-import "context"
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
 
 type ProviderFile struct {
 	Path string `json:"path"`
+	Sha  string `json:"sha,omitempty"` // git blob sha of the file, when the provider knows it
+
+	Imported bool `json:"-"` // pulled in by go follow_imports, copied even when file_patterns leave it out
 }
 
 // 🌐 RepoProvider interface for different Git providers
@@ -21,3 +32,175 @@ type RepoProvider interface {
 	// GetFile returns the contents of a file
 	GetLicense(ctx context.Context, args Source, commitHash string) (LicenseEntry, error)
 }
+
+// 🔀 ProviderResolver picks the RepoProvider that serves a source
+type ProviderResolver interface {
+	ProviderFor(src Source) (RepoProvider, error)
+}
+
+// 🗂️ ProviderRegistry resolves providers from the host in Source.Repo, creating one per host
+type ProviderRegistry struct {
+	configs map[string]ProviderConfig
+
+	mu        sync.Mutex
+	providers map[string]RepoProvider
+}
+
+// NewProviderRegistry creates a registry, configs override the provider used for their host
+func NewProviderRegistry(configs []*ProviderConfig) (*ProviderRegistry, error) {
+	r := &ProviderRegistry{
+		configs:   make(map[string]ProviderConfig),
+		providers: make(map[string]RepoProvider),
+	}
+
+	for _, cfg := range configs {
+		if cfg == nil {
+			continue
+		}
+		switch cfg.Type {
+		case "github", "gitlab", "git", "goproxy", "npm":
+		default:
+			return nil, errors.Errorf("provider %s: unknown type %q (expected github, gitlab, git, goproxy or npm)", cfg.Host, cfg.Type)
+		}
+		if cfg.Type == "git" && cfg.TokenEnv != "" {
+			return nil, errors.Errorf("provider %s: token_env is not supported for git providers, configure git credentials instead", cfg.Host)
+		}
+		if cfg.Type == "goproxy" && cfg.TokenEnv != "" {
+			return nil, errors.Errorf("provider %s: token_env is not supported for goproxy providers, use credentials in base_url or .netrc instead", cfg.Host)
+		}
+		if cfg.Type != "github" && (cfg.APIURL != "" || cfg.RawURL != "") {
+			return nil, errors.Errorf("provider %s: api_url and raw_url are only supported for github providers", cfg.Host)
+		}
+		if _, ok := r.configs[cfg.Host]; ok {
+			return nil, errors.Errorf("provider %s: configured more than once", cfg.Host)
+		}
+		r.configs[cfg.Host] = *cfg
+	}
+
+	return r, nil
+}
+
+// repoHost returns the key a repository is registered under: its host, file:// for local
+// remotes and paths, go: for go modules or npm: for npm packages
+func repoHost(repo string) string {
+	repo = strings.TrimPrefix(repo, "From ")
+
+	for _, prefix := range []string{"go:", "npm:"} {
+		if strings.HasPrefix(repo, prefix) {
+			return prefix
+		}
+	}
+
+	if strings.HasPrefix(repo, "file://") || isLocalPath(repo) {
+		return "file://"
+	}
+
+	if strings.Contains(repo, "://") {
+		if u, err := url.Parse(repo); err == nil {
+			return u.Hostname()
+		}
+	}
+
+	// scp-like syntax: user@host:path
+	if _, err := parseGitRemote(repo); err == nil {
+		_, rest, _ := strings.Cut(repo, "@")
+		host, _, _ := strings.Cut(rest, ":")
+		return host
+	}
+
+	host, _, _ := strings.Cut(repo, "/")
+	return host
+}
+
+// providerConfigFor returns the configuration for the host of src.Repo, falling back to the built-in defaults
+func (r *ProviderRegistry) providerConfigFor(src Source) (ProviderConfig, error) {
+	repo := src.Repo
+	host := repoHost(repo)
+	if cfg, ok := r.configs[host]; ok {
+		return cfg, nil
+	}
+
+	// local directories are copied as they are on disk, file:// urls of bare repositories
+	// only have commits to offer so they are cloned by the git provider
+	if isLocalPath(repo) {
+		return ProviderConfig{Host: host, Type: "local"}, nil
+	}
+	if host == "file://" {
+		if dir, err := parseLocalRepo(repo); err == nil && !isBareGitRepo(dir) {
+			return ProviderConfig{Host: host, Type: "local"}, nil
+		}
+	}
+
+	if _, err := parseGitRemote(repo); err == nil {
+		return ProviderConfig{Host: host, Type: "git"}, nil
+	}
+
+	// a per-entry base_url is only read by the gitlab provider, self-hosted instances are
+	// usually served from a gitlab.* host
+	if src.BaseURL != "" || strings.HasPrefix(host, "gitlab.") {
+		return ProviderConfig{Host: host, Type: "gitlab"}, nil
+	}
+
+	switch host {
+	case "github.com":
+		return ProviderConfig{Host: host, Type: "github"}, nil
+	case "go:":
+		return ProviderConfig{Host: host, Type: "goproxy"}, nil
+	case "npm:":
+		return ProviderConfig{Host: host, Type: "npm"}, nil
+	}
+
+	return ProviderConfig{}, errors.Errorf("no provider for repository %s - add a provider \"%s\" block", repo, host)
+}
+
+// repoBaseName returns the name archives of repo are stored under, the last path element without a go: or npm: prefix
+func repoBaseName(repo string) string {
+	for _, prefix := range []string{"go:", "npm:"} {
+		repo = strings.TrimPrefix(repo, prefix)
+	}
+	return filepath.Base(repo)
+}
+
+func (r *ProviderRegistry) ProviderFor(src Source) (RepoProvider, error) {
+	cfg, err := r.providerConfigFor(src)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// local directories and bare repositories share the file:// host
+	key := cfg.Type + ":" + cfg.Host
+	if provider, ok := r.providers[key]; ok {
+		return provider, nil
+	}
+
+	var provider RepoProvider
+	switch cfg.Type {
+	case "github":
+		provider, err = NewGithubProviderWithOptions(GithubProviderOptions{
+			Host:     cfg.Host,
+			APIURL:   cfg.APIURL,
+			RawURL:   cfg.RawURL,
+			WebURL:   cfg.BaseURL,
+			TokenEnv: cfg.TokenEnv,
+		})
+	case "gitlab":
+		provider, err = NewGitlabProvider(cfg.BaseURL, cfg.TokenEnv)
+	case "git":
+		provider, err = NewGitProvider("", cfg.BaseURL)
+	case "goproxy":
+		provider, err = NewGoproxyProvider(cfg.BaseURL)
+	case "local":
+		provider, err = NewLocalProvider()
+	case "npm":
+		provider, err = NewNpmProvider(cfg.BaseURL, cfg.TokenEnv)
+	}
+	if err != nil {
+		return nil, errors.Errorf("creating %s provider for %s: %w", cfg.Type, cfg.Host, err)
+	}
+
+	r.providers[key] = provider
+	return provider, nil
+}
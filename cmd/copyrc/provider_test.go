@@ -0,0 +1,134 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepoHost(t *testing.T) {
+	tests := []struct {
+		repo string
+		want string
+	}{
+		{repo: "github.com/org/repo", want: "github.com"},
+		{repo: "From github.com/org/repo", want: "github.com"},
+		{repo: "gitlab.corp.example/group/sub/repo", want: "gitlab.corp.example"},
+		{repo: "https://git.corp.example/org/repo.git", want: "git.corp.example"},
+		{repo: "ssh://git@git.corp.example:2222/org/repo.git", want: "git.corp.example"},
+		{repo: "git@git.corp.example:org/repo.git", want: "git.corp.example"},
+		{repo: "file:///srv/git/repo.git", want: "file://"},
+		{repo: "go:golang.org/x/mod", want: "go:"},
+		{repo: "../upstream", want: "file://"},
+		{repo: "npm:@vscode/l10n", want: "npm:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.repo, func(t *testing.T) {
+			assert.Equal(t, tt.want, repoHost(tt.repo))
+		})
+	}
+}
+
+func TestProviderRegistry(t *testing.T) {
+	registry, err := NewProviderRegistry([]*ProviderConfig{
+		{Host: "gitlab.corp.example", Type: "gitlab", BaseURL: "https://gitlab.corp.example", TokenEnv: "CORP_GITLAB_TOKEN"},
+		{Host: "mirror.corp.example", Type: "git"},
+		{Host: "github.corp.example", Type: "github", TokenEnv: "CORP_GITHUB_TOKEN"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		repo    string
+		baseURL string
+		want    any
+		wantErr bool
+	}{
+		{name: "github", repo: "github.com/org/repo", want: &GithubProvider{}},
+		{name: "gitlab", repo: "gitlab.com/group/sub/repo", want: &GitlabProvider{}},
+		{name: "configured_gitlab", repo: "gitlab.corp.example/group/repo", want: &GitlabProvider{}},
+		{name: "self_hosted_gitlab", repo: "gitlab.other.example/group/repo", want: &GitlabProvider{}},
+		{name: "gitlab_base_url", repo: "code.other.example/group/repo", baseURL: "https://code.other.example", want: &GitlabProvider{}},
+		{name: "configured_github", repo: "github.corp.example/org/repo", want: &GithubProvider{}},
+		{name: "configured_git_host", repo: "mirror.corp.example/org/repo", want: &GitProvider{}},
+		{name: "git_remote", repo: "git@git.example.com:org/repo.git", want: &GitProvider{}},
+		{name: "file_remote", repo: "file:///srv/git/repo.git", want: &GitProvider{}},
+		{name: "go_module", repo: "go:golang.org/x/mod", want: &GoproxyProvider{}},
+		{name: "npm_package", repo: "npm:vscode-jsonrpc", want: &NpmProvider{}},
+		{name: "local_path", repo: "../upstream", want: &LocalProvider{}},
+		{name: "local_dir", repo: "file://" + t.TempDir(), want: &LocalProvider{}},
+		{name: "unknown_host", repo: "example.com/org/repo", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := registry.ProviderFor(Source{Repo: tt.repo, BaseURL: tt.baseURL})
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "provider \"example.com\"")
+				return
+			}
+			require.NoError(t, err)
+			assert.IsType(t, tt.want, provider)
+
+			again, err := registry.ProviderFor(Source{Repo: tt.repo, BaseURL: tt.baseURL})
+			require.NoError(t, err)
+			assert.Same(t, provider, again, "providers should be reused per host")
+		})
+	}
+
+	t.Run("per_host_config", func(t *testing.T) {
+		corp, err := registry.ProviderFor(Source{Repo: "gitlab.corp.example/group/repo"})
+		require.NoError(t, err)
+		public, err := registry.ProviderFor(Source{Repo: "gitlab.com/group/repo"})
+		require.NoError(t, err)
+
+		assert.NotSame(t, corp, public, "each host should get its own provider")
+		assert.Equal(t, "CORP_GITLAB_TOKEN", corp.(*GitlabProvider).tokenEnv)
+		assert.Equal(t, "https://gitlab.corp.example", corp.(*GitlabProvider).baseURL)
+		assert.Equal(t, "GITLAB_TOKEN", public.(*GitlabProvider).tokenEnv)
+
+		enterprise, err := registry.ProviderFor(Source{Repo: "github.corp.example/org/repo"})
+		require.NoError(t, err)
+		assert.Equal(t, "https://github.corp.example/api/v3", enterprise.(*GithubProvider).apiURL)
+		assert.Equal(t, "https://github.corp.example/raw", enterprise.(*GithubProvider).rawURL)
+		assert.Equal(t, "CORP_GITHUB_TOKEN", enterprise.(*GithubProvider).tokenEnv)
+	})
+}
+
+func TestNewProviderRegistry_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []*ProviderConfig
+		errMsg  string
+	}{
+		{name: "unknown_type", configs: []*ProviderConfig{{Host: "a.example", Type: "bitbucket"}}, errMsg: "unknown type"},
+		{name: "duplicate_host", configs: []*ProviderConfig{{Host: "a.example", Type: "git"}, {Host: "a.example", Type: "gitlab"}}, errMsg: "more than once"},
+		{name: "gitlab_with_api_url", configs: []*ProviderConfig{{Host: "a.example", Type: "gitlab", APIURL: "https://a.example/api"}}, errMsg: "api_url"},
+		{name: "git_with_token", configs: []*ProviderConfig{{Host: "a.example", Type: "git", TokenEnv: "TOKEN"}}, errMsg: "token_env"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewProviderRegistry(tt.configs)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
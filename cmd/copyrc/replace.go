@@ -0,0 +1,192 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// 🔁 replacer is a Replacement ready to apply to a file
+type replacer struct {
+	Replacement
+	re       *regexp.Regexp // nil for literal replacements
+	from, to int            // 1-based inclusive line range of the upstream file, 0 when open
+}
+
+// compile checks the pattern, count and line range of r
+func (r Replacement) compile() (*replacer, error) {
+	c := &replacer{Replacement: r}
+
+	if r.Old == "" {
+		return nil, errors.New("replacement has an empty old value")
+	}
+
+	if r.Regex {
+		re, err := regexp.Compile(r.Old)
+		if err != nil {
+			return nil, errors.Errorf("compiling replacement %q: %w", r.Old, err)
+		}
+		c.re = re
+	}
+
+	if r.Count < 0 {
+		return nil, errors.Errorf("replacement %q: count must not be negative", r.Old)
+	}
+
+	from, to, err := parseLineRange(r.LineRange)
+	if err != nil {
+		return nil, errors.Errorf("replacement %q: %w", r.Old, err)
+	}
+	c.from, c.to = from, to
+
+	return c, nil
+}
+
+// parseLineRange parses "10-20", "10-", "-20" or "7" into 1-based inclusive bounds, 0 for an open end
+func parseLineRange(s string) (int, int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, 0, nil
+	}
+
+	parse := func(part string) (int, error) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 1 {
+			return 0, errors.Errorf("invalid line range %q", s)
+		}
+		return n, nil
+	}
+
+	fromPart, toPart, isRange := strings.Cut(s, "-")
+	from, err := parse(fromPart)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return from, from, nil
+	}
+	to, err := parse(toPart)
+	if err != nil {
+		return 0, 0, err
+	}
+	if to != 0 && from > to {
+		return 0, 0, errors.Errorf("invalid line range %q", s)
+	}
+	return from, to, nil
+}
+
+// validateReplacements compiles every replacement of args so a bad pattern fails before any download
+func validateReplacements(args *CopyEntry_Options) error {
+	if args == nil {
+		return nil
+	}
+	for _, r := range args.Replacements {
+		if _, err := r.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply replaces the matches of r in content. lineOffset is the number of lines in front of the
+// upstream file (the copyrc header), line ranges count from after it. It returns the new content,
+// the number of replacements and the (content) line of each replacement.
+func (r *replacer) apply(content []byte, lineOffset int) ([]byte, int, []int) {
+	var matches [][]int
+	if r.re != nil {
+		matches = r.re.FindAllSubmatchIndex(content, -1)
+	} else {
+		old := []byte(r.Old)
+		for start := 0; ; {
+			i := bytes.Index(content[start:], old)
+			if i < 0 {
+				break
+			}
+			matches = append(matches, []int{start + i, start + i + len(old)})
+			start += i + len(old)
+		}
+	}
+
+	var out bytes.Buffer
+	var lines []int
+	prev, line, lineStart := 0, 1, 0
+	for _, m := range matches {
+		if r.Count > 0 && len(lines) >= r.Count {
+			break
+		}
+
+		line += bytes.Count(content[lineStart:m[0]], []byte("\n"))
+		lineStart = m[0]
+		if r.from > 0 || r.to > 0 {
+			upstream := line - lineOffset
+			if upstream < max(r.from, 1) {
+				continue
+			}
+			if r.to > 0 && upstream > r.to {
+				break
+			}
+		}
+
+		out.Write(content[prev:m[0]])
+		if r.re != nil {
+			out.Write(r.re.Expand(nil, []byte(r.New), content, m))
+		} else {
+			out.WriteString(r.New)
+		}
+		prev = m[1]
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return content, 0, nil
+	}
+	out.Write(content[prev:])
+	return out.Bytes(), len(lines), lines
+}
+
+// checkRequiredReplacements fails when a required replacement of args matched none of entries,
+// the files of one copy. This is how upstream drift shows up.
+func checkRequiredReplacements(args *CopyEntry_Options, entries []StatusEntry) error {
+	if args == nil {
+		return nil
+	}
+
+	matched := make(map[int]bool)
+	for _, entry := range entries {
+		for _, i := range entry.MatchedReplacements {
+			matched[i] = true
+		}
+	}
+
+	var missing []string
+	for i, r := range args.Replacements {
+		if r.Required && !matched[i] {
+			missing = append(missing, fmt.Sprintf("%q", r.Old))
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("required replacements matched nothing, upstream may have changed: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderCopy_Replacements(t *testing.T) {
+	const upstream = `package y
+
+import (
+	"github.com/x/y/v2/internal/a"
+	"github.com/x/y/v2/b"
+)
+
+func Foo() { FooBar(); Foo() }
+`
+
+	tests := []struct {
+		name         string
+		replacements []Replacement
+		want         string
+		count        int
+		changes      []string
+	}{
+		{
+			name:         "literal",
+			replacements: []Replacement{{Old: "Foo", New: "Baz"}},
+			want: `package y
+
+import (
+	"github.com/x/y/v2/internal/a"
+	"github.com/x/y/v2/b"
+)
+
+func Baz() { BazBar(); Baz() }
+`,
+			count:   3,
+			changes: []string{"Line 8: Replaced 'Foo' with 'Baz'"},
+		},
+		{
+			name:         "regex_groups",
+			replacements: []Replacement{{Old: `github\.com/x/y/v\d+/(\S+)"`, New: `example.com/fork/$1"`, Regex: true}},
+			want: `package y
+
+import (
+	"example.com/fork/internal/a"
+	"example.com/fork/b"
+)
+
+func Foo() { FooBar(); Foo() }
+`,
+			count: 2,
+		},
+		{
+			name:         "word_boundary",
+			replacements: []Replacement{{Old: `\bFoo\b`, New: "Baz", Regex: true}},
+			want: `package y
+
+import (
+	"github.com/x/y/v2/internal/a"
+	"github.com/x/y/v2/b"
+)
+
+func Baz() { FooBar(); Baz() }
+`,
+			count: 2,
+		},
+		{
+			name:         "count",
+			replacements: []Replacement{{Old: "Foo", New: "Baz", Count: 1}},
+			want: `package y
+
+import (
+	"github.com/x/y/v2/internal/a"
+	"github.com/x/y/v2/b"
+)
+
+func Baz() { FooBar(); Foo() }
+`,
+			count: 1,
+		},
+		{
+			name:         "line_range",
+			replacements: []Replacement{{Old: "github.com/x/y/v2", New: "example.com/y", LineRange: "5-"}},
+			want: `package y
+
+import (
+	"github.com/x/y/v2/internal/a"
+	"example.com/y/b"
+)
+
+func Foo() { FooBar(); Foo() }
+`,
+			count:   1,
+			changes: []string{"Line 5: Replaced 'github.com/x/y/v2' with 'example.com/y'"},
+		},
+		{
+			name:         "no_match",
+			replacements: []Replacement{{Old: "Nope", New: "Yes"}},
+			want:         upstream,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderCopy("y.go", "", "", []byte(upstream), &CopyEntry_Options{
+				Replacements:     tt.replacements,
+				NoHeaderComments: true,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(got.content))
+			assert.Equal(t, tt.count, got.replacementCount)
+			if tt.changes != nil {
+				assert.Equal(t, tt.changes, got.changes)
+			}
+			if tt.count > 0 {
+				assert.Equal(t, []int{0}, got.matched)
+			} else {
+				assert.Empty(t, got.matched)
+			}
+		})
+	}
+
+	t.Run("line_range_skips_header", func(t *testing.T) {
+		got, err := renderCopy("y.go", "https://example.com/y.go", "MIT", []byte(upstream), &CopyEntry_Options{
+			Replacements: []Replacement{{Old: "Foo", New: "Baz", LineRange: "8"}},
+		})
+		require.NoError(t, err)
+		assert.Contains(t, string(got.content), "func Baz() { BazBar(); Baz() }")
+		assert.Contains(t, string(got.content), "// 🔗 source: https://example.com/y.go")
+	})
+}
+
+func TestParseLineRange(t *testing.T) {
+	tests := []struct {
+		in       string
+		from, to int
+		wantErr  bool
+	}{
+		{in: "10-20", from: 10, to: 20},
+		{in: "10-", from: 10},
+		{in: "-20", to: 20},
+		{in: "7", from: 7, to: 7},
+		{in: " 3 - 4 ", from: 3, to: 4},
+		{in: "20-10", wantErr: true},
+		{in: "0-5", wantErr: true},
+		{in: "a-b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			from, to, err := parseLineRange(tt.in)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.from, from)
+			assert.Equal(t, tt.to, to)
+		})
+	}
+}
+
+func TestProcess_RequiredReplacements(t *testing.T) {
+	ctx := NewLoggerInContext(context.Background(), NewDiscardDebugLogger(os.Stdout))
+
+	mock := NewMockProvider(t)
+	mock.AddFile("a.go", []byte("package a\n\nfunc Old() {}\n"))
+	mock.AddFile("b.go", []byte("package b\n"))
+
+	cfg := &SingleConfig{
+		Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+		Destination: Destination{Path: t.TempDir()},
+		CopyArgs: &CopyEntry_Options{Replacements: []Replacement{
+			{Old: `\bOld\b`, New: "New", Regex: true, Required: true},
+		}},
+	}
+	require.NoError(t, process(ctx, cfg, mock))
+
+	content, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "a.go"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "func New() {}")
+
+	status, err := loadStatusFile(filepath.Join(cfg.Destination.Path, ".copyrc.lock"))
+	require.NoError(t, err)
+	assert.Equal(t, []int{0}, status.CoppiedFiles["a.go"].MatchedReplacements)
+	assert.Empty(t, status.CoppiedFiles["b.go"].MatchedReplacements)
+
+	t.Run("unchanged_upstream", func(t *testing.T) {
+		require.NoError(t, process(ctx, cfg, mock), "files skipped by the incremental sync still count")
+	})
+
+	t.Run("drift", func(t *testing.T) {
+		mock.AddFile("a.go", []byte("package a\n\nfunc Renamed() {}\n"))
+		mock.commitHash = "def456"
+		defer func() { mock.commitHash = "abc123" }()
+
+		err := process(ctx, cfg, mock)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "required replacements matched nothing")
+		assert.Contains(t, err.Error(), `"\\bOld\\b"`)
+
+		content, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "a.go"))
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "func New() {}", "the failed sync wrote nothing")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		bad := *cfg
+		bad.CopyArgs = &CopyEntry_Options{Replacements: []Replacement{{Old: "(", New: "", Regex: true}}}
+		err := process(ctx, &bad, mock)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "compiling replacement")
+	})
+}
+
+func TestLoadConfig_ReplacementBlocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".copyrc.hcl")
+	require.NoError(t, os.WriteFile(path, []byte(`
+copy {
+	source {
+		repo = "github.com/org/repo"
+		ref  = "main"
+	}
+	destination {
+		path = "gen"
+	}
+	options {
+		replacements = [{ old = "foo", new = "bar" }]
+
+		replacement {
+			old        = "github.com/x/y/v2/(.*)"
+			new        = "example.com/y/$1"
+			regex      = true
+			count      = 2
+			line_range = "1-20"
+			required   = true
+			file       = "*.go"
+		}
+	}
+}
+`), 0644))
+
+	cfg, err := LoadConfig(path, Input{})
+	require.NoError(t, err)
+	require.Len(t, cfg.Copies, 1)
+
+	file := "*.go"
+	assert.Equal(t, []Replacement{
+		{Old: "foo", New: "bar"},
+		{
+			Old:       "github.com/x/y/v2/(.*)",
+			New:       "example.com/y/$1",
+			File:      &file,
+			Regex:     true,
+			Count:     2,
+			LineRange: "1-20",
+			Required:  true,
+		},
+	}, cfg.Copies[0].Options.Replacements)
+	assert.Nil(t, cfg.Copies[0].Options.ReplacementBlocks)
+}
@@ -28,13 +28,21 @@ import (
 
 // 📝 Status file entry
 type StatusEntry struct {
-	File        string    `json:"file"`
-	Source      string    `json:"source"`
-	Permalink   string    `json:"permalink"`
-	LastUpdated time.Time `json:"last_updated"`
-	Changes     []string  `json:"changes,omitempty"`
-	DiffDelta   string    `json:"diff_delta,omitempty"`
-	RemoteHash  string    `json:"remote_hash,omitempty"`
+	File         string    `json:"file"`
+	Source       string    `json:"source"`
+	Permalink    string    `json:"permalink"`
+	LastUpdated  time.Time `json:"last_updated"`
+	Changes      []string  `json:"changes,omitempty"`
+	DiffDelta    string    `json:"diff_delta,omitempty"`
+	RemoteHash   string    `json:"remote_hash,omitempty"`
+	BlobSha      string    `json:"blob_sha,omitempty"`      // upstream git blob sha, unchanged blobs are not downloaded again
+	ETag         string    `json:"etag,omitempty"`          // url sources: etag of the last download
+	LastModified string    `json:"last_modified,omitempty"` // url sources: last-modified of the last download
+	Sha256       string    `json:"sha256,omitempty"`        // sha256 of the upstream content, before headers and replacements
+	Path         string    `json:"path,omitempty"`          // path in the source repository, offline runs look it up in the download cache
+
+	MatchedReplacements []int    `json:"matched_replacements,omitempty"` // indexes of the replacements that matched, for required replacements
+	Patches             []string `json:"patches,omitempty"`              // patch files applied to the file, in order
 }
 
 type GeneratedFileEntry struct {
@@ -46,6 +54,7 @@ type StatusFileArgs struct {
 	SrcRepo     string                `json:"src_repo"`
 	SrcRef      string                `json:"src_ref"`
 	SrcPath     string                `json:"src_path,omitempty"`
+	URLs        []string              `json:"urls,omitempty"`
 	CopyArgs    *CopyEntry_Options    `json:"copy_args,omitempty"`
 	ArchiveArgs *ArchiveEntry_Options `json:"archive_args,omitempty"`
 }
@@ -56,14 +65,22 @@ type LicenseEntry struct {
 	Name      string `json:"name"`
 }
 
+// 🩹 A patch applied to the copied files, its checksum tells when it changed
+type PatchEntry struct {
+	File   string `json:"file"`
+	Sha256 string `json:"sha256"`
+}
+
 // 📦 Status file structure
 type StatusFile struct {
 	LastUpdated    time.Time                     `json:"last_updated"`
 	CommitHash     string                        `json:"commit_hash"`
+	ArchiveURL     string                        `json:"archive_url,omitempty"`
 	License        LicenseEntry                  `json:"license"`
 	Ref            string                        `json:"branch"`
 	CoppiedFiles   map[string]StatusEntry        `json:"coppied_files"`
 	GeneratedFiles map[string]GeneratedFileEntry `json:"generated_files"`
+	Patches        []PatchEntry                  `json:"patches,omitempty"`
 	Warnings       []string                      `json:"warnings,omitempty" hcl:"warnings,omitempty" yaml:"warnings,omitempty"`
 	Args           StatusFileArgs                `json:"args" hcl:"args" yaml:"args"`
 }
@@ -16,6 +16,8 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"net/http"
 	"os"
@@ -24,11 +26,6 @@ import (
 	"gitlab.com/tozd/go/errors"
 )
 
-// 📦 TarballOptions configures tarball extraction behavior
-type TarballOptions struct {
-	CacheDir string // Directory where tarballs are cached
-}
-
 // 📥 GetFileFromTarball downloads and extracts a specific file from a repository tarball
 func GetFileFromTarball(ctx context.Context, provider RepoProvider, args Source) ([]byte, error) {
 	// Validate path
@@ -45,8 +42,27 @@ func GetFileFromTarball(ctx context.Context, provider RepoProvider, args Source)
 	return data, nil
 }
 
-// 🔄 getArchiveData downloads and caches the repository tarball
-func getArchiveData(ctx context.Context, provider RepoProvider, args Source) ([]byte, error) {
+// 🌊 ArchiveStreamer is implemented by providers that download or build the archive themselves,
+// e.g. with a token or from a local checkout, instead of serving a URL
+type ArchiveStreamer interface {
+	OpenArchive(ctx context.Context, args Source) (io.ReadCloser, error)
+}
+
+// pipeArchive streams what write produces, for providers that build the archive themselves.
+// write stops with an error once the reader is closed.
+func pipeArchive(write func(w io.Writer) error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(write(pw))
+	}()
+	return pr
+}
+
+// DefaultMaxArchiveSize is the largest archive downloaded when an archive sets no max_size
+const DefaultMaxArchiveSize int64 = 4 << 30
+
+// openArchive returns the repository archive as a stream
+func openArchive(ctx context.Context, provider RepoProvider, args Source) (io.ReadCloser, error) {
 	// Get archive URL
 	url, err := provider.GetArchiveUrl(ctx, args)
 	if err != nil {
@@ -54,47 +70,259 @@ func getArchiveData(ctx context.Context, provider RepoProvider, args Source) ([]
 	}
 
 	// Read data based on URL scheme
-	var data []byte
-	if strings.HasPrefix(url, "file://") {
+	if streamer, ok := provider.(ArchiveStreamer); ok {
+		rc, err := streamer.OpenArchive(ctx, args)
+		if err != nil {
+			return nil, errors.Errorf("getting archive: %w", err)
+		}
+		return rc, nil
+	} else if strings.HasPrefix(url, "file://") {
 		// Local file URL
-		path := strings.TrimPrefix(url, "file://")
-		data, err = os.ReadFile(path)
+		f, err := os.Open(strings.TrimPrefix(url, "file://"))
 		if err != nil {
 			return nil, errors.Errorf("reading local archive: %w", err)
 		}
+		return f, nil
 	} else if strings.HasPrefix(url, "https://") {
 		// Remote HTTPS URL
-		resp, err := http.Get(url)
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, errors.Errorf("creating request: %w", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			return nil, errors.Errorf("downloading archive: %w", err)
 		}
-		defer resp.Body.Close()
 
 		if resp.StatusCode == http.StatusNotFound {
-			return nil, errors.Errorf("invalid tag or reference '%s': %w", url, err)
+			resp.Body.Close()
+			return nil, errors.Errorf("invalid tag or reference '%s'", url)
 		}
-
-		data, err = io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, errors.Errorf("reading response: %w", err)
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.Errorf("downloading archive: %s", resp.Status)
 		}
-	} else {
-		return nil, errors.Errorf("unsupported URL scheme: %s", url)
+		return resp.Body, nil
 	}
 
+	return nil, errors.Errorf("unsupported URL scheme: %s", url)
+}
+
+// checkArchiveHead rejects anything that does not start like an archive, head is the first bytes of the download
+func checkArchiveHead(head []byte, args Source) (string, error) {
 	// Check if the response is a 404 text message
-	if len(data) < 1024 && strings.Contains(string(data), "404: Not Found") {
-		return nil, errors.Errorf("invalid tag or reference '%s'", args.Ref)
+	if len(head) < 1024 && strings.Contains(string(head), "404: Not Found") {
+		return "", errors.Errorf("invalid tag or reference '%s'", args.Ref)
+	}
+
+	// Verify it's actually an archive by checking the magic number
+	return detectArchiveFormat(head)
+}
+
+// 🔄 getArchiveData downloads the repository tarball into memory
+func getArchiveData(ctx context.Context, provider RepoProvider, args Source) ([]byte, error) {
+	rc, err := openArchive(ctx, provider, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Errorf("reading response: %w", err)
 	}
 
-	// Verify it's actually a gzip file by checking magic number
-	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
-		return nil, errors.Errorf("invalid archive format - expected gzip file, got: %s", string(data[:min(len(data), 1024)]))
+	if _, err := checkArchiveHead(data[:min(len(data), 1024)], args); err != nil {
+		return nil, err
 	}
 
 	return data, nil
 }
 
+// 📄 downloadedArchive is an archive streamed to a temp file, the caller renames or removes it
+type downloadedArchive struct {
+	Path   string
+	Sha256 string
+	Size   int64
+	Format string
+}
+
+// rewrite streams a new archive, written by fn from the download, into a temp file in dir. It
+// returns the temp file and its sha256, the caller renames or removes it.
+func (d *downloadedArchive) rewrite(dir string, fn func(src io.ReaderAt, size int64, w io.Writer) error) (string, string, error) {
+	src, err := os.Open(d.Path)
+	if err != nil {
+		return "", "", errors.Errorf("opening downloaded archive: %w", err)
+	}
+	defer src.Close()
+
+	f, err := os.CreateTemp(dir, ".copyrc-download-*")
+	if err != nil {
+		return "", "", errors.Errorf("creating temp file: %w", err)
+	}
+	keep := false
+	defer func() {
+		if !keep {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	h := sha256.New()
+	if err := fn(src, d.Size, io.MultiWriter(f, h)); err != nil {
+		return "", "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", "", errors.Errorf("closing temp file: %w", err)
+	}
+
+	keep = true
+	return f.Name(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// streamToTemp copies r into a new temp file in dir (the system temp dir when empty), hashing it
+// on the way. More than maxSize bytes is an error, a maxSize of 0 means no limit.
+func streamToTemp(dir string, r io.Reader, maxSize int64) (string, string, int64, error) {
+	f, err := os.CreateTemp(dir, ".copyrc-download-*")
+	if err != nil {
+		return "", "", 0, errors.Errorf("creating temp file: %w", err)
+	}
+	keep := false
+	defer func() {
+		if !keep {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return "", "", 0, errors.Errorf("writing temp file: %w", err)
+	}
+	if maxSize > 0 && size > maxSize {
+		return "", "", 0, errors.Errorf("download is larger than the maximum size of %d bytes (set max_size to raise it)", maxSize)
+	}
+	if err := f.Close(); err != nil {
+		return "", "", 0, errors.Errorf("closing temp file: %w", err)
+	}
+
+	keep = true
+	return f.Name(), hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// downloadArchive streams the repository archive into a temp file in dir without holding it in memory
+func downloadArchive(ctx context.Context, provider RepoProvider, args Source, dir string, maxSize int64) (*downloadedArchive, error) {
+	release, err := acquireJob(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rc, err := openArchive(ctx, provider, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	path, sum, size, err := streamToTemp(dir, rc, maxSize)
+	if err != nil {
+		return nil, errors.Errorf("downloading archive: %w", err)
+	}
+
+	format, err := archiveFileFormat(path, args)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	return &downloadedArchive{Path: path, Sha256: sum, Size: size, Format: format}, nil
+}
+
+// archiveFileFormat checks the head of a downloaded archive
+func archiveFileFormat(path string, args Source) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Errorf("opening downloaded archive: %w", err)
+	}
+	defer f.Close()
+
+	head := make([]byte, 1024)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", errors.Errorf("reading downloaded archive: %w", err)
+	}
+	return checkArchiveHead(head[:n], args)
+}
+
+// fetchArchive downloads the archive of src at commitHash through the download cache in ctx
+func fetchArchive(ctx context.Context, provider RepoProvider, src Source, commitHash string, dir string, maxSize int64) (*downloadedArchive, error) {
+	cache := downloadCacheFromContext(ctx)
+	host := repoHost(src.Repo)
+	if cache == nil || commitHash == "" || host == "file://" {
+		return downloadArchive(ctx, provider, src, dir, maxSize)
+	}
+
+	// entries for the same commit wait for the first download, then copy it from the cache
+	key := CacheKey{Provider: host, Repo: src.Repo, Commit: commitHash}
+	defer cache.acquire(key)()
+
+	if object, want, ok := cache.lookupObject(key); ok {
+		dl, err := copyCachedArchive(object, want, src, dir, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		if dl != nil {
+			return dl, nil
+		}
+		// a corrupt object is downloaded again
+	}
+
+	dl, err := downloadArchive(ctx, provider, src, dir, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.storeFile(key, dl.Path, dl.Sha256); err != nil {
+		os.Remove(dl.Path)
+		return nil, errors.Errorf("caching download: %w", err)
+	}
+	return dl, nil
+}
+
+// copyCachedArchive copies a cached archive into a temp file in dir, checking it against its
+// sha256 on the way. It returns nil when the object does not match and has to be downloaded again.
+func copyCachedArchive(object string, want string, src Source, dir string, maxSize int64) (*downloadedArchive, error) {
+	f, err := os.Open(object)
+	if err != nil {
+		return nil, errors.Errorf("opening cached archive: %w", err)
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && maxSize > 0 && info.Size() > maxSize {
+		return nil, errors.Errorf("cached archive is larger than the maximum size of %d bytes (set max_size to raise it)", maxSize)
+	}
+
+	path, sum, size, err := streamToTemp(dir, f, maxSize)
+	if err != nil {
+		return nil, errors.Errorf("copying cached archive: %w", err)
+	}
+	if sum != want {
+		os.Remove(path)
+		return nil, nil
+	}
+
+	format, err := archiveFileFormat(path, src)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return &downloadedArchive{Path: path, Sha256: sum, Size: size, Format: format}, nil
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -15,9 +15,17 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"io"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -94,6 +102,66 @@ func TestTarballFunctions(t *testing.T) {
 	})
 }
 
+// 🧪 testArchive packs files below a repo-sha/ directory with the given mtime
+func testArchive(t *testing.T, mtime time.Time, names []string, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.ModTime = mtime
+	tw := tar.NewWriter(gw)
+	for _, name := range names {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "repo-abc123/" + name, Size: int64(len(files[name])), Mode: 0664, ModTime: mtime, Uname: "dev", Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(files[name]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestRepackArchive(t *testing.T) {
+	files := map[string]string{
+		"lua/lspconfig.lua":         "return {}\n",
+		"lua/configs/gopls.lua":     "return { 'gopls' }\n",
+		"lua/configs/rust.lua":      "return { 'rust' }\n",
+		"doc/configs.md":            "# configs\n",
+		"test/lspconfig_spec.lua":   "-- spec\n",
+		"lua/configs/gopls_old.lua": "-- old\n",
+	}
+	names := []string{"lua/lspconfig.lua", "lua/configs/gopls.lua", "lua/configs/rust.lua", "doc/configs.md", "test/lspconfig_spec.lua", "lua/configs/gopls_old.lua"}
+
+	repack := func(src io.ReaderAt, size int64, w io.Writer) error {
+		return repackArchive(src, size, w, ArchiveFormatTarGz, []string{"lua/**"}, []string{"**/*_old.lua"})
+	}
+	first := rewriteTestArchive(t, testArchive(t, time.Now(), names, files), repack)
+
+	// same contents, packed later and in another order
+	reversed := []string{}
+	for i := len(names) - 1; i >= 0; i-- {
+		reversed = append(reversed, names[i])
+	}
+	second := rewriteTestArchive(t, testArchive(t, time.Now().Add(time.Hour), reversed, files), repack)
+
+	assert.Equal(t, first, second, "repacked archives should be byte for byte identical")
+
+	gz, err := gzip.NewReader(bytes.NewReader(first))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+	var got []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		got = append(got, hdr.Name)
+		assert.Equal(t, int64(0), hdr.ModTime.Unix())
+		assert.Empty(t, hdr.Uname)
+	}
+	assert.Equal(t, []string{"repo-abc123/lua/configs/gopls.lua", "repo-abc123/lua/configs/rust.lua", "repo-abc123/lua/lspconfig.lua"}, got)
+}
+
 type MockErrorProvider struct {
 	*MockProvider
 	shouldReturn404 bool
@@ -123,3 +191,174 @@ func (m *MockErrorProvider) GetArchiveUrl(ctx context.Context, args Source) (str
 	}
 	return m.MockProvider.GetArchiveUrl(ctx, args)
 }
+
+func TestStreamToTemp(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("copyrc"), 1000)
+
+	path, sum, size, err := streamToTemp(dir, bytes.NewReader(content), int64(len(content)))
+	require.NoError(t, err)
+	assert.Equal(t, sha256Hex(content), sum)
+	assert.Equal(t, int64(len(content)), size)
+
+	written, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, content, written)
+
+	_, _, _, err = streamToTemp(dir, bytes.NewReader(content), int64(len(content))-1)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "maximum size")
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "the temp file of a rejected download is removed")
+}
+
+func TestProcess_StreamedArchive(t *testing.T) {
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	mock := NewMockProvider(t)
+	mock.AddFile("a.go", []byte("package a\n"))
+
+	cfg := &SingleConfig{
+		Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+		Destination: Destination{Path: t.TempDir()},
+		ArchiveArgs: &ArchiveEntry_Options{},
+	}
+	require.NoError(t, process(ctx, cfg, mock))
+
+	stored, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "repo.tar.gz"))
+	require.NoError(t, err)
+
+	status, err := loadStatusFile(filepath.Join(cfg.statusDir(), ".copyrc.lock"))
+	require.NoError(t, err)
+	entry := status.CoppiedFiles["repo.tar.gz"]
+	assert.Equal(t, sha256Hex(stored), entry.Sha256, "the download is stored as is")
+	assert.NotEmpty(t, entry.RemoteHash)
+
+	entries, err := os.ReadDir(cfg.Destination.Path)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.NotContains(t, e.Name(), ".copyrc-download-", "no temp files are left behind")
+	}
+
+	t.Run("max_size", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+			Destination: Destination{Path: t.TempDir()},
+			ArchiveArgs: &ArchiveEntry_Options{MaxSize: "16B"},
+		}
+		err := process(ctx, cfg, mock)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "maximum size")
+
+		_, err = os.Stat(filepath.Join(cfg.Destination.Path, "repo.tar.gz"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("converted", func(t *testing.T) {
+		cfg := &SingleConfig{
+			Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+			Destination: Destination{Path: t.TempDir()},
+			ArchiveArgs: &ArchiveEntry_Options{Format: ArchiveFormatZip},
+		}
+		require.NoError(t, process(ctx, cfg, mock))
+
+		stored, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "repo.zip"))
+		require.NoError(t, err)
+		files, err := readArchive(stored)
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		assert.Equal(t, "package a\n", string(files[0].Data))
+
+		status, err := loadStatusFile(filepath.Join(cfg.statusDir(), ".copyrc.lock"))
+		require.NoError(t, err)
+		entry := status.CoppiedFiles["repo.zip"]
+		assert.Len(t, entry.Sha256, 64)
+		assert.NotEqual(t, sha256Hex(stored), entry.Sha256, "the lock file has the digest of the download, not of the converted archive")
+		assert.Equal(t, hashContents(stored), entry.RemoteHash)
+
+		entries, err := os.ReadDir(cfg.Destination.Path)
+		require.NoError(t, err)
+		for _, e := range entries {
+			assert.NotContains(t, e.Name(), ".copyrc-download-", "no temp files are left behind")
+		}
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		cache, err := NewDownloadCache(t.TempDir())
+		require.NoError(t, err)
+		ctx := NewDownloadCacheInContext(ctx, cache)
+
+		cfg := &SingleConfig{
+			Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+			Destination: Destination{Path: t.TempDir()},
+			ArchiveArgs: &ArchiveEntry_Options{},
+		}
+		require.NoError(t, process(ctx, cfg, mock))
+
+		object, _, ok := cache.lookupObject(CacheKey{Provider: repoHost(cfg.Source.Repo), Repo: cfg.Source.Repo, Commit: "abc123"})
+		require.True(t, ok)
+
+		limited := &SingleConfig{Source: cfg.Source, Destination: Destination{Path: t.TempDir()}, ArchiveArgs: &ArchiveEntry_Options{MaxSize: "16B"}}
+		err = process(ctx, limited, mock)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "maximum size", "max_size applies to cached archives too")
+
+		require.NoError(t, os.WriteFile(object, []byte("corrupt"), 0644))
+		fresh := &SingleConfig{Source: cfg.Source, Destination: Destination{Path: t.TempDir()}, ArchiveArgs: &ArchiveEntry_Options{}}
+		require.NoError(t, process(ctx, fresh, mock), "a corrupt cached archive is downloaded again")
+
+		stored, err := os.ReadFile(filepath.Join(fresh.Destination.Path, "repo.tar.gz"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x1f, 0x8b}, stored[0:2])
+	})
+
+	t.Run("cached_concurrent", func(t *testing.T) {
+		cache, err := NewDownloadCache(t.TempDir())
+		require.NoError(t, err)
+		ctx := NewDownloadCacheInContext(ctx, cache)
+
+		slow := &slowArchiveProvider{MockProvider: mock, release: make(chan struct{})}
+
+		var wg sync.WaitGroup
+		for range 3 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				cfg := &SingleConfig{
+					Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+					Destination: Destination{Path: t.TempDir()},
+					ArchiveArgs: &ArchiveEntry_Options{},
+				}
+				assert.NoError(t, process(ctx, cfg, slow))
+			}()
+		}
+
+		// let the entries pile up on the first download
+		time.Sleep(50 * time.Millisecond)
+		close(slow.release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), slow.opens.Load(), "entries for the same commit share one download")
+	})
+}
+
+// 🧪 slowArchiveProvider streams the mock archive once release is closed, counting the downloads
+type slowArchiveProvider struct {
+	*MockProvider
+	opens   atomic.Int32
+	release chan struct{}
+}
+
+func (p *slowArchiveProvider) OpenArchive(ctx context.Context, args Source) (io.ReadCloser, error) {
+	p.opens.Add(1)
+	<-p.release
+
+	data, err := p.GetArchiveData()
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
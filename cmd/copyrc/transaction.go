@@ -0,0 +1,351 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// stagingPrefix marks the temp files of a transaction, they never count as untracked files
+const stagingPrefix = ".copyrc-staged-"
+
+// 🧾 transaction stages the writes and removals of one entry. Nothing in the destination
+// changes until commit swaps every file in, the lock file last. An error or interrupt
+// before that rolls back by dropping the staged files.
+type transaction struct {
+	mu      sync.Mutex
+	writes  map[string]string // target path -> staged temp file
+	removes map[string]bool
+	dirs    []string // directories created for staged files, removed again on rollback
+	done    bool
+}
+
+// applied is a step of a commit, undone in reverse when a later step fails
+type applied struct {
+	target string
+	backup string // previous file, empty when there was none
+	added  bool   // target is a new file, not a removal
+}
+
+func newTransaction() *transaction {
+	return &transaction{
+		writes:  make(map[string]string),
+		removes: make(map[string]bool),
+	}
+}
+
+type transactionContextKey struct{}
+
+func withTransaction(ctx context.Context, tx *transaction) context.Context {
+	return context.WithValue(ctx, transactionContextKey{}, tx)
+}
+
+func transactionFromContext(ctx context.Context) *transaction {
+	tx, _ := ctx.Value(transactionContextKey{}).(*transaction)
+	return tx
+}
+
+// inTransaction runs fn with a transaction in its context and commits it when fn succeeds
+// and ctx has not been canceled
+func inTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	tx := newTransaction()
+	if err := fn(withTransaction(ctx, tx)); err != nil {
+		tx.rollback()
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		tx.rollback()
+		return errors.Errorf("interrupted, nothing was written: %w", err)
+	}
+	return tx.commit()
+}
+
+// putFile writes data to path, staged in the transaction of ctx when there is one
+func putFile(ctx context.Context, path string, data []byte) error {
+	tx := transactionFromContext(ctx)
+	if tx == nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errors.Errorf("creating directory for %s: %w", path, err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return errors.Errorf("writing file %s: %w", path, err)
+		}
+		return nil
+	}
+
+	if err := tx.mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), stagingPrefix+"*")
+	if err != nil {
+		return errors.Errorf("staging %s: %w", path, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Errorf("staging %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Errorf("staging %s: %w", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Errorf("staging %s: %w", path, err)
+	}
+
+	tx.stage(path, tmp.Name())
+	return nil
+}
+
+// readFile reads path as the transaction of ctx will leave it, staged writes included
+func readFile(ctx context.Context, path string) ([]byte, error) {
+	if tx := transactionFromContext(ctx); tx != nil {
+		tx.mu.Lock()
+		staged, ok := tx.writes[path]
+		removed := tx.removes[path]
+		tx.mu.Unlock()
+		if ok {
+			return os.ReadFile(staged)
+		}
+		if removed {
+			return nil, errors.Errorf("reading %s: %w", path, os.ErrNotExist)
+		}
+	}
+	return os.ReadFile(path)
+}
+
+// moveFileInto renames temp, a file in the directory of path, to path when the transaction commits
+func moveFileInto(ctx context.Context, path string, temp string) error {
+	tx := transactionFromContext(ctx)
+	if tx == nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errors.Errorf("creating directory for %s: %w", path, err)
+		}
+		if err := os.Rename(temp, path); err != nil {
+			return errors.Errorf("moving %s into place: %w", path, err)
+		}
+		return nil
+	}
+
+	if err := tx.mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	// the staged file keeps the prefix so it is never mistaken for an untracked file
+	staged := filepath.Join(filepath.Dir(path), stagingPrefix+filepath.Base(temp))
+	if err := os.Rename(temp, staged); err != nil {
+		return errors.Errorf("staging %s: %w", path, err)
+	}
+
+	tx.stage(path, staged)
+	return nil
+}
+
+// deleteFile removes path, when the transaction commits if there is one. Like os.Remove
+// it fails for a file that does not exist.
+func deleteFile(ctx context.Context, path string) error {
+	tx := transactionFromContext(ctx)
+	if tx == nil {
+		return os.Remove(path)
+	}
+
+	if _, err := os.Lstat(path); err != nil {
+		return err
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if temp, ok := tx.writes[path]; ok {
+		os.Remove(temp)
+		delete(tx.writes, path)
+	}
+	tx.removes[path] = true
+	return nil
+}
+
+func (tx *transaction) stage(path string, temp string) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	// the last write of a file wins
+	if prev, ok := tx.writes[path]; ok {
+		os.Remove(prev)
+	}
+	delete(tx.removes, path)
+	tx.writes[path] = temp
+}
+
+// mkdirAll creates dir like os.MkdirAll, remembering the directories it created
+func (tx *transaction) mkdirAll(dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Errorf("creating directory %s: %w", dir, err)
+	}
+
+	tx.mu.Lock()
+	tx.dirs = append(tx.dirs, missing...)
+	tx.mu.Unlock()
+	return nil
+}
+
+// commit swaps the staged files in and removes the staged removals, every lock file last so a
+// destination is never described by a lock that is ahead of it. If a step fails the ones before
+// it are undone.
+func (tx *transaction) commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return nil
+	}
+	tx.done = true
+
+	targets := make([]string, 0, len(tx.writes)+len(tx.removes))
+	for target := range tx.writes {
+		targets = append(targets, target)
+	}
+	for target := range tx.removes {
+		targets = append(targets, target)
+	}
+	slices.SortFunc(targets, func(a, b string) int {
+		aLock, bLock := filepath.Base(a) == ".copyrc.lock", filepath.Base(b) == ".copyrc.lock"
+		switch {
+		case aLock && !bLock:
+			return 1
+		case !aLock && bLock:
+			return -1
+		}
+		return strings.Compare(a, b)
+	})
+
+	var steps []applied
+	for _, target := range targets {
+		step, err := tx.apply(target)
+		if err != nil {
+			undo(steps)
+			tx.dropStaged()
+			tx.removeDirs()
+			return errors.Errorf("committing %s: %w", target, err)
+		}
+		steps = append(steps, step)
+	}
+
+	for _, step := range steps {
+		if step.backup != "" {
+			os.Remove(step.backup)
+		}
+	}
+	return nil
+}
+
+// apply moves the current target aside and the staged file (if any) in
+func (tx *transaction) apply(target string) (applied, error) {
+	step := applied{target: target}
+
+	if _, err := os.Lstat(target); err == nil {
+		backup, err := backupName(target)
+		if err != nil {
+			return applied{}, err
+		}
+		if err := os.Rename(target, backup); err != nil {
+			os.Remove(backup)
+			return applied{}, err
+		}
+		step.backup = backup
+	}
+
+	if temp, ok := tx.writes[target]; ok {
+		if err := os.Rename(temp, target); err != nil {
+			if step.backup != "" {
+				os.Rename(step.backup, target)
+			}
+			return applied{}, err
+		}
+		delete(tx.writes, target)
+		step.added = true
+	}
+	return step, nil
+}
+
+// backupName reserves a name next to target to move it to during a commit
+func backupName(target string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(target), stagingPrefix+"backup-*")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+func undo(steps []applied) {
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		if step.added {
+			os.Remove(step.target)
+		}
+		if step.backup != "" {
+			os.Rename(step.backup, step.target)
+		}
+	}
+}
+
+// rollback drops everything staged, the destination is left as it was
+func (tx *transaction) rollback() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return
+	}
+	tx.done = true
+
+	tx.dropStaged()
+	tx.removeDirs()
+}
+
+func (tx *transaction) dropStaged() {
+	for _, temp := range tx.writes {
+		os.Remove(temp)
+	}
+	tx.writes = map[string]string{}
+	tx.removes = map[string]bool{}
+}
+
+// removeDirs removes the directories created for staged files, deepest first, if they are empty again
+func (tx *transaction) removeDirs() {
+	slices.SortFunc(tx.dirs, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	for _, dir := range tx.dirs {
+		os.Remove(dir)
+	}
+	tx.dirs = nil
+}
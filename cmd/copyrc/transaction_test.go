@@ -0,0 +1,159 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+)
+
+func TestTransaction(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"keep.txt":   "keep\n",
+		"old.txt":    "old\n",
+		"remove.txt": "remove\n",
+	})
+
+	stageAll := func(ctx context.Context) error {
+		if err := putFile(ctx, filepath.Join(dir, "old.txt"), []byte("new\n")); err != nil {
+			return err
+		}
+		if err := putFile(ctx, filepath.Join(dir, "sub", "added.txt"), []byte("added\n")); err != nil {
+			return err
+		}
+		if err := deleteFile(ctx, filepath.Join(dir, "remove.txt")); err != nil {
+			return err
+		}
+
+		// nothing is visible before the commit
+		content, err := os.ReadFile(filepath.Join(dir, "old.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "old\n", string(content))
+		assert.FileExists(t, filepath.Join(dir, "remove.txt"))
+		return nil
+	}
+
+	listDir := func() []string {
+		var names []string
+		require.NoError(t, filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			require.NoError(t, err)
+			if !d.IsDir() {
+				rel, _ := filepath.Rel(dir, path)
+				names = append(names, rel)
+			}
+			return nil
+		}))
+		return names
+	}
+
+	t.Run("rollback", func(t *testing.T) {
+		err := inTransaction(context.Background(), func(ctx context.Context) error {
+			if err := stageAll(ctx); err != nil {
+				return err
+			}
+			return errors.New("upstream went away")
+		})
+		require.Error(t, err)
+
+		assert.ElementsMatch(t, []string{"keep.txt", "old.txt", "remove.txt"}, listDir(), "staged files are dropped")
+		assert.NoDirExists(t, filepath.Join(dir, "sub"), "directories created for staged files are removed")
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		err := inTransaction(ctx, func(ctx context.Context) error {
+			err := stageAll(ctx)
+			cancel()
+			return err
+		})
+		require.ErrorIs(t, err, context.Canceled)
+		assert.ElementsMatch(t, []string{"keep.txt", "old.txt", "remove.txt"}, listDir())
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		require.NoError(t, inTransaction(context.Background(), stageAll))
+
+		assert.ElementsMatch(t, []string{"keep.txt", "old.txt", filepath.Join("sub", "added.txt")}, listDir(), "no staged or backup files are left")
+		content, err := os.ReadFile(filepath.Join(dir, "old.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "new\n", string(content))
+	})
+}
+
+func TestProcess_RollsBackOnError(t *testing.T) {
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	mock := NewMockProvider(t)
+	mock.AddFile("a.go", []byte("package a\n"))
+	mock.AddFile("b.go", []byte("package b\n"))
+
+	cfg := &SingleConfig{
+		Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+		Destination: Destination{Path: t.TempDir()},
+		CopyArgs:    &CopyEntry_Options{},
+	}
+	require.NoError(t, process(ctx, cfg, mock))
+
+	lockPath := filepath.Join(cfg.Destination.Path, ".copyrc.lock")
+	lock, err := os.ReadFile(lockPath)
+	require.NoError(t, err)
+	a, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "a.go"))
+	require.NoError(t, err)
+
+	// the new replacement rewrites a.go before b.go fails its checksum
+	mock.AddFile("b.go", []byte("package b // tampered\n"))
+	cfg.CopyArgs = &CopyEntry_Options{Replacements: []Replacement{{Old: "package a", New: "package aa"}}}
+
+	err = process(ctx, cfg, mock)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch for b.go")
+
+	afterA, err := os.ReadFile(filepath.Join(cfg.Destination.Path, "a.go"))
+	require.NoError(t, err)
+	assert.Equal(t, string(a), string(afterA), "a.go is rolled back")
+	afterLock, err := os.ReadFile(lockPath)
+	require.NoError(t, err)
+	assert.Equal(t, string(lock), string(afterLock), "the lock file is untouched")
+
+	entries, err := os.ReadDir(cfg.Destination.Path)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.NotContains(t, e.Name(), stagingPrefix)
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		dest := t.TempDir()
+		err := process(canceled, &SingleConfig{
+			Source:      Source{Repo: "github.com/test/repo", Ref: "main"},
+			Destination: Destination{Path: dest},
+			CopyArgs:    &CopyEntry_Options{},
+		}, NewMockProvider(t))
+		require.ErrorIs(t, err, context.Canceled)
+
+		_, err = os.Stat(filepath.Join(dest, ".copyrc.lock"))
+		assert.True(t, os.IsNotExist(err), "no lock file is written")
+	})
+}
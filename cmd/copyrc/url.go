@@ -0,0 +1,408 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// 🔗 urlResponse is the result of a (conditional) download of a url source
+type urlResponse struct {
+	body         []byte
+	etag         string
+	lastModified string
+	sha256       string
+	notModified  bool
+}
+
+// urlFileName returns the file name a url is written to, the last segment of its path
+func urlFileName(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", errors.Errorf("parsing url %s: %w", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.Errorf("invalid url %s (expected http or https)", raw)
+	}
+
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return "", errors.Errorf("url %s has no file name", raw)
+	}
+	return name, nil
+}
+
+// fetchURL downloads raw, sending the validators of prev (if any) so an unchanged file comes back as 304
+func fetchURL(ctx context.Context, raw string, prev *StatusEntry) (*urlResponse, error) {
+	release, err := acquireJob(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", raw, nil)
+	if err != nil {
+		return nil, errors.Errorf("creating request: %w", err)
+	}
+	if prev != nil {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("downloading %s: %w", raw, err)
+	}
+	defer resp.Body.Close()
+
+	res := &urlResponse{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && prev != nil:
+		res.notModified = true
+		res.sha256 = prev.Sha256
+		// servers may leave the validators out of a 304
+		if res.etag == "" {
+			res.etag = prev.ETag
+		}
+		if res.lastModified == "" {
+			res.lastModified = prev.LastModified
+		}
+		return res, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, errors.Errorf("downloading %s: %s", raw, resp.Status)
+	}
+
+	res.body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("reading %s: %w", raw, err)
+	}
+	res.sha256 = sha256Hex(res.body)
+
+	return res, nil
+}
+
+// urlCacheKey is where the download cache keeps the content of raw, urls have no commit so the digest stands in
+func urlCacheKey(raw string, sum string) CacheKey {
+	return CacheKey{Provider: "url", Repo: raw, Commit: sum}
+}
+
+// offlineURLs returns the cached content of every url in the lock file, or the list of the missing ones
+func offlineURLs(cache *DownloadCache, status *StatusFile, names map[string]string) (map[string][]byte, error) {
+	if cache == nil {
+		return nil, errors.New("offline: no download cache")
+	}
+	if len(status.Args.URLs) == 0 {
+		return nil, errors.New("offline: no lock file")
+	}
+
+	bodies := make(map[string][]byte, len(names))
+	var missing []string
+	for name, raw := range names {
+		entry, ok := status.CoppiedFiles[name]
+		if !ok || entry.Sha256 == "" {
+			missing = append(missing, raw+" (not in the lock file)")
+			continue
+		}
+		body, ok := cache.lookup(urlCacheKey(raw, entry.Sha256))
+		if !ok {
+			missing = append(missing, raw)
+			continue
+		}
+		bodies[name] = body
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return nil, errors.Errorf("offline: missing from the download cache:\n\t%s", strings.Join(missing, "\n\t"))
+	}
+	return bodies, nil
+}
+
+// sameArgs compares options by their lock file representation
+func sameArgs(a, b any) bool {
+	aj, aerr := json.Marshal(a)
+	bj, berr := json.Marshal(b)
+	return aerr == nil && berr == nil && string(aj) == string(bj)
+}
+
+// processURLs syncs a url entry. Instead of a commit hash the lock file keeps the etag,
+// last-modified and sha256 of every url, which are sent back as a conditional request.
+// Like process, the files and lock file are committed together.
+func processURLs(ctx context.Context, entry *URLEntry, flags FlagsBlock) error {
+	ctx = withJobLimit(ctx, flags.jobs())
+	return inTransaction(ctx, func(ctx context.Context) error {
+		return processURLEntry(ctx, entry, flags)
+	})
+}
+
+func processURLEntry(ctx context.Context, entry *URLEntry, flags FlagsBlock) error {
+	logger := loggerFromContext(ctx)
+
+	urls := entry.All()
+	dest := entry.Destination
+
+	logger.formatRepoDisplay(RepoDisplay{
+		Name:        strings.Join(urls, ", "),
+		Destination: dest.Path,
+	})
+
+	if len(urls) == 0 {
+		return errors.Errorf("url entry for %s has neither url nor urls", dest.Path)
+	}
+	if err := validateReplacements(entry.Options); err != nil {
+		return err
+	}
+	if entry.Options != nil && len(entry.Options.Patches) > 0 {
+		return errors.New("patches are only supported on copy entries")
+	}
+
+	names := make(map[string]string, len(urls))
+	for _, raw := range urls {
+		name, err := urlFileName(raw)
+		if err != nil {
+			return err
+		}
+		if other, ok := names[name]; ok {
+			return errors.Errorf("urls %s and %s are both written to %s", other, raw, name)
+		}
+		names[name] = raw
+	}
+
+	status, err := loadStatusFile(filepath.Join(dest.Path, ".copyrc.lock"))
+	if err != nil || status == nil {
+		status = &StatusFile{
+			CoppiedFiles:   make(map[string]StatusEntry),
+			GeneratedFiles: make(map[string]GeneratedFileEntry),
+		}
+	}
+
+	argsAreSame := slices.Equal(status.Args.URLs, urls) && sameArgs(status.Args.CopyArgs, entry.Options)
+
+	if flags.Frozen {
+		if err := checkFrozen(status, argsAreSame); err != nil {
+			return err
+		}
+	}
+
+	var offline map[string][]byte
+	if flags.Offline {
+		if !argsAreSame {
+			return errors.New("offline: configuration has changed since the lock file was written")
+		}
+		offline, err = offlineURLs(downloadCacheFromContext(ctx), status, names)
+		if err != nil {
+			return err
+		}
+	}
+
+	checkOnly := (flags.Status || flags.RemoteStatus) && !flags.Force
+	if checkOnly {
+		if !argsAreSame {
+			return errors.New("configuration has changed")
+		}
+		// For local status check, we're done
+		if !flags.RemoteStatus {
+			return nil
+		}
+	}
+
+	if flags.Clean {
+		if err := cleanDestination(ctx, status, dest.Path); err != nil {
+			return errors.Errorf("cleaning destination: %w", err)
+		}
+
+		if err := processUntracked(ctx, status, dest, false); err != nil {
+			return errors.Errorf("processing untracked files: %w", err)
+		}
+
+		logger.LogNewline()
+		return nil
+	}
+
+	if err := os.MkdirAll(dest.Path, 0755); err != nil {
+		return errors.Errorf("creating destination directory: %w", err)
+	}
+
+	// there is no repository to read a license from
+	status.License = LicenseEntry{SPDX: "NOASSERTION", Name: "Other"}
+	logger.longestNeighbor = status.GetLongestNeighbor()
+
+	var mu sync.Mutex
+	outOfDate := false
+	for _, raw := range urls {
+		name, err := urlFileName(raw)
+		if err != nil {
+			return err
+		}
+		outPath := filepath.Join(dest.Path, name)
+
+		// only a file we wrote with the same arguments can be kept as is
+		var prev *StatusEntry
+		if existing, ok := status.CoppiedFiles[name]; ok && argsAreSame && !flags.Force && !flags.Offline {
+			if _, err := os.Stat(outPath); err == nil {
+				prev = &existing
+			}
+		}
+
+		// frozen runs download unconditionally so the content itself is checked
+		conditional := prev
+		if flags.Frozen {
+			conditional = nil
+		}
+
+		var res *urlResponse
+		if flags.Offline {
+			locked := status.CoppiedFiles[name]
+			res = &urlResponse{
+				body:         offline[name],
+				etag:         locked.ETag,
+				lastModified: locked.LastModified,
+				sha256:       locked.Sha256,
+			}
+		} else {
+			res, err = fetchURL(ctx, raw, conditional)
+			if err != nil {
+				return err
+			}
+		}
+
+		// keep the content around for offline runs
+		if cache := downloadCacheFromContext(ctx); cache != nil && res.body != nil && !flags.Offline {
+			if _, err := cache.Get(urlCacheKey(raw, res.sha256), func() ([]byte, error) { return res.body, nil }); err != nil {
+				return err
+			}
+		}
+
+		if locked := status.CoppiedFiles[name]; flags.Frozen && res.sha256 != locked.Sha256 {
+			return errors.Errorf("frozen: checksum mismatch for %s: lock file has sha256 %s, downloaded content has %s", raw, locked.Sha256, res.sha256)
+		}
+
+		if prev != nil && (res.notModified || res.sha256 == prev.Sha256) {
+			if _, err := writeFile(ctx, WriteFileOpts{
+				SourcePath:    name,
+				Destination:   dest,
+				Path:          outPath,
+				Contents:      nil,
+				StatusFile:    status,
+				StatusMutex:   &mu,
+				EnsureNewline: true,
+			}); err != nil {
+				return errors.Errorf("writing file: %w", err)
+			}
+			prev.ETag = res.etag
+			prev.LastModified = res.lastModified
+			status.CoppiedFiles[name] = *prev
+			continue
+		}
+
+		if checkOnly {
+			outOfDate = true
+			continue
+		}
+
+		rendered, err := renderCopy(name, raw, status.License.SPDX, res.body, entry.Options)
+		if err != nil {
+			return err
+		}
+
+		if _, err := writeFile(ctx, WriteFileOpts{
+			SourcePath:       name,
+			Destination:      dest,
+			Path:             outPath,
+			Contents:         rendered.content,
+			StatusFile:       status,
+			StatusMutex:      &mu,
+			RepoSourceInfo:   raw,
+			Permalink:        raw,
+			Changes:          rendered.changes,
+			ReplacementCount: rendered.replacementCount,
+			Matched:          rendered.matched,
+			EnsureNewline:    true,
+			Sha256:           res.sha256,
+		}); err != nil {
+			return errors.Errorf("writing file: %w", err)
+		}
+
+		written := status.CoppiedFiles[name]
+		written.ETag = res.etag
+		written.LastModified = res.lastModified
+		status.CoppiedFiles[name] = written
+	}
+
+	if checkOnly {
+		if outOfDate {
+			return errors.New("files are out of date")
+		}
+		logger.LogNewline()
+		return nil
+	}
+
+	// drop the files of urls that were removed from the config
+	for name, file := range status.CoppiedFiles {
+		if _, ok := names[name]; ok {
+			continue
+		}
+		logger.AddFileOperation(FileInfo{Name: file.File, IsRemoved: true})
+		if err := deleteFile(ctx, filepath.Join(dest.Path, file.File)); err != nil && !os.IsNotExist(err) {
+			return errors.Errorf("removing file: %w", err)
+		}
+		delete(status.CoppiedFiles, name)
+	}
+
+	entries := make([]StatusEntry, 0, len(status.CoppiedFiles))
+	for _, file := range status.CoppiedFiles {
+		entries = append(entries, file)
+	}
+	if err := checkRequiredReplacements(entry.Options, entries); err != nil {
+		return err
+	}
+
+	status.CommitHash = ""
+	status.Ref = ""
+	status.Args = StatusFileArgs{
+		URLs:     urls,
+		CopyArgs: entry.Options,
+	}
+
+	if err := processUntracked(ctx, status, dest, false); err != nil {
+		return errors.Errorf("processing untracked files: %w", err)
+	}
+
+	if err := writeStatusFile(ctx, status, dest.Path); err != nil {
+		return errors.Errorf("writing status file: %w", err)
+	}
+
+	logger.LogNewline()
+	return nil
+}
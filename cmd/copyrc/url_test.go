@@ -0,0 +1,167 @@
+// Copyright 2025 walteh LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestURLFileName(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "https://json.schemastore.org/package.json", want: "package.json"},
+		{input: "https://example.com/releases/v1/tool.tar.gz?download=1", want: "tool.tar.gz"},
+		{input: "https://example.com/", wantErr: true},
+		{input: "ftp://example.com/file.txt", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := urlFileName(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestProcessURLs(t *testing.T) {
+	var mu sync.Mutex
+	files := map[string]string{
+		"/schema.json": `{"$id": "https://example.com/schema.json"}`,
+		"/spec.md":     "# Spec\n\nold wording\n",
+	}
+	var notModified int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		content, ok := files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sum := sha256.Sum256([]byte(content))
+		etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Wed, 01 Jan 2025 00:00:00 GMT")
+		_, _ = w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	logger := NewDiscardDebugLogger(os.Stdout)
+	ctx := NewLoggerInContext(context.Background(), logger)
+
+	entry := &URLEntry{
+		URL:         server.URL + "/schema.json",
+		URLs:        []string{server.URL + "/spec.md"},
+		Destination: Destination{Path: t.TempDir()},
+		Options: &CopyEntry_Options{
+			Replacements: []Replacement{{Old: "old wording", New: "new wording"}},
+		},
+	}
+
+	require.NoError(t, processURLs(ctx, entry, FlagsBlock{}))
+
+	spec, err := os.ReadFile(filepath.Join(entry.Destination.Path, "spec.md"))
+	require.NoError(t, err)
+	assert.Contains(t, string(spec), "🔗 source: "+server.URL+"/spec.md")
+	assert.Contains(t, string(spec), "new wording")
+
+	schema, err := os.ReadFile(filepath.Join(entry.Destination.Path, "schema.json"))
+	require.NoError(t, err)
+	assert.Equal(t, files["/schema.json"]+"\n", string(schema), "json files get no header")
+
+	status, err := loadStatusFile(filepath.Join(entry.Destination.Path, ".copyrc.lock"))
+	require.NoError(t, err)
+	assert.Empty(t, status.CommitHash)
+	sum := sha256.Sum256([]byte(files["/schema.json"]))
+	assert.Equal(t, hex.EncodeToString(sum[:]), status.CoppiedFiles["schema.json"].Sha256)
+	assert.NotEmpty(t, status.CoppiedFiles["schema.json"].ETag)
+	assert.Equal(t, "Wed, 01 Jan 2025 00:00:00 GMT", status.CoppiedFiles["spec.md"].LastModified)
+
+	t.Run("unchanged", func(t *testing.T) {
+		require.NoError(t, processURLs(ctx, entry, FlagsBlock{}))
+		assert.Equal(t, 2, notModified, "both urls are revalidated with a conditional request")
+
+		require.NoError(t, processURLs(ctx, entry, FlagsBlock{RemoteStatus: true}))
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		mu.Lock()
+		files["/spec.md"] = "# Spec\n\nold wording, revised\n"
+		mu.Unlock()
+
+		err := processURLs(ctx, entry, FlagsBlock{RemoteStatus: true})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "files are out of date")
+
+		require.NoError(t, processURLs(ctx, entry, FlagsBlock{}))
+		spec, err := os.ReadFile(filepath.Join(entry.Destination.Path, "spec.md"))
+		require.NoError(t, err)
+		assert.Contains(t, string(spec), "new wording, revised")
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		entry.URLs = nil
+		require.NoError(t, processURLs(ctx, entry, FlagsBlock{}))
+
+		_, err := os.Stat(filepath.Join(entry.Destination.Path, "spec.md"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("frozen", func(t *testing.T) {
+		require.NoError(t, processURLs(ctx, entry, FlagsBlock{Frozen: true}))
+
+		mu.Lock()
+		files["/schema.json"] = `{"$id": "https://example.com/schema-v2.json"}`
+		mu.Unlock()
+
+		err := processURLs(ctx, entry, FlagsBlock{Frozen: true})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "checksum mismatch")
+	})
+
+	t.Run("duplicate_names", func(t *testing.T) {
+		err := processURLs(ctx, &URLEntry{
+			URLs:        []string{server.URL + "/a/schema.json", server.URL + "/b/schema.json"},
+			Destination: Destination{Path: t.TempDir()},
+		}, FlagsBlock{})
+		require.Error(t, err)
+	})
+}
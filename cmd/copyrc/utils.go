@@ -19,7 +19,9 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -37,19 +39,32 @@ type WriteFileOpts struct {
 	Path       string // Path to write the file to
 	SourcePath string // Source path to write the file to
 	Contents   []byte // Contents to write to the file
+	// ContentsPath is a temp file moved into Path instead of writing Contents, so large downloads
+	// never sit in memory. Its sha256 is ContentsSha256, or Sha256 when that is empty.
+	ContentsPath   string
+	ContentsSha256 string
 	// FileType FileType // Type of file (managed/local/copy)
 
 	// Optional fields
 	StatusFile       *StatusFile // Full status file for checking existing entries
 	StatusMutex      *sync.Mutex // Mutex for status file access
 	ReplacementCount int         // Number of replacements made in the file
+	Matched          []int       // Indexes of the replacements that matched the file, for the status entry
 	EnsureNewline    bool        // Ensure contents end with a newline
 	RepoSourceInfo   string      // Source info for status entry
 	Permalink        string      // Permalink for status entry
 	Changes          []string    // Changes made to the file
+	BlobSha          string      // Upstream git blob sha for status entry
+	Sha256           string      // Digest of the upstream content for status entry
+	UpstreamPath     string      // Path in the source repository for status entry
+	Patches          []string    // Patch files applied to the contents for status entry
 	IsStatusFile     bool        // Whether this is a status file
 	IsUntracked      bool        // Whether this is an untracked file
 	IsManaged        bool        // Whether this is a managed file
+
+	// MergeBase renders the content copyrc wrote last time, customized files are merged with it
+	// when upstream moves. Customized files are left alone when it is nil.
+	MergeBase func() ([]byte, error)
 }
 
 // writeFile handles all file writing scenarios including status updates and logging.
@@ -75,6 +90,10 @@ func writeFile(ctx context.Context, opts WriteFileOpts) (bool, error) {
 		return false, errors.New("status file is required")
 	}
 
+	if opts.ContentsPath != "" {
+		return moveFile(ctx, opts, fileName)
+	}
+
 	if opts.IsStatusFile {
 		opts.IsManaged = true
 	}
@@ -89,6 +108,7 @@ func writeFile(ctx context.Context, opts WriteFileOpts) (bool, error) {
 	if err != nil && !os.IsNotExist(err) {
 		return false, errors.Errorf("reading file: %w", err)
 	}
+	missing := os.IsNotExist(err)
 
 	existingHashData := sha256.New()
 	existingHashData.Write(existing)
@@ -120,14 +140,41 @@ func writeFile(ctx context.Context, opts WriteFileOpts) (bool, error) {
 		}
 	}
 
+	// Ensure newline at end of file if requested
+	contents := opts.Contents
+	if opts.EnsureNewline && !bytes.HasSuffix(contents, []byte("\n")) {
+		contents = append(contents, '\n')
+	}
+
 	var encodedCustomizations string
-	if (remoteHash != "" && existingHash != remoteHash) || customizations != "" {
+	var merged []byte // the local customizations on top of the new upstream content
+	conflicted := false
+	// a deleted file is written again, not kept as a customization
+	if !missing && ((remoteHash != "" && existingHash != remoteHash) || customizations != "") {
 		isCustomized = true
 		dmp := diffmatchpatch.New()
 		if len(opts.Contents) > 0 {
-			diffs := dmp.DiffMain(string(existing), string(opts.Contents), false)
-			encodedCustomizations = dmp.DiffToDelta(diffs)
-			rcount = len(diffs)
+			local := existing
+			// upstream moved, bring its changes into the customized file
+			if opts.MergeBase != nil && remoteHash != "" && hashContents(contents) != remoteHash {
+				// going on would make the new upstream the merge base and lose its changes for good,
+				// failing rolls the entry back so the lock keeps the previous commit
+				base, err := opts.MergeBase()
+				if err != nil {
+					return false, errors.Errorf("cannot merge the upstream changes into customized %s: %w (revert or remove the local edits to take the upstream version)", fileName, err)
+				}
+				merged, conflicted = merge3(base, existing, contents)
+				local = merged
+			}
+
+			if merged != nil && bytes.Equal(merged, contents) {
+				// upstream made the same changes, the file is a plain copy again
+				isCustomized = false
+			} else {
+				diffs := dmp.DiffMain(string(local), string(opts.Contents), false)
+				encodedCustomizations = dmp.DiffToDelta(diffs)
+				rcount = len(diffs)
+			}
 		} else if customizations != "" {
 			diffs, err := dmp.DiffFromDelta(string(existing), customizations)
 			if err != nil {
@@ -140,7 +187,7 @@ func writeFile(ctx context.Context, opts WriteFileOpts) (bool, error) {
 		}
 	}
 
-	if hasEntry && len(opts.Contents) == 0 {
+	if hasEntry && opts.Contents == nil {
 		logFileOperation(ctx, FileInfo{
 			Name:         fileName,
 			IsCustomized: isCustomized,
@@ -150,21 +197,35 @@ func writeFile(ctx context.Context, opts WriteFileOpts) (bool, error) {
 		return false, nil
 	}
 
-	if len(opts.Contents) == 0 {
+	if opts.Contents == nil {
 		return false, errors.Errorf("contents are required for %s", opts.Path)
 	}
 
-	// Ensure newline at end of file if requested
-	contents := opts.Contents
-	if opts.EnsureNewline && !bytes.HasSuffix(contents, []byte("\n")) {
-		contents = append(contents, '\n')
-	}
-
 	logger := loggerFromContext(ctx)
 	logger.zlog.Debug().Msgf("👀 Writing file %s with contents length %d, curr len: %d, equal: %t", opts.Path, len(contents), len(existing), bytes.Equal(existing, contents))
 
 	// If file exists and content is the same, and we have an existing status entry, no need to write
 	if err == nil && bytes.Equal(existing, contents) && (hasEntry || opts.IsStatusFile) {
+		if !opts.IsManaged && opts.StatusMutex != nil {
+			opts.StatusMutex.Lock()
+			entry := opts.StatusFile.CoppiedFiles[fileName]
+			// a customized file that is now what copyrc renders (say a patch took over its
+			// edits) is a plain copy again
+			entry.RemoteHash = hashContents(contents)
+			entry.DiffDelta = ""
+			// digests can still be missing from locks written before they were recorded
+			if opts.BlobSha != "" || opts.Sha256 != "" {
+				entry.BlobSha = opts.BlobSha
+				entry.Sha256 = opts.Sha256
+				entry.Path = opts.UpstreamPath
+				entry.MatchedReplacements = opts.Matched
+				entry.Changes = opts.Changes
+				entry.Patches = opts.Patches
+			}
+			opts.StatusFile.CoppiedFiles[fileName] = entry
+			opts.StatusMutex.Unlock()
+		}
+
 		// Log the unchanged status
 		logFileOperation(ctx, FileInfo{
 			Name:         fileName,
@@ -188,19 +249,19 @@ func writeFile(ctx context.Context, opts WriteFileOpts) (bool, error) {
 	}
 
 	if !isCustomized {
-		// Ensure the directory exists
-		if err := os.MkdirAll(filepath.Dir(opts.Path), 0755); err != nil {
-			return false, errors.Errorf("creating directory for %s: %w", opts.Path, err)
+		if err := putFile(ctx, opts.Path, contents); err != nil {
+			return false, err
 		}
-
-		if err := os.WriteFile(opts.Path, contents, 0644); err != nil {
-			return false, errors.Errorf("writing file %s: %w", opts.Path, err)
+	} else if merged != nil {
+		if err := putFile(ctx, opts.Path, merged); err != nil {
+			return false, err
+		}
+		if conflicted {
+			recordConflict(ctx, fileName)
 		}
 	}
 
-	hashData := sha256.New()
-	hashData.Write(contents)
-	hash := base64.URLEncoding.EncodeToString(hashData.Sum(nil))
+	hash := hashContents(contents)
 
 	// Update status entries
 	now := time.Now().UTC()
@@ -228,6 +289,11 @@ func writeFile(ctx context.Context, opts WriteFileOpts) (bool, error) {
 			entry.Changes = opts.Changes
 			entry.DiffDelta = encodedCustomizations
 			entry.RemoteHash = hash
+			entry.BlobSha = opts.BlobSha
+			entry.Sha256 = opts.Sha256
+			entry.Path = opts.UpstreamPath
+			entry.MatchedReplacements = opts.Matched
+			entry.Patches = opts.Patches
 			opts.StatusFile.CoppiedFiles[fileName] = entry
 		}
 		opts.StatusMutex.Unlock()
@@ -241,11 +307,101 @@ func writeFile(ctx context.Context, opts WriteFileOpts) (bool, error) {
 	logFileOperation(ctx, FileInfo{
 		Name:         fileName,
 		IsNew:        len(existing) == 0 && len(contents) > 0,
-		IsModified:   true,
+		IsModified:   !isCustomized || merged != nil,
 		IsCustomized: isCustomized,
+		IsConflicted: conflicted,
 		IsManaged:    opts.IsManaged,
 		Replacements: rcount,
 	})
 
+	return !isCustomized || merged != nil, nil
+}
+
+// hashContents is the digest stored as remote_hash, of the content copyrc writes
+func hashContents(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return base64.URLEncoding.EncodeToString(sum[:])
+}
+
+// moveFile is writeFile for opts.ContentsPath: the existing file is hashed as a stream and the
+// temp file renamed over it, neither is read into memory
+func moveFile(ctx context.Context, opts WriteFileOpts, fileName string) (bool, error) {
+	contentsSum := opts.ContentsSha256
+	if contentsSum == "" {
+		contentsSum = opts.Sha256
+	}
+	sum, err := hex.DecodeString(contentsSum)
+	if err != nil || len(sum) != sha256.Size {
+		return false, errors.Errorf("moving %s: invalid sha256 %q", opts.ContentsPath, contentsSum)
+	}
+
+	existingSum, exists, err := hashFile(opts.Path)
+	if err != nil {
+		return false, err
+	}
+
+	opts.StatusMutex.Lock()
+	entry, hasEntry := opts.StatusFile.CoppiedFiles[fileName]
+	opts.StatusMutex.Unlock()
+
+	if exists && hasEntry && bytes.Equal(existingSum, sum) {
+		opts.StatusMutex.Lock()
+		entry.Sha256 = opts.Sha256
+		opts.StatusFile.CoppiedFiles[fileName] = entry
+		opts.StatusMutex.Unlock()
+
+		logFileOperation(ctx, FileInfo{
+			Name:       fileName,
+			IsModified: false,
+		})
+		return false, nil
+	}
+
+	if err := os.Chmod(opts.ContentsPath, 0644); err != nil {
+		return false, errors.Errorf("setting mode of %s: %w", opts.ContentsPath, err)
+	}
+	if err := moveFileInto(ctx, opts.Path, opts.ContentsPath); err != nil {
+		return false, err
+	}
+
+	opts.StatusMutex.Lock()
+	if !hasEntry {
+		entry = StatusEntry{File: fileName}
+	}
+	entry.LastUpdated = time.Now().UTC()
+	entry.Source = opts.RepoSourceInfo
+	entry.Permalink = opts.Permalink
+	entry.Changes = nil
+	entry.DiffDelta = ""
+	entry.RemoteHash = base64.URLEncoding.EncodeToString(sum)
+	entry.BlobSha = opts.BlobSha
+	entry.Sha256 = opts.Sha256
+	entry.Path = opts.UpstreamPath
+	opts.StatusFile.CoppiedFiles[fileName] = entry
+	opts.StatusMutex.Unlock()
+
+	logFileOperation(ctx, FileInfo{
+		Name:       fileName,
+		IsNew:      !exists,
+		IsModified: true,
+	})
 	return true, nil
 }
+
+// hashFile returns the sha256 of the file at path, false when there is none
+func hashFile(path string) ([]byte, bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Errorf("reading file: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, false, errors.Errorf("reading file: %w", err)
+	}
+	return h.Sum(nil), true, nil
+}
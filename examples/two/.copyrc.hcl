@@ -14,16 +14,12 @@ copy {
 			"pkg/generator/**/*.go",
 			"pkg/internal/**/*.go",
 		]
-		replacements = [
-			{
-				old = "package generator"
-				new = "package reformat"
-			},
-			{
-				old = "\"github.com/atombender/go-jsonschema/internal/x/text\""
-				new = "\"github.com/walteh/schema2go/pkg/reformat/internal/x/text\""
+		go {
+			package = { generator = "reformat" }
+			import_rewrites = {
+				"github.com/atombender/go-jsonschema/internal/x/text" = "github.com/walteh/schema2go/pkg/reformat/internal/x/text"
 			}
-		]
+		}
 	}
 }
 
@@ -43,11 +39,8 @@ copy {
 			"**/*.go",
 			"**/*.json",
 		]
-		replacements = [
-			{
-				old = "package test"
-				new = "package testdata"
-			}
-		]
+		go {
+			package = { test = "testdata" }
+		}
 	}
 }
\ No newline at end of file